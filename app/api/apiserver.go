@@ -1,15 +1,30 @@
 package api
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	_ "embed"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/device"
+	"github.com/parMaster/logserver/app/discovery"
+	"github.com/parMaster/logserver/app/influx"
+	"github.com/parMaster/logserver/app/publish"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
 	"github.com/parMaster/logserver/app/store"
 	"github.com/parMaster/logserver/app/web"
 )
@@ -22,24 +37,31 @@ import (
 // 5. Replace the NewApiServer call with a call to the factory function
 
 type ApiServer struct {
-	ctx    context.Context
-	config config.Config
-	store  store.Storer
+	ctx     context.Context
+	config  config.Config
+	store   store.Storer
+	service Service
 }
 
-func NewApiServer(ctx context.Context, config config.Config) *ApiServer {
-	l := &ApiServer{
-		ctx:    ctx,
-		config: config,
-	}
+// Service is the ingestion service reporting its state
+type Service interface {
+	Queues() []queue.Status
+	Ingest() []queue.IngestStats
+	Publisher() *publish.Publisher // nil if publishing is not configured
+	Devices() []device.Device
+	Catalog() *discovery.Catalog         // nil if discovery is not configured
+	Submit(d store.Data) error           // validates and writes the record, route.ErrRejected if it is rejected
+	Rejected() map[string]route.Rejected // values rejected by validation, by module/topic
+}
 
-	// Initialize database
-	err := store.Load(ctx, config, &l.store)
-	if err != nil {
-		log.Fatalf("Can't configure database %e", err)
+// NewApiServer creates the server of the storage and the service, service is optional
+func NewApiServer(ctx context.Context, config config.Config, db store.Storer, service Service) *ApiServer {
+	return &ApiServer{
+		ctx:     ctx,
+		config:  config,
+		store:   db,
+		service: service,
 	}
-
-	return l
 }
 
 func (l *ApiServer) Start() error {
@@ -71,6 +93,33 @@ func (l *ApiServer) router() http.Handler {
 	router := chi.NewRouter()
 
 	router.Get("/api/v1/check", l.HandleCheck)
+	router.Get("/api/v1/data/{module}", l.HandleData)
+	router.Get("/api/v1/status", l.HandleStatus)
+	router.Get("/api/v1/devices", l.HandleDevices)
+	router.Get("/api/v1/topics", l.HandleTopics)
+	router.Post("/api/v1/topics/preview", l.HandlePreview)
+	router.Get("/api/v1/spool", l.auth(l.HandleSpool))
+	router.Post("/api/v1/spool/flush", l.auth(l.HandleSpoolFlush))
+	router.Post("/api/v1/write", l.HandleWrite)
+	router.Post("/write", l.HandleInfluxWrite)
+	router.Post("/api/v2/write", l.HandleInfluxWrite)
+	router.Get("/ping", l.HandlePing)
+	router.Head("/ping", l.HandlePing)
+	router.Post("/api/v1/publish", l.publishing(l.auth(l.HandlePublish)))
+	router.Get("/api/v1/publish/topics", l.publishing(l.auth(l.HandlePublishTopics)))
+	router.Get("/api/v1/publish/audit", l.publishing(l.auth(l.HandleAudit)))
+
+	router.Get("/devices", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(web.Devices_html))
+	})
+
+	router.Get("/topics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(web.Topics_html))
+	})
+
+	router.Get("/publish", l.publishing(l.auth(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(web.Publish_html))
+	})))
 
 	router.Get("/web/chart_tpl.min.js", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Write([]byte(web.Chart_tpl_min_js))
@@ -112,3 +161,671 @@ func (l *ApiServer) HandleCheck(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[ERROR] %s", err.Error())
 	}
 }
+
+// status is the state of the ingestion
+type status struct {
+	Queues   []queue.Status            `json:"queues"`
+	Ingest   []queue.IngestStats       `json:"ingest"`
+	Rejected map[string]route.Rejected `json:"rejected"` // by module/topic
+}
+
+// HandleStatus returns the status of the broker connections, the counters of the ingest queues
+// and of the values rejected by validation
+//
+//	GET /api/v1/status
+func (l *ApiServer) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	if l.service == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status{Queues: l.service.Queues(), Ingest: l.service.Ingest(), Rejected: l.service.Rejected()}); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// HandleDevices returns the presence state of the devices ordered by name
+//
+//	GET /api/v1/devices
+func (l *ApiServer) HandleDevices(w http.ResponseWriter, r *http.Request) {
+	if l.service == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(l.service.Devices()); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// catalog returns the topic catalog of the service, nil if discovery is not configured
+func (l *ApiServer) catalog() *discovery.Catalog {
+	if l.service == nil {
+		return nil
+	}
+	return l.service.Catalog()
+}
+
+// HandleTopics returns the topics discovered under the root topics, ordered by broker connection and topic
+//
+//	GET /api/v1/topics
+func (l *ApiServer) HandleTopics(w http.ResponseWriter, r *http.Request) {
+	c := l.catalog()
+	if c == nil {
+		http.Error(w, "discovery is not configured, set mq_root_topic", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(c.Topics()); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// HandlePreview applies the route to the last payloads of the discovered topics and returns
+// the records it would store, the route is not added
+//
+//	POST /api/v1/topics/preview {"filter": "croco/cave/{name}", "module": "cave", "topic": "{name}"}
+func (l *ApiServer) HandlePreview(w http.ResponseWriter, r *http.Request) {
+	c := l.catalog()
+	if c == nil {
+		http.Error(w, "discovery is not configured, set mq_root_topic", http.StatusNotFound)
+		return
+	}
+	var rt config.Route
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&rt); err != nil {
+		http.Error(w, fmt.Sprintf("invalid route: %v", err), http.StatusBadRequest)
+		return
+	}
+	out, err := c.Preview(rt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// HandleSpool returns the counters of the spool of failed writes, with the spooled records if records=true.
+// Allowed to the publish users only, like the flush
+//
+//	GET /api/v1/spool?records=true
+func (l *ApiServer) HandleSpool(w http.ResponseWriter, r *http.Request) {
+	sp := store.FindSpool(l.store)
+	if sp == nil {
+		http.Error(w, "spool is not configured", http.StatusNotFound)
+		return
+	}
+	out := struct {
+		store.SpoolStats
+		Records []store.Data `json:"records,omitempty"`
+	}{SpoolStats: sp.Stats()}
+	if r.URL.Query().Get("records") == "true" {
+		var err error
+		if out.Records, err = sp.Records(); err != nil {
+			log.Printf("[ERROR] failed to read spool: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// HandleSpoolFlush writes the spooled records right away and returns the spool counters,
+// the records failed to write again are kept in the spool
+//
+//	POST /api/v1/spool/flush
+func (l *ApiServer) HandleSpoolFlush(w http.ResponseWriter, r *http.Request) {
+	sp := store.FindSpool(l.store)
+	if sp == nil {
+		http.Error(w, "spool is not configured", http.StatusNotFound)
+		return
+	}
+	n, err := sp.Flush()
+	out := struct {
+		Written int    `json:"written"`
+		Error   string `json:"error,omitempty"`
+		store.SpoolStats
+	}{Written: n, SpoolStats: sp.Stats()}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		out.Error = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// publisher returns the publisher of the service, nil if publishing is not configured
+func (l *ApiServer) publisher() *publish.Publisher {
+	if l.service == nil || !l.config.Publish.Enabled() {
+		return nil
+	}
+	return l.service.Publisher()
+}
+
+// auth allows the requests of the publish users only, with basic auth. Nothing is allowed without the users
+func (l *ApiServer) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(l.config.Publish.Users) == 0 {
+			http.Error(w, "users are not configured, see publish.users", http.StatusNotFound)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		expected, known := l.config.Publish.Users[user]
+		if !ok || !known || subtle.ConstantTimeCompare([]byte(password), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="logserver", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// publishing allows the requests only if publishing is configured
+func (l *ApiServer) publishing(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.publisher() == nil {
+			http.Error(w, "publishing is not configured", http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandlePublish publishes the command to the whitelisted topic and returns the audit log entry of it.
+// The command is rejected with 403 if the topic is not allowed and with 400 if it fails validation
+//
+//	POST /api/v1/publish {"topic": "croco/cave/targetTemperature", "payload": "28", "qos": 1, "retained": true}
+func (l *ApiServer) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	// json content type can't be sent cross-site without preflight, so the browser credentials are not abused
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var c publish.Command
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&c); err != nil {
+		http.Error(w, fmt.Sprintf("invalid command: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	user, _, _ := r.BasicAuth()
+	e, err := l.publisher().Publish(user, c)
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case errors.Is(err, publish.ErrForbidden):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, publish.ErrInvalid):
+		w.WriteHeader(http.StatusBadRequest)
+	case err != nil:
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// HandlePublishTopics returns the topics allowed to publish to
+//
+//	GET /api/v1/publish/topics
+func (l *ApiServer) HandlePublishTopics(w http.ResponseWriter, r *http.Request) {
+	type topic struct {
+		Topic    string   `json:"topic"`
+		Broker   string   `json:"broker"`
+		QoS      byte     `json:"qos"`
+		Retained bool     `json:"retained"`
+		Values   []string `json:"values,omitempty"`
+	}
+	out := []topic{}
+	for _, t := range l.publisher().Topics() {
+		out = append(out, topic{Topic: t.Topic, Broker: t.Broker, QoS: t.QoS, Retained: t.Retained, Values: t.Values})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// HandleAudit returns the last entries of the audit log of the commands, the newest first, 100 by default
+//
+//	GET /api/v1/publish/audit?limit=100
+func (l *ApiServer) HandleAudit(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	out, err := l.publisher().Audit(limit)
+	if err != nil {
+		log.Printf("[ERROR] failed to read audit log: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// maxPoints limits the points of a write request
+const maxPoints = 10000
+
+// errWrite marks the points failed to be written to the storage, not the fault of the client
+var errWrite = errors.New("write failed")
+
+// point is the record written over http
+type point struct {
+	Module string          `json:"module"`
+	Topic  string          `json:"topic"`
+	Value  json.RawMessage `json:"value"` // number, string or bool
+	Time   json.RawMessage `json:"time"`  // RFC3339 or unix seconds, receive time if not set
+}
+
+// data converts the point to the record, timestamped with now if the time is not set
+func (p point) data(now time.Time) (store.Data, error) {
+	d := store.Data{Module: p.Module, Topic: p.Topic, DateTime: now}
+	if d.Module == "" || d.Topic == "" {
+		return d, errors.New("module and topic are required")
+	}
+
+	var value string
+	switch v := bytes.TrimSpace(p.Value); {
+	case len(v) == 0 || string(v) == "null":
+		return d, errors.New("value is required")
+	case v[0] == '"':
+		if err := json.Unmarshal(v, &value); err != nil {
+			return d, fmt.Errorf("invalid value: %w", err)
+		}
+	case v[0] == '{' || v[0] == '[':
+		return d, errors.New("value must be a number, string or bool")
+	default:
+		value = string(v)
+	}
+	d.Value = store.ParseValue(value)
+
+	switch t := bytes.TrimSpace(p.Time); {
+	case len(t) == 0 || string(t) == "null":
+	case t[0] == '"':
+		var s string
+		if err := json.Unmarshal(t, &s); err != nil {
+			return d, fmt.Errorf("invalid time: %w", err)
+		}
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return d, fmt.Errorf("invalid time %q, expected RFC3339 or unix seconds", s)
+		}
+		d.DateTime = ts
+	default:
+		sec, err := strconv.ParseFloat(string(t), 64)
+		if err != nil {
+			return d, fmt.Errorf("invalid time %s, expected RFC3339 or unix seconds", t)
+		}
+		d.DateTime = time.Unix(0, int64(sec*float64(time.Second)))
+	}
+	return d, nil
+}
+
+// writeResult reports the points written and the errors of the others by their index in the request
+type writeResult struct {
+	Written int          `json:"written"`
+	Errors  []pointError `json:"errors,omitempty"`
+}
+
+type pointError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// writer authenticates the client writing the records by the bearer token. Influx clients send the token
+// as v2 "Token" authorization, v1 basic auth password or p query parameter, the latter is only accepted
+// from v1 clients, query strings end up in access logs
+func (l *ApiServer) writer(r *http.Request) (config.WriteToken, bool) {
+	var token string
+	if r.URL.Path == "/write" {
+		token = r.URL.Query().Get("p")
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") || strings.HasPrefix(h, "Token ") {
+		token = h[strings.Index(h, " ")+1:]
+	}
+	if token == "" {
+		return config.WriteToken{}, false
+	}
+	for _, t := range l.config.Write.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+			return t, true
+		}
+	}
+	return config.WriteToken{}, false
+}
+
+// HandleWrite writes a single point or a batch of them for the devices which can't publish to mqtt.
+// Points are validated with the checks of the routes rendering their module and topic, the response
+// reports the errors by point index: 400 if any point is rejected, 500 if any failed to be written
+//
+//	POST /api/v1/write {"module": "nas", "topic": "disk/free", "value": 42.5, "time": "2023-01-01T10:00:00Z"}
+//	POST /api/v1/write [{"module": "nas", "topic": "disk/free", "value": 42.5, "time": 1672567200}, ...]
+func (l *ApiServer) HandleWrite(w http.ResponseWriter, r *http.Request) {
+	if l.service == nil || len(l.config.Write.Tokens) == 0 {
+		http.Error(w, "writing is not configured", http.StatusNotFound)
+		return
+	}
+	client, ok := l.writer(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="logserver"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4*1024*1024))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read points: %v", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var points []point
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &points)
+	} else {
+		var p point
+		err = json.Unmarshal(body, &p)
+		points = append(points, p)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid points: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(points) > maxPoints {
+		http.Error(w, fmt.Sprintf("too many points, max %d", maxPoints), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	now := time.Now()
+	data, errs := make([]store.Data, len(points)), make([]error, len(points))
+	for i, p := range points {
+		data[i], errs[i] = p.data(now)
+	}
+	res, status := l.writeData(client, data, errs)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// writeData writes the records of the client, errs holds the errors of the points failed to be parsed.
+// Returns the result and the response status: 400 if any point is rejected, 500 if any failed to be written
+func (l *ApiServer) writeData(client config.WriteToken, data []store.Data, errs []error) (writeResult, int) {
+	res, status := writeResult{}, http.StatusOK
+	for i, d := range data {
+		err := errs[i]
+		if err == nil {
+			err = l.submit(client, d)
+		}
+		if err == nil {
+			res.Written++
+			continue
+		}
+		res.Errors = append(res.Errors, pointError{Index: i, Error: err.Error()})
+		if errors.Is(err, errWrite) {
+			status = http.StatusInternalServerError
+		} else if status == http.StatusOK {
+			status = http.StatusBadRequest
+		}
+	}
+	if len(res.Errors) > 0 {
+		log.Printf("[WARN] %d of %d points of %s are not written, the first: %s", len(res.Errors), len(data), client.Name, res.Errors[0].Error)
+	}
+	return res, status
+}
+
+// submit validates and writes the record of the client, storage failures are errWrite
+func (l *ApiServer) submit(client config.WriteToken, d store.Data) error {
+	if !client.Allows(d.Module) {
+		return fmt.Errorf("module %s is not allowed", d.Module)
+	}
+	if d.DateTime.After(time.Now().Add(5 * time.Minute)) {
+		return fmt.Errorf("time %s is in the future", d.DateTime.Format(time.RFC3339))
+	}
+	err := l.service.Submit(d)
+	if err != nil && !errors.Is(err, route.ErrRejected) {
+		log.Printf("[ERROR] failed to write %s/%s of %s: %v", d.Module, d.Topic, client.Name, err)
+		return fmt.Errorf("%w: %v", errWrite, err)
+	}
+	return err
+}
+
+// HandleInfluxWrite writes InfluxDB line protocol for Telegraf and the firmware speaking Influx v1 and v2,
+// a record per field of every line. Module and topic are rendered with write.influx templates, db and bucket
+// are ignored. Responds with 204 if every record is written, otherwise with the Influx error of the failed lines
+//
+//	POST /write?db=telegraf&precision=s
+//	POST /api/v2/write?org=home&bucket=telegraf&precision=ns
+func (l *ApiServer) HandleInfluxWrite(w http.ResponseWriter, r *http.Request) {
+	if l.service == nil || len(l.config.Write.Tokens) == 0 {
+		influxError(w, http.StatusNotFound, "not found", "writing is not configured")
+		return
+	}
+	client, ok := l.writer(r)
+	if !ok {
+		influxError(w, http.StatusUnauthorized, "unauthorized", "unauthorized access")
+		return
+	}
+	precision, err := influx.Precision(r.URL.Query().Get("precision"))
+	if err != nil {
+		influxError(w, http.StatusBadRequest, "invalid", err.Error())
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, 16*1024*1024)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			influxError(w, http.StatusBadRequest, "invalid", fmt.Sprintf("invalid gzip body: %v", err))
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	module, topic := l.config.Write.Influx.Module, l.config.Write.Influx.Topic
+	if module == "" {
+		module = "{measurement}"
+	}
+	if topic == "" {
+		topic = "{tags}/{field}"
+	}
+
+	// records of a line share its number for the error report
+	var data []store.Data
+	var errs []error
+	var lines []int
+	now := time.Now()
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		p, err := influx.ParseLine(line, precision)
+		var records []store.Data
+		if err == nil {
+			records, err = p.Data(module, topic, now)
+		}
+		if err != nil {
+			data, errs, lines = append(data, store.Data{}), append(errs, err), append(lines, n)
+			continue
+		}
+		for _, d := range records {
+			data, errs, lines = append(data, d), append(errs, nil), append(lines, n)
+		}
+		if len(data) > maxPoints {
+			influxError(w, http.StatusRequestEntityTooLarge, "too large", fmt.Sprintf("too many points, max %d", maxPoints))
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		influxError(w, http.StatusBadRequest, "invalid", fmt.Sprintf("failed to read lines: %v", err))
+		return
+	}
+
+	res, status := l.writeData(client, data, errs)
+	if status == http.StatusOK {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	msg := fmt.Sprintf("%d of %d points are not written", len(res.Errors), len(data))
+	for i, e := range res.Errors {
+		if i == 10 {
+			msg += "; ..."
+			break
+		}
+		msg += fmt.Sprintf("; line %d: %s", lines[e.Index], e.Error)
+	}
+	code := "invalid"
+	if status == http.StatusInternalServerError {
+		code = "internal error"
+	}
+	influxError(w, status, code, msg)
+}
+
+// influxError responds with the error in the form of Influx v2, v1 clients take the message from the header
+func influxError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Influxdb-Error", message)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message}); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// HandlePing answers the health checks of Influx clients
+//
+//	GET /ping
+func (l *ApiServer) HandlePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Influxdb-Build", "logserver")
+	w.Header().Set("X-Influxdb-Version", "1.8")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// series is the data of a topic in the form suitable for charts
+type series struct {
+	X []time.Time   `json:"x"`
+	Y []store.Value `json:"y"`
+}
+
+// HandleData returns the records of the module grouped by topic, query parameters:
+// topic - optional, can be repeated; from and to - optional time bounds, see parseTime;
+// step - optional bucket size like "5m", "1h", "1d" or "auto", raw records if not set;
+// agg - aggregate function of the buckets, avg by default, see store.ParseAgg
+//
+//	GET /api/v1/data/cave?topic=temp&topic=heater&from=-24h&step=auto&agg=max
+func (l *ApiServer) HandleData(w http.ResponseWriter, r *http.Request) {
+	if l.store == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	q := store.Query{Module: chi.URLParam(r, "module"), Topics: r.URL.Query()["topic"]}
+	var err error
+	now := time.Now()
+	if q.From, err = parseTime(r.URL.Query().Get("from"), now); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseTime(r.URL.Query().Get("to"), now); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Step, err = parseStep(r.URL.Query().Get("step"), q.From, q.To); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Agg, err = store.ParseAgg(r.URL.Query().Get("agg")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := l.store.Range(q)
+	if errors.Is(err, store.ErrRecordNotFound) {
+		http.Error(w, "module not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, store.ErrRollupAgg) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to get range of %s: %v", q.Module, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	out := map[string]*series{}
+	for _, d := range data {
+		if _, ok := out[d.Topic]; !ok {
+			out[d.Topic] = &series{}
+		}
+		out[d.Topic].X = append(out[d.Topic].X, d.DateTime)
+		out[d.Topic].Y = append(out[d.Topic].Y, d.Value)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		log.Printf("[ERROR] %s", err.Error())
+	}
+}
+
+// parseTime parses RFC3339 time, local date "2006-01-02" or date and time "2006-01-02 15:04",
+// or duration relative to now, like "-24h" or "-7d". Empty string is zero time
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02 15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return now.AddDate(0, 0, days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// parseStep parses bucket size: Go duration of a millisecond or more, days like "1d" or "auto" to choose by the range
+func parseStep(s string, from, to time.Time) (time.Duration, error) {
+	switch {
+	case s == "":
+		return 0, nil
+	case s == "auto":
+		return store.AutoStep(from, to), nil
+	case strings.HasSuffix(s, "d"):
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && days > 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	default:
+		if d, err := time.ParseDuration(s); err == nil && d >= time.Millisecond {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid step %q", s)
+}
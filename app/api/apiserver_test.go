@@ -0,0 +1,570 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/device"
+	"github.com/parMaster/logserver/app/discovery"
+	"github.com/parMaster/logserver/app/publish"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseTime(t *testing.T) {
+
+	now := time.Date(2023, 5, 6, 7, 8, 9, 0, time.UTC)
+	tbl := []struct {
+		in  string
+		out time.Time
+		err bool
+	}{
+		{"", time.Time{}, false},
+		{"2023-01-02T03:04:05Z", time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"2023-01-02", time.Date(2023, 1, 2, 0, 0, 0, 0, time.Local), false},
+		{"2023-01-02 03:04", time.Date(2023, 1, 2, 3, 4, 0, 0, time.Local), false},
+		{"-24h", now.Add(-24 * time.Hour), false},
+		{"-7d", now.AddDate(0, 0, -7), false},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tbl {
+		out, err := parseTime(tt.in, now)
+		if tt.err {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		assert.NoError(t, err, tt.in)
+		assert.True(t, tt.out.Equal(out), tt.in)
+	}
+}
+
+func Test_parseStep(t *testing.T) {
+
+	to := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	tbl := []struct {
+		in  string
+		out time.Duration
+		err bool
+	}{
+		{"", 0, false},
+		{"5m", 5 * time.Minute, false},
+		{"1d", 24 * time.Hour, false},
+		{"auto", time.Minute, false},
+		{"0d", 0, true},
+		{"-1h", 0, true},
+		{"500us", 0, true},
+		{"1ms", time.Millisecond, false},
+		{"often", 0, true},
+	}
+	for _, tt := range tbl {
+		out, err := parseStep(tt.in, to.Add(-time.Hour), to)
+		if tt.err {
+			assert.Error(t, err, tt.in)
+			continue
+		}
+		assert.NoError(t, err, tt.in)
+		assert.Equal(t, tt.out, out, tt.in)
+	}
+}
+
+func Test_HandleData(t *testing.T) {
+
+	s := store.NewMemoryStore()
+	l := &ApiServer{store: s}
+	ts := httptest.NewServer(l.router())
+	defer ts.Close()
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		s.Write(store.Data{Module: "cave", DateTime: start.Add(time.Duration(i) * time.Minute), Topic: "temp", Value: store.FloatValue(20 + float64(i))})
+		s.Write(store.Data{Module: "cave", DateTime: start.Add(time.Duration(i) * time.Minute), Topic: "heater", Value: store.BoolValue(i%2 == 0)})
+	}
+
+	resp, err := http.Get(ts.URL + "/api/v1/data/cave?topic=temp&from=2023-01-01T00:01:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	out := map[string]struct {
+		X []time.Time
+		Y []float64
+	}{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	resp.Body.Close()
+	assert.Len(t, out, 1)
+	assert.Equal(t, []float64{21, 22}, out["temp"].Y)
+	assert.True(t, start.Add(time.Minute).Equal(out["temp"].X[0]))
+
+	resp, err = http.Get(ts.URL + "/api/v1/data/cave?topic=temp&step=1h&agg=max")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	resp.Body.Close()
+	assert.Equal(t, []float64{22}, out["temp"].Y)
+
+	for _, q := range []string{"step=0", "step=500us", "step=fast", "agg=median"} {
+		resp, err = http.Get(ts.URL + "/api/v1/data/cave?" + q)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, q)
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(ts.URL + "/api/v1/data/nosuchmodule")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/api/v1/data/cave?from=whenever")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+
+	// the range reaching the rollups can't have max of the bucket averages
+	l.store = store.NewRetention(s, []config.Retention{{Module: "cave", Keep: config.Keep{Raw: config.Duration(24 * time.Hour)}}})
+	resp, err = http.Get(ts.URL + "/api/v1/data/cave?topic=temp&step=1h&agg=max")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+}
+
+// mockService reports the fixed status
+type mockService struct {
+	status    []queue.Status
+	ingest    []queue.IngestStats
+	publisher *publish.Publisher
+	devices   []device.Device
+	catalog   *discovery.Catalog
+	submit    func(d store.Data) error
+	rejected  map[string]route.Rejected
+}
+
+func (m mockService) Queues() []queue.Status              { return m.status }
+func (m mockService) Ingest() []queue.IngestStats         { return m.ingest }
+func (m mockService) Publisher() *publish.Publisher       { return m.publisher }
+func (m mockService) Devices() []device.Device            { return m.devices }
+func (m mockService) Catalog() *discovery.Catalog         { return m.catalog }
+func (m mockService) Submit(d store.Data) error           { return m.submit(d) }
+func (m mockService) Rejected() map[string]route.Rejected { return m.rejected }
+
+// senderFunc publishes the messages with the function
+type senderFunc func(broker string, m queue.Message) error
+
+func (f senderFunc) Publish(broker string, m queue.Message) error { return f(broker, m) }
+
+func Test_HandleStatus(t *testing.T) {
+
+	ts := httptest.NewServer((&ApiServer{}).router())
+	resp, err := http.Get(ts.URL + "/api/v1/status")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	resp.Body.Close()
+	ts.Close()
+
+	svc := mockService{
+		status: []queue.Status{{Name: "default", Type: "local", Connected: true, Received: 3}, {Name: "office", Type: "mqtt"}},
+		ingest: []queue.IngestStats{{Topic: "croco/#", Policy: "drop-oldest", Capacity: 10, Received: 3, Processed: 2, Dropped: 1}},
+		rejected: map[string]route.Rejected{"probes/ds18b20/1": {Count: 2, Reason: "rejected value -127", Value: "-127",
+			Time: time.Date(2023, 1, 1, 0, 1, 0, 0, time.UTC)}},
+		devices: []device.Device{{Name: "ESP32-1", Broker: "default", Online: true, Messages: 3,
+			FirstSeen: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC), LastSeen: time.Date(2023, 1, 1, 0, 1, 0, 0, time.UTC)}},
+	}
+	ts = httptest.NewServer(NewApiServer(context.Background(), config.Config{}, store.NewMemoryStore(), svc).router())
+	defer ts.Close()
+
+	resp, err = http.Get(ts.URL + "/api/v1/status")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var out status
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	resp.Body.Close()
+	assert.Equal(t, svc.ingest, out.Ingest)
+	assert.Equal(t, svc.status, out.Queues)
+	assert.Equal(t, svc.rejected, out.Rejected)
+
+	resp, err = http.Get(ts.URL + "/api/v1/devices")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var devices []device.Device
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&devices))
+	resp.Body.Close()
+	assert.Equal(t, svc.devices, devices)
+}
+
+func Test_HandleSpool(t *testing.T) {
+
+	ts := httptest.NewServer((&ApiServer{store: store.NewMemoryStore()}).router())
+	resp, err := http.Get(ts.URL + "/api/v1/spool")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp.Body.Close()
+	ts.Close()
+
+	spoolFile := path.Join(t.TempDir(), "spool.jsonl")
+	assert.NoError(t, os.WriteFile(spoolFile, []byte(`{"module":"cave","datetime":"2023-01-01T00:00:00Z","topic":"temp","value":21}`+"\n"), 0o600))
+	db := store.NewMemoryStore()
+	sp, err := store.OpenSpool(db, config.Spool{Path: spoolFile})
+	assert.NoError(t, err)
+	defer sp.Close()
+	ts = httptest.NewServer((&ApiServer{store: sp}).router())
+	resp, err = http.Get(ts.URL + "/api/v1/spool")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "users are not configured")
+	resp.Body.Close()
+	ts.Close()
+
+	cfg := config.Config{Publish: config.Publish{Users: map[string]string{"admin": "secret"}}}
+	ts = httptest.NewServer((&ApiServer{config: cfg, store: sp}).router())
+	defer ts.Close()
+	request := func(method, url, password string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+url, nil)
+		assert.NoError(t, err)
+		req.SetBasicAuth("admin", password)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+	for _, r := range [][2]string{{"GET", "/api/v1/spool?records=true"}, {"POST", "/api/v1/spool/flush"}} {
+		resp = request(r[0], r[1], "wrong")
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, r[1])
+		resp.Body.Close()
+	}
+
+	resp = request("GET", "/api/v1/spool?records=true", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	out := struct {
+		store.SpoolStats
+		Records []store.Data
+		Written int
+	}{}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	resp.Body.Close()
+	assert.Equal(t, 1, out.Pending)
+	assert.Len(t, out.Records, 1)
+
+	resp = request("POST", "/api/v1/spool/flush", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&out))
+	resp.Body.Close()
+	assert.Equal(t, 1, out.Written)
+	assert.Zero(t, out.Pending)
+
+	topics, err := db.Topics("cave")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"temp"}, topics)
+}
+
+func Test_HandlePublish(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := config.Config{Publish: config.Publish{
+		Users:    map[string]string{"admin": "secret"},
+		AuditLog: path.Join(t.TempDir(), "audit.jsonl"),
+		Topics:   []config.PublishTopic{{Topic: "croco/cave/targetTemperature", QoS: 1}},
+	}}
+
+	ts := httptest.NewServer(NewApiServer(ctx, cfg, nil, mockService{}).router())
+	resp, err := http.Get(ts.URL + "/api/v1/publish/topics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "publisher is not configured")
+	resp.Body.Close()
+	ts.Close()
+
+	q := queue.NewLocal()
+	assert.NoError(t, q.Connect(ctx))
+	msgs := make(chan queue.Message, 10)
+	assert.NoError(t, q.Subscribe(queue.Subscription{Topic: "#", Messages: msgs}))
+	p, err := publish.New(cfg.Publish, "default", senderFunc(func(_ string, m queue.Message) error { return q.Publish(m) }))
+	assert.NoError(t, err)
+	ts = httptest.NewServer(NewApiServer(ctx, cfg, nil, mockService{publisher: p}).router())
+	defer ts.Close()
+
+	post := func(user, password, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/publish", strings.NewReader(body))
+		assert.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.SetBasicAuth(user, password)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("admin", "wrong", `{"topic":"croco/cave/targetTemperature","payload":"28"}`).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, post("bob", "", `{"topic":"croco/cave/targetTemperature","payload":"28"}`).StatusCode)
+	assert.Equal(t, http.StatusOK, post("admin", "secret", `{"topic":"croco/cave/targetTemperature","payload":"28","qos":1}`).StatusCode)
+	assert.Equal(t, http.StatusForbidden, post("admin", "secret", `{"topic":"croco/cave/heater","payload":"1"}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, post("admin", "secret", `{"topic":"croco/cave/targetTemperature","payload":"28","retained":true}`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, post("admin", "secret", `{"topic":`).StatusCode)
+
+	select {
+	case m := <-msgs:
+		assert.Equal(t, "croco/cave/targetTemperature", m.Topic)
+		assert.Equal(t, "28", m.Payload)
+		assert.Equal(t, byte(1), m.QoS)
+	case <-time.After(time.Second):
+		t.Fatal("command is not published")
+	}
+
+	// forms can't be posted cross-site with the browser credentials
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/publish", strings.NewReader("topic=croco/cave/targetTemperature&payload=28"))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/v1/publish/audit?limit=2", nil)
+	assert.NoError(t, err)
+	req.SetBasicAuth("admin", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var audit []publish.Entry
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&audit))
+	resp.Body.Close()
+	assert.Len(t, audit, 2)
+	assert.Equal(t, "admin", audit[0].User)
+	assert.Equal(t, publish.Rejected, audit[0].Result)
+	assert.Equal(t, publish.Rejected, audit[1].Result)
+}
+
+func Test_HandleTopics(t *testing.T) {
+
+	ts := httptest.NewServer(NewApiServer(context.Background(), config.Config{}, nil, mockService{}).router())
+	resp, err := http.Get(ts.URL + "/api/v1/topics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "discovery is not configured")
+	resp.Body.Close()
+	ts.Close()
+
+	c := discovery.New(nil, 0)
+	c.Observe("default", "croco/cave/temperature", "23.5")
+	c.Observe("default", "croco/cave/light", "on")
+	ts = httptest.NewServer(NewApiServer(context.Background(), config.Config{}, nil, mockService{catalog: c}).router())
+	defer ts.Close()
+
+	resp, err = http.Get(ts.URL + "/api/v1/topics")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var topics []discovery.Topic
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&topics))
+	resp.Body.Close()
+	assert.Len(t, topics, 2)
+	assert.Equal(t, "croco/cave/light", topics[0].Topic)
+	assert.Equal(t, "string", topics[0].Type)
+
+	resp, err = http.Post(ts.URL+"/api/v1/topics/preview", "application/json",
+		strings.NewReader(`{"filter":"croco/cave/{name}","module":"cave","topic":"{name}","rename":{"temperature":"temp"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var preview discovery.Preview
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&preview))
+	resp.Body.Close()
+	require.Len(t, preview.Records, 2)
+	assert.Equal(t, "light", preview.Records[0].Topic)
+	assert.Equal(t, "temp", preview.Records[1].Topic)
+	assert.Equal(t, store.FloatValue(23.5), preview.Records[1].Value)
+
+	resp, err = http.Post(ts.URL+"/api/v1/topics/preview", "application/json", strings.NewReader(`{"filter":"croco/cave/{name}"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "module is required")
+	resp.Body.Close()
+}
+
+func Test_HandleWrite(t *testing.T) {
+
+	ts := httptest.NewServer(NewApiServer(context.Background(), config.Config{}, nil, mockService{}).router())
+	resp, err := http.Post(ts.URL+"/api/v1/write", "application/json", strings.NewReader(`{}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "writing is not configured")
+	resp.Body.Close()
+	ts.Close()
+
+	max := 100.0
+	router, err := route.New([]config.Route{{Filter: "nas/{name}", Module: "nas", Topic: "{name}", Validate: config.Validate{Max: &max}}})
+	require.NoError(t, err)
+	db := store.NewMemoryStore()
+	svc := mockService{submit: func(d store.Data) error {
+		if err := router.Check(d); err != nil {
+			return err
+		}
+		if d.Topic == "broken" {
+			return errors.New("disk is full")
+		}
+		return db.Write(d)
+	}}
+	cfg := config.Config{Write: config.Write{Tokens: []config.WriteToken{
+		{Name: "nas", Token: "secret", Modules: []string{"nas"}},
+		{Name: "shelly", Token: "plug"},
+	}}}
+	ts = httptest.NewServer(NewApiServer(context.Background(), cfg, nil, svc).router())
+	defer ts.Close()
+
+	write := func(token, query, body string) (int, writeResult) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/write"+query, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var res writeResult
+		if resp.Header.Get("Content-Type") == "application/json" {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		}
+		return resp.StatusCode, res
+	}
+
+	code, _ := write("", "", `{"module":"nas","topic":"disk","value":42}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = write("wrong", "", `{"module":"nas","topic":"disk","value":42}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = write("", "?token=secret", `{"module":"nas","topic":"disk","value":42}`)
+	assert.Equal(t, http.StatusUnauthorized, code, "token is not accepted in the url")
+	code, _ = write("", "?p=secret", `{"module":"nas","topic":"disk","value":42}`)
+	assert.Equal(t, http.StatusUnauthorized, code, "influx v1 token parameter is not accepted")
+	code, _ = write("secret", "", `{"module":`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, res := write("secret", "", `{"module":"nas","topic":"disk","value":42.5,"time":"2023-01-01T10:00:00Z"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, writeResult{Written: 1}, res)
+
+	// per point errors, the valid points are written
+	code, res = write("secret", "", `[
+		{"module":"nas","topic":"disk","value":43,"time":1672567260},
+		{"module":"nas","topic":"disk","value":142},
+		{"module":"office","topic":"temp","value":21},
+		{"module":"nas","topic":"status","value":"ok"},
+		{"module":"nas","topic":"disk"},
+		{"module":"nas","topic":"disk","value":{"free":1}},
+		{"module":"nas","topic":"disk","value":1,"time":"yesterday"},
+		{"module":"nas","topic":"disk","value":1,"time":"2100-01-01T00:00:00Z"},
+		{"module":"nas","value":1}
+	]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, 2, res.Written)
+	var indexes []int
+	for _, e := range res.Errors {
+		indexes = append(indexes, e.Index)
+	}
+	assert.Equal(t, []int{1, 2, 4, 5, 6, 7, 8}, indexes)
+	assert.Contains(t, res.Errors[0].Error, "above max")
+	assert.Contains(t, res.Errors[1].Error, "not allowed")
+
+	code, res = write("plug", "", `[{"module":"nas","topic":"power","value":true},{"module":"nas","topic":"broken","value":1}]`)
+	assert.Equal(t, http.StatusInternalServerError, code, "storage failure")
+	assert.Equal(t, 1, res.Written)
+	code, res = write("plug", "", `[{"module":"plug","topic":"power","value":true},{"module":"nas@5m","topic":"disk","value":1}]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	require.Len(t, res.Errors, 2)
+	assert.Contains(t, res.Errors[0].Error, "no route renders")
+	assert.Contains(t, res.Errors[1].Error, "reserved for rollups")
+
+	data, err := db.Range(store.Query{Module: "nas", Topics: []string{"disk"}})
+	require.NoError(t, err)
+	require.Len(t, data, 2)
+	assert.True(t, time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC).Equal(data[0].DateTime))
+	assert.Equal(t, store.FloatValue(42.5), data[0].Value)
+	assert.True(t, time.Date(2023, 1, 1, 10, 1, 0, 0, time.UTC).Equal(data[1].DateTime), "unix seconds")
+	status, err := db.Range(store.Query{Module: "nas", Topics: []string{"status"}})
+	require.NoError(t, err)
+	require.Len(t, status, 1)
+	assert.Equal(t, store.StringValue("ok"), status[0].Value)
+}
+
+func Test_HandleInfluxWrite(t *testing.T) {
+
+	max := 100.0
+	router, err := route.New([]config.Route{{Filter: "{host}/cpu/{name}", Module: "cpu", Topic: "{host}/{name}", Validate: config.Validate{Max: &max}}})
+	require.NoError(t, err)
+	db := store.NewMemoryStore()
+	svc := mockService{submit: func(d store.Data) error {
+		if err := router.Check(d); err != nil {
+			return err
+		}
+		return db.Write(d)
+	}}
+	cfg := config.Config{Write: config.Write{
+		Tokens: []config.WriteToken{{Name: "telegraf", Token: "secret"}},
+		Influx: config.Influx{Topic: "{host}/{field}"},
+	}}
+	ts := httptest.NewServer(NewApiServer(context.Background(), cfg, nil, svc).router())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ping")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	write := func(path string, body []byte, auth func(r *http.Request)) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		auth(req)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	v1 := func(r *http.Request) { r.SetBasicAuth("telegraf", "secret") }
+	v2 := func(r *http.Request) { r.Header.Set("Authorization", "Token secret") }
+
+	resp = write("/write?db=telegraf", []byte("cpu,host=nas usage_idle=98.2"), func(r *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = write("/write?db=telegraf&precision=d", []byte("cpu,host=nas usage_idle=98.2"), v1)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	// v1 clients may send the token as p query parameter, v2 ones may not
+	resp = write("/write?db=telegraf&p=secret&precision=d", []byte("cpu,host=nas usage_idle=98.2"), func(r *http.Request) {})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = write("/api/v2/write?bucket=telegraf&p=secret", []byte("cpu,host=nas usage_idle=98.2"), func(r *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = write("/write?db=telegraf&precision=s", []byte("# comment\ncpu,host=nas usage_idle=98.2,usage_user=1i 1672567200\n\n"), v1)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	// telegraf v2 output compresses the body
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err = gz.Write([]byte("cpu,host=nas usage_idle=97 1672567260000\ncpu,host=nas usage_idle=197 1672567320000\nmem,host=nas used=abc\n"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v2/write?org=home&bucket=telegraf&precision=ms", &buf)
+	require.NoError(t, err)
+	v2(req)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var influxErr map[string]string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&influxErr))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid", influxErr["code"])
+	assert.Contains(t, influxErr["message"], "2 of 3 points are not written; line 2: rejected: above max 100; line 3: field used")
+
+	data, err := db.Range(store.Query{Module: "cpu"})
+	require.NoError(t, err)
+	assert.Len(t, data, 3)
+	data, err = db.Range(store.Query{Module: "cpu", Topics: []string{"nas/usage_idle"}})
+	require.NoError(t, err)
+	require.Len(t, data, 2)
+	assert.True(t, time.Unix(1672567200, 0).Equal(data[0].DateTime))
+	assert.Equal(t, store.FloatValue(97), data[1].Value)
+	assert.True(t, time.Unix(1672567260, 0).Equal(data[1].DateTime), "ms precision")
+}
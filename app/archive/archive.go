@@ -0,0 +1,331 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+)
+
+// file names are "raw-<period start>.jsonl.gz" and "raw-<period start>-<seq>.jsonl.gz" for the files
+// of the same period written after restart
+const (
+	prefix = "raw-"
+	suffix = ".jsonl.gz"
+	layout = "20060102T150405Z"
+)
+
+// Record is the archived message
+type Record struct {
+	Time     time.Time `json:"time"` // receive time
+	Broker   string    `json:"broker"`
+	Topic    string    `json:"topic"`
+	Payload  string    `json:"payload"`          // utf-8 payload, binary payloads are kept in Binary
+	Binary   []byte    `json:"binary,omitempty"` // payload which is not valid utf-8, base64 encoded
+	Retained bool      `json:"retained,omitempty"`
+}
+
+// Writer appends the records to gzip compressed JSON lines files, a file per rotation period.
+// Existing files are not appended, so the torn tail of the file written by the interrupted process
+// is the only loss
+type Writer struct {
+	dir    string
+	rotate time.Duration
+	keep   time.Duration // files are kept forever if zero
+
+	mu    sync.Mutex
+	file  *os.File
+	gz    *gzip.Writer
+	start time.Time // period start of the open file
+	dirty bool      // records written since the last flush
+}
+
+// NewWriter creates the archive directory, files are opened on write
+func NewWriter(cfg config.Archive) (*Writer, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("archive directory is not set")
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+	w := &Writer{dir: cfg.Dir, rotate: cfg.Rotate}
+	if w.rotate <= 0 {
+		w.rotate = 24 * time.Hour
+	}
+	if cfg.Keep > 0 {
+		w.keep = time.Duration(cfg.Keep)
+	}
+	return w, nil
+}
+
+// Write archives the message received on the broker connection
+func (w *Writer) Write(broker string, m queue.Message, received time.Time) error {
+	r := newRecord(broker, m, received)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if start := r.Time.Truncate(w.rotate); w.file == nil || !start.Equal(w.start) {
+		if err := w.close(); err != nil {
+			log.Printf("[WARN] failed to close archive file: %v", err)
+		}
+		if err := w.open(start); err != nil {
+			return err
+		}
+	}
+	w.dirty = true
+	return json.NewEncoder(w.gz).Encode(r)
+}
+
+func newRecord(broker string, m queue.Message, received time.Time) Record {
+	r := Record{Time: received.UTC(), Broker: broker, Topic: m.Topic, Payload: m.Payload, Retained: m.Retained}
+	if !utf8.ValidString(m.Payload) {
+		r.Payload, r.Binary = "", []byte(m.Payload)
+	}
+	return r
+}
+
+// open creates the next file of the period, called with the lock held
+func (w *Writer) open(start time.Time) error {
+	for seq := 0; ; seq++ {
+		f, err := os.OpenFile(filepath.Join(w.dir, name(start, seq)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create archive file: %w", err)
+		}
+		w.file, w.gz, w.start = f, gzip.NewWriter(f), start
+		return nil
+	}
+}
+
+func name(start time.Time, seq int) string {
+	if seq == 0 {
+		return prefix + start.Format(layout) + suffix
+	}
+	return fmt.Sprintf("%s%s-%d%s", prefix, start.Format(layout), seq, suffix)
+}
+
+// Flush writes the compressed records to the file
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.gz == nil || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.gz.Flush()
+}
+
+// Close completes the gzip stream and closes the file, next write creates a new one
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
+func (w *Writer) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.file, w.gz, w.dirty = nil, nil, false
+	return err
+}
+
+// Prune removes the files of the periods ended before the keep duration, nothing is removed without it
+func (w *Writer) Prune(now time.Time) (removed int, err error) {
+	if w.keep == 0 {
+		return 0, nil
+	}
+	files, err := list(w.dir)
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, f := range files {
+		end := f.start.Add(w.rotate)
+		if next, ok := nextStart(files, i); ok {
+			end = next
+		}
+		if !end.Before(now.Add(-w.keep)) || (w.file != nil && f.start.Equal(w.start)) {
+			continue
+		}
+		if err = os.Remove(f.path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Run flushes the records every interval and prunes the expired files hourly until the context is done
+func (w *Writer) Run(ctx context.Context, interval time.Duration) {
+	flush := time.NewTicker(interval)
+	defer flush.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+	w.prune()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flush.C:
+			if err := w.Flush(); err != nil {
+				log.Printf("[WARN] failed to flush archive: %v", err)
+			}
+		case <-prune.C:
+			w.prune()
+		}
+	}
+}
+
+func (w *Writer) prune() {
+	n, err := w.Prune(time.Now())
+	if err != nil {
+		log.Printf("[WARN] failed to prune archive: %v", err)
+	}
+	if n > 0 {
+		log.Printf("[INFO] %d expired archive files removed", n)
+	}
+}
+
+// file is the archive file of the period started at start
+type file struct {
+	path  string
+	start time.Time
+	seq   int
+}
+
+// list returns the archive files of the directory in order
+func list(dir string) ([]file, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []file
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix), "-", 2)
+		start, err := time.Parse(layout, parts[0])
+		if err != nil {
+			continue
+		}
+		f := file{path: filepath.Join(dir, name), start: start}
+		if len(parts) == 2 {
+			if f.seq, err = strconv.Atoi(parts[1]); err != nil {
+				continue
+			}
+		}
+		res = append(res, f)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].start.Equal(res[j].start) {
+			return res[i].start.Before(res[j].start)
+		}
+		return res[i].seq < res[j].seq
+	})
+	return res, nil
+}
+
+// nextStart returns the start of the next period after the file i, the end of the file period
+func nextStart(files []file, i int) (time.Time, bool) {
+	for _, f := range files[i+1:] {
+		if f.start.After(files[i].start) {
+			return f.start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Read calls fn for the archived records received within [from, to), in order of the files.
+// Zero bounds are open. Torn tail of the file written by the interrupted process is skipped
+func Read(dir string, from, to time.Time, fn func(Record) error) error {
+	files, err := list(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list archive: %w", err)
+	}
+	for i, f := range files {
+		if !to.IsZero() && !f.start.Before(to) {
+			break
+		}
+		if next, ok := nextStart(files, i); ok && !from.IsZero() && !next.After(from) {
+			continue
+		}
+		if err := read(f.path, from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFile calls fn for the records of the single file, archived or recorded, in order
+func ReadFile(path string, fn func(Record) error) error {
+	return read(path, time.Time{}, time.Time{}, fn)
+}
+
+// read calls fn for the records of the file within the bounds, files without .gz extension are not compressed
+func read(path string, from, to time.Time, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		r = gz
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Printf("[WARN] skipping invalid record at %s:%d: %v", path, line, err)
+			continue
+		}
+		if (!from.IsZero() && r.Time.Before(from)) || (!to.IsZero() && !r.Time.Before(to)) {
+			continue
+		}
+		if r.Binary != nil {
+			r.Payload, r.Binary = string(r.Binary), nil
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		// the file being written or torn by a crash ends with an incomplete record
+		log.Printf("[WARN] %s is read up to an incomplete record: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Archive(t *testing.T) {
+
+	dir := t.TempDir()
+	w, err := NewWriter(config.Archive{Dir: dir, Rotate: time.Hour, Keep: config.Duration(2 * time.Hour)})
+	require.NoError(t, err)
+
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 6; i++ {
+		// every 20 minutes, three records per file
+		m := queue.Message{Topic: "croco/cave/temperature", Payload: "23.5"}
+		if i == 1 {
+			m = queue.Message{Topic: "croco/cave/raw", Payload: "\xff\x00bin", Retained: true}
+		}
+		require.NoError(t, w.Write("default", m, start.Add(time.Duration(i)*20*time.Minute)))
+	}
+	require.NoError(t, w.Flush())
+
+	// the records flushed are readable while the file is written
+	var records []Record
+	collect := func(r Record) error {
+		records = append(records, r)
+		return nil
+	}
+	require.NoError(t, Read(dir, time.Time{}, time.Time{}, collect))
+	assert.Len(t, records, 6)
+	require.NoError(t, w.Close())
+
+	// restart writes the next file of the period
+	require.NoError(t, w.Write("office", queue.Message{Topic: "office/temp", Payload: "21"}, start.Add(110*time.Minute)))
+	require.NoError(t, w.Close())
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "raw-20230101T100000Z.jsonl.gz"),
+		filepath.Join(dir, "raw-20230101T110000Z-1.jsonl.gz"),
+		filepath.Join(dir, "raw-20230101T110000Z.jsonl.gz"),
+	}, files)
+
+	records = nil
+	require.NoError(t, Read(dir, start.Add(20*time.Minute), start.Add(81*time.Minute), collect))
+	require.Len(t, records, 4)
+	assert.Equal(t, Record{Time: start.Add(20 * time.Minute), Broker: "default", Topic: "croco/cave/raw", Payload: "\xff\x00bin", Retained: true}, records[0])
+	assert.Equal(t, start.Add(80*time.Minute), records[3].Time)
+
+	records = nil
+	require.NoError(t, Read(dir, start.Add(time.Hour), time.Time{}, collect))
+	require.Len(t, records, 4)
+	assert.Equal(t, "office", records[3].Broker, "files of the period are read in order")
+
+	// torn tail of the interrupted write is skipped
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(files[0], data[:len(data)-10], 0o600))
+	records = nil
+	require.NoError(t, Read(dir, time.Time{}, start.Add(time.Hour), collect))
+	assert.Len(t, records, 3)
+
+	// periods ended before the keep duration are removed
+	n, err := w.Prune(start.Add(4 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	files, err = filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func Test_Recorder(t *testing.T) {
+
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	for _, name := range []string{"traffic.jsonl", "traffic.jsonl.gz"} {
+		path := filepath.Join(t.TempDir(), name)
+		r, err := Create(path)
+		require.NoError(t, err)
+		require.NoError(t, r.Write("default", queue.Message{Topic: "croco/cave/temperature", Payload: "23.5"}, start))
+		require.NoError(t, r.Write("office", queue.Message{Topic: "office/raw", Payload: "\xff", Retained: true}, start.Add(time.Second)))
+		require.NoError(t, r.Flush())
+		assert.Equal(t, int64(2), r.Count())
+		require.NoError(t, r.Close())
+
+		_, err = Create(path)
+		assert.Error(t, err, "recording is not overwritten")
+
+		var records []Record
+		require.NoError(t, ReadFile(path, func(r Record) error {
+			records = append(records, r)
+			return nil
+		}))
+		assert.Equal(t, []Record{
+			{Time: start, Broker: "default", Topic: "croco/cave/temperature", Payload: "23.5"},
+			{Time: start.Add(time.Second), Broker: "office", Topic: "office/raw", Payload: "\xff", Retained: true},
+		}, records, name)
+	}
+}
@@ -0,0 +1,82 @@
+package archive
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/logserver/app/queue"
+)
+
+// Recorder writes the records to a single JSON lines file of the archive format, gzip compressed
+// if the file name ends with .gz. Recordings are read with ReadFile
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer // nil if not compressed
+	enc  *json.Encoder
+	n    int64
+}
+
+// Create creates the recording file, existing file is not overwritten
+func Create(path string) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	r := &Recorder{file: f}
+	var w io.Writer = f
+	if strings.HasSuffix(path, ".gz") {
+		r.gz = gzip.NewWriter(f)
+		w = r.gz
+	}
+	r.enc = json.NewEncoder(w)
+	return r, nil
+}
+
+// Write records the message received on the broker connection
+func (r *Recorder) Write(broker string, m queue.Message, received time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(newRecord(broker, m, received)); err != nil {
+		return err
+	}
+	r.n++
+	return nil
+}
+
+// Count returns the number of the records written
+func (r *Recorder) Count() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.n
+}
+
+// Flush writes the compressed records to the file
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gz == nil {
+		return nil
+	}
+	return r.gz.Flush()
+}
+
+// Close completes the gzip stream and closes the file
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var err error
+	if r.gz != nil {
+		err = r.gz.Close()
+	}
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,282 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+)
+
+// Broker is an embedded MQTT 3.1.1 broker with QoS 0 and 1. Messages are routed by the in-process queue,
+// so the service subscribes to the broker like to any other Queue. Sessions are clean, QoS 1 messages
+// are not redelivered and messages are dropped for the clients not keeping up with them
+type Broker struct {
+	*queue.Local
+	cfg      config.Broker
+	upstream queue.Queue // bridge target, nil if disabled
+
+	mu       sync.Mutex
+	sessions map[string]*session // by client id
+	addrs    []net.Addr
+	seq      int64 // generated client and subscriber ids
+}
+
+const (
+	connectTimeout = 10 * time.Second // time to send CONNECT after the connection is accepted
+	maxConnectSize = 64 * 1024        // CONNECT with the will message, credentials and client id
+)
+
+// New creates the broker, the messages are forwarded to the upstream queue if it is not nil
+func New(cfg config.Broker, upstream queue.Queue) *Broker {
+	if cfg.BridgeFilter == "" {
+		cfg.BridgeFilter = "#"
+	}
+	return &Broker{
+		Local:    queue.NewLocal(),
+		cfg:      cfg,
+		upstream: upstream,
+		sessions: map[string]*session{},
+	}
+}
+
+// Connect starts the listeners and the bridge, they are stopped when the context is done
+func (b *Broker) Connect(ctx context.Context) error {
+	if err := b.Local.Connect(ctx); err != nil {
+		return err
+	}
+
+	if b.cfg.Listen != "" {
+		ln, err := net.Listen("tcp", b.cfg.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", b.cfg.Listen, err)
+		}
+		b.serve(ctx, ln)
+	}
+
+	if b.cfg.TLSListen != "" {
+		cert, err := tls.LoadX509KeyPair(b.cfg.TLSCert, b.cfg.TLSKey)
+		if err != nil {
+			return fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		ln, err := tls.Listen("tcp", b.cfg.TLSListen, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", b.cfg.TLSListen, err)
+		}
+		b.serve(ctx, ln)
+	}
+
+	if b.upstream != nil {
+		return b.bridge(ctx)
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the listeners
+func (b *Broker) Addrs() []net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]net.Addr{}, b.addrs...)
+}
+
+func (b *Broker) Status() queue.Status {
+	st := b.Local.Status()
+	st.Type = "broker"
+	var addrs []string
+	for _, a := range b.Addrs() {
+		addrs = append(addrs, a.String())
+	}
+	st.Broker = strings.Join(addrs, ", ")
+	b.mu.Lock()
+	st.Clients = len(b.sessions)
+	b.mu.Unlock()
+	return st
+}
+
+// serve accepts the connections until the context is done
+func (b *Broker) serve(ctx context.Context, ln net.Listener) {
+	b.mu.Lock()
+	b.addrs = append(b.addrs, ln.Addr())
+	b.mu.Unlock()
+	log.Printf("[INFO] MQTT broker listening on %s", ln.Addr())
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("[WARN] failed to accept connection: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go b.handle(ctx, conn)
+		}
+	}()
+}
+
+// bridge forwards the messages upstream while it is connected, they are dropped otherwise
+func (b *Broker) bridge(ctx context.Context) error {
+	// upstream may be unreachable on start, the client reconnects by itself once connected
+	queue.Retry(ctx, b.upstream, 10*time.Second)
+
+	msgs := make(chan queue.Message, 1000)
+	if err := b.Subscribe(queue.Subscription{Topic: b.cfg.BridgeFilter, Messages: msgs, Lossy: true, ID: "bridge"}); err != nil {
+		return fmt.Errorf("failed to subscribe bridge: %w", err)
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case m := <-msgs:
+				if !b.upstream.Status().Connected {
+					continue
+				}
+				if err := b.upstream.Publish(m); err != nil {
+					log.Printf("[WARN] failed to forward %s upstream: %v", m.Topic, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// authorized checks the credentials, anonymous clients are allowed if there are no users
+func (b *Broker) authorized(username, password string) bool {
+	if len(b.cfg.Users) == 0 {
+		return true
+	}
+	p, ok := b.cfg.Users[username]
+	return ok && subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+}
+
+// handle serves the client connection
+func (b *Broker) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// CONNECT is read before the client is authorized, slow and oversized ones are dropped
+	conn.SetReadDeadline(time.Now().Add(connectTimeout)) // nolint
+	p, err := readPacket(conn, maxConnectSize)
+	if err != nil {
+		log.Printf("[DEBUG] failed to read connect packet from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	cp, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		log.Printf("[DEBUG] %s sent %s before connect", conn.RemoteAddr(), p)
+		return
+	}
+
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.ReturnCode = cp.Validate()
+	if ack.ReturnCode == packets.Accepted && !b.authorized(cp.Username, string(cp.Password)) {
+		ack.ReturnCode = packets.ErrRefusedNotAuthorised
+	}
+	if ack.ReturnCode != packets.Accepted {
+		log.Printf("[WARN] refused %s connection from %s: %s", cp.ClientIdentifier, conn.RemoteAddr(), packets.ConnackReturnCodes[ack.ReturnCode])
+		ack.Write(conn) // nolint
+		return
+	}
+
+	s := b.register(conn, cp)
+	defer b.unregister(s)
+	if err = s.write(ack); err != nil {
+		return
+	}
+	log.Printf("[INFO] client %s connected from %s", s.id, conn.RemoteAddr())
+
+	go s.writeLoop()
+	if graceful := s.readLoop(ctx, cp.Keepalive); !graceful && s.will != nil {
+		if err := b.Publish(*s.will); err != nil {
+			log.Printf("[WARN] failed to publish will of %s: %v", s.id, err)
+		}
+	}
+	log.Printf("[INFO] client %s disconnected", s.id)
+}
+
+// readPacket reads the packet of the remaining length up to max bytes, the larger one is not allocated
+func readPacket(r io.Reader, max int) (packets.ControlPacket, error) {
+	header := make([]byte, 1, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	// remaining length is encoded in up to 4 bytes, 7 bits each
+	var length, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		header = append(header, b[0])
+		length |= int(b[0]&0x7f) << shift
+		if b[0]&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	if length > max {
+		return nil, fmt.Errorf("packet of %d bytes exceeds %d", length, max)
+	}
+	return packets.ReadPacket(io.MultiReader(bytes.NewReader(header), r))
+}
+
+// register adds the session of the client, the session of the same client id is taken over
+func (b *Broker) register(conn net.Conn, cp *packets.ConnectPacket) *session {
+	seq := atomic.AddInt64(&b.seq, 1)
+	id := cp.ClientIdentifier
+	if id == "" {
+		id = fmt.Sprintf("logserver-%d", seq)
+	}
+	s := newSession(b, conn, id, fmt.Sprintf("client:%s:%d", id, seq))
+	if cp.WillFlag {
+		s.will = &queue.Message{Topic: cp.WillTopic, Payload: string(cp.WillMessage), Retained: cp.WillRetain, QoS: min(cp.WillQos, 1)}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if old, ok := b.sessions[id]; ok {
+		log.Printf("[INFO] client %s reconnected, closing the previous connection", id)
+		old.conn.Close()
+	}
+	b.sessions[id] = s
+	return s
+}
+
+func (b *Broker) unregister(s *session) {
+	b.Unsubscribe(s.subID, "")
+	close(s.done)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sessions[s.id] == s {
+		delete(b.sessions, s.id)
+	}
+}
+
+func min(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,266 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connect(t *testing.T, addr, id, password string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + addr)
+	opts.SetClientID(id)
+	opts.SetUsername("esp32")
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(false)
+	c := mqtt.NewClient(opts)
+	token := c.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	if token.Error() == nil {
+		t.Cleanup(func() { c.Disconnect(0) })
+	}
+	return c, token.Error()
+}
+
+// receive returns the message without the receive time
+func receive(t *testing.T, ch chan queue.Message) queue.Message {
+	select {
+	case m := <-ch:
+		m.Time = time.Time{}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("message is not received")
+	}
+	return queue.Message{}
+}
+
+func Test_Broker(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := queue.NewLocal()
+	b := New(config.Broker{Listen: "127.0.0.1:0", Users: map[string]string{"esp32": "secret"}, Bridge: true, BridgeFilter: "croco/#"}, upstream)
+	var _ queue.Queue = b
+	require.NoError(t, b.Connect(ctx))
+	require.Len(t, b.Addrs(), 1)
+	addr := b.Addrs()[0].String()
+	assert.Equal(t, "broker", b.Status().Type)
+	assert.True(t, b.Status().Connected)
+
+	// service subscribes internally
+	internal := make(chan queue.Message, 10)
+	require.NoError(t, b.Subscribe(queue.Subscription{Topic: "croco/+/temp", Messages: internal}))
+	forwarded := make(chan queue.Message, 10)
+	require.NoError(t, upstream.Subscribe(queue.Subscription{Topic: "#", Messages: forwarded}))
+
+	_, err := connect(t, addr, "intruder", "wrong")
+	assert.Error(t, err)
+
+	sub, err := connect(t, addr, "sub", "secret")
+	require.NoError(t, err)
+	subscribed := make(chan queue.Message, 10)
+	token := sub.Subscribe("croco/#", 1, func(_ mqtt.Client, m mqtt.Message) {
+		subscribed <- queue.Message{Topic: m.Topic(), Payload: string(m.Payload()), Retained: m.Retained(), QoS: m.Qos()}
+	})
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	pub, err := connect(t, addr, "pub", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, 2, b.Status().Clients)
+
+	// QoS 1 publish is acknowledged
+	token = pub.Publish("croco/cave/temp", 1, false, "23.5")
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+
+	assert.Equal(t, queue.Message{Topic: "croco/cave/temp", Payload: "23.5", QoS: 1}, receive(t, subscribed))
+	assert.Equal(t, queue.Message{Topic: "croco/cave/temp", Payload: "23.5", QoS: 1}, receive(t, internal))
+	assert.Equal(t, queue.Message{Topic: "croco/cave/temp", Payload: "23.5", QoS: 1}, receive(t, forwarded))
+
+	// retained message is delivered to the new subscription
+	token = pub.Publish("croco/cave/target", 0, true, "25")
+	require.True(t, token.WaitTimeout(5*time.Second))
+	assert.Equal(t, "croco/cave/target", receive(t, subscribed).Topic)
+
+	late, err := connect(t, addr, "late", "secret")
+	require.NoError(t, err)
+	retained := make(chan queue.Message, 10)
+	late.Subscribe("croco/+/target", 0, func(_ mqtt.Client, m mqtt.Message) {
+		retained <- queue.Message{Topic: m.Topic(), Payload: string(m.Payload()), Retained: m.Retained()}
+	})
+	assert.Equal(t, queue.Message{Topic: "croco/cave/target", Payload: "25", Retained: true}, receive(t, retained))
+
+	// unsubscribed client gets nothing
+	token = sub.Unsubscribe("croco/#")
+	require.True(t, token.WaitTimeout(5*time.Second))
+	pub.Publish("croco/cave/temp", 0, false, "24").WaitTimeout(5 * time.Second)
+	assert.Equal(t, "24", receive(t, internal).Payload)
+	select {
+	case m := <-subscribed:
+		t.Fatalf("unexpected message %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_Broker_Client(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := New(config.Broker{Listen: "127.0.0.1:0"}, nil)
+	require.NoError(t, b.Connect(ctx))
+	c, err := queue.NewClient(config.Mqtt{MqBrokerURL: "tcp://" + b.Addrs()[0].String(), MqClientId: "client"})
+	require.NoError(t, err)
+
+	// subscriptions of the same filter, like the archive and the route of "#", get the message
+	// stamped with the same receive time
+	require.NoError(t, c.Connect(ctx))
+	require.Eventually(t, func() bool { return c.Status().Connected }, time.Second, 10*time.Millisecond)
+	route, archived, light := make(chan queue.Message, 10), make(chan queue.Message, 10), make(chan queue.Message, 10)
+	require.NoError(t, c.Subscribe(queue.Subscription{Topic: "croco/+/temp", Messages: route}))
+	require.NoError(t, c.Subscribe(queue.Subscription{Topic: "croco/+/temp", Messages: archived}))
+	require.NoError(t, c.Subscribe(queue.Subscription{Topic: "croco/+/light", Messages: light}))
+	assert.NoError(t, c.Publish(queue.Message{Topic: "croco/cave/temp", Payload: "23.5", QoS: 1}))
+
+	m := <-route
+	assert.Equal(t, "23.5", m.Payload)
+	assert.WithinDuration(t, time.Now(), m.Time, time.Second)
+	assert.Equal(t, m.Time, (<-archived).Time)
+	assert.Empty(t, light)
+	assert.Equal(t, int64(1), c.Status().Received)
+}
+
+func Test_Broker_Will(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := New(config.Broker{Listen: "127.0.0.1:0"}, nil)
+	require.NoError(t, b.Connect(ctx))
+	wills := make(chan queue.Message, 10)
+	require.NoError(t, b.Subscribe(queue.Subscription{Topic: "croco/+/status", Messages: wills}))
+
+	conn, err := net.Dial("tcp", b.Addrs()[0].String())
+	require.NoError(t, err)
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName, cp.ProtocolVersion, cp.CleanSession = "MQTT", 4, true
+	cp.WillFlag, cp.WillTopic, cp.WillMessage = true, "croco/cave/status", []byte("offline")
+	require.NoError(t, cp.Write(conn))
+	p, err := packets.ReadPacket(conn)
+	require.NoError(t, err)
+	assert.EqualValues(t, packets.Accepted, p.(*packets.ConnackPacket).ReturnCode)
+	assert.Eventually(t, func() bool { return b.Status().Clients == 1 }, time.Second, 10*time.Millisecond)
+
+	// will is published when the connection is lost without DISCONNECT
+	conn.Close()
+	assert.Equal(t, queue.Message{Topic: "croco/cave/status", Payload: "offline"}, receive(t, wills))
+	assert.Eventually(t, func() bool { return b.Status().Clients == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func Test_Broker_ConnectSize(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := New(config.Broker{Listen: "127.0.0.1:0"}, nil)
+	require.NoError(t, b.Connect(ctx))
+
+	// oversized CONNECT is refused before its body is read
+	conn, err := net.Dial("tcp", b.Addrs()[0].String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{packets.Connect << 4, 0xff, 0xff, 0xff, 0x7f})
+	require.NoError(t, err)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF, "connection is closed")
+
+	cp := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	cp.ProtocolName, cp.ProtocolVersion, cp.ClientIdentifier = "MQTT", 4, "esp32"
+	var buf bytes.Buffer
+	require.NoError(t, cp.Write(&buf))
+	p, err := readPacket(bytes.NewReader(buf.Bytes()), maxConnectSize)
+	require.NoError(t, err)
+	assert.Equal(t, "esp32", p.(*packets.ConnectPacket).ClientIdentifier)
+	_, err = readPacket(bytes.NewReader(buf.Bytes()), 10)
+	assert.Error(t, err)
+	_, err = readPacket(bytes.NewReader([]byte{packets.Connect << 4, 0xff, 0xff, 0xff, 0xff, 0x7f}), maxConnectSize)
+	assert.Error(t, err, "malformed remaining length")
+}
+
+// selfSigned writes the self-signed certificate of the name and its key to the directory
+func selfSigned(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return certFile, keyFile
+}
+
+func Test_Broker_TLS(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	cert, key := selfSigned(t, dir, "broker.test")
+	clientCert, clientKey := selfSigned(t, dir, "client.test")
+	b := New(config.Broker{TLSListen: "127.0.0.1:0", TLSCert: cert, TLSKey: key}, nil)
+	require.NoError(t, b.Connect(ctx))
+	received := make(chan queue.Message, 10)
+	require.NoError(t, b.Subscribe(queue.Subscription{Topic: "croco/#", Messages: received}))
+	url := "ssl://" + b.Addrs()[0].String()
+
+	// broker certificate is verified against the pinned CA and the server name
+	untrusted, err := queue.NewClient(config.Mqtt{MqBrokerURL: url, MqClientId: "untrusted", ConnectTimeout: time.Second})
+	require.NoError(t, err)
+	assert.Error(t, untrusted.Connect(ctx))
+
+	c, err := queue.NewClient(config.Mqtt{MqBrokerURL: url, MqClientId: "tls", CAFile: cert, ServerName: "broker.test",
+		CertFile: clientCert, KeyFile: clientKey, KeepAlive: 10 * time.Second, ConnectTimeout: time.Second})
+	require.NoError(t, err)
+	require.NoError(t, c.Connect(ctx))
+	assert.NoError(t, c.Publish(queue.Message{Topic: "croco/cave/temp", Payload: "23.5", QoS: 1}))
+	assert.Equal(t, queue.Message{Topic: "croco/cave/temp", Payload: "23.5", QoS: 1}, receive(t, received))
+
+	insecure, err := queue.NewClient(config.Mqtt{MqBrokerURL: url, MqClientId: "insecure", Insecure: true})
+	require.NoError(t, err)
+	assert.NoError(t, insecure.Connect(ctx))
+}
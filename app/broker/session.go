@@ -0,0 +1,190 @@
+package broker
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/parMaster/logserver/app/queue"
+)
+
+// session is the state of a connected client
+type session struct {
+	b     *Broker
+	conn  net.Conn
+	id    string // client id
+	subID string // subscriber id of the session subscriptions
+	will  *queue.Message
+	out   chan queue.Message
+	done  chan struct{}
+
+	mu       sync.Mutex      // guards conn writes, subs and packetID
+	subs     map[string]byte // granted QoS by filter
+	packetID uint16
+}
+
+func newSession(b *Broker, conn net.Conn, id, subID string) *session {
+	return &session{
+		b:     b,
+		conn:  conn,
+		id:    id,
+		subID: subID,
+		out:   make(chan queue.Message, 256),
+		done:  make(chan struct{}),
+		subs:  map[string]byte{},
+	}
+}
+
+// write sends the packet, the connection is closed if it fails
+func (s *session) write(p packets.ControlPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)) // nolint
+	if err := p.Write(s.conn); err != nil {
+		log.Printf("[DEBUG] failed to write to %s: %v", s.id, err)
+		s.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// writeLoop sends the messages of the session subscriptions until the session is closed
+func (s *session) writeLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case m := <-s.out:
+			p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			p.TopicName, p.Payload, p.Retain = m.Topic, []byte(m.Payload), m.Retained
+			s.mu.Lock()
+			p.Qos = min(m.QoS, s.granted(m.Topic))
+			if p.Qos > 0 {
+				s.packetID++
+				if s.packetID == 0 {
+					s.packetID++
+				}
+				p.MessageID = s.packetID
+			}
+			s.mu.Unlock()
+			if s.write(p) != nil {
+				return
+			}
+		}
+	}
+}
+
+// granted returns the max QoS granted by the subscriptions matching the topic
+func (s *session) granted(topic string) (qos byte) {
+	for f, q := range s.subs {
+		if q > qos && queue.Match(f, topic) {
+			qos = q
+		}
+	}
+	return qos
+}
+
+// readLoop handles the client packets until the connection is closed, true if the client disconnected gracefully
+func (s *session) readLoop(ctx context.Context, keepalive uint16) bool {
+	for {
+		if keepalive > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(time.Duration(keepalive) * time.Second * 3 / 2)) // nolint
+		} else {
+			s.conn.SetReadDeadline(time.Time{}) // nolint
+		}
+		p, err := packets.ReadPacket(s.conn)
+		if err != nil {
+			log.Printf("[DEBUG] connection of %s closed: %v", s.id, err)
+			return false
+		}
+		if ctx.Err() != nil {
+			return true
+		}
+
+		switch p := p.(type) {
+		case *packets.PublishPacket:
+			if err := queue.ValidTopic(p.TopicName); err != nil {
+				log.Printf("[WARN] %s published to invalid topic %q", s.id, p.TopicName)
+				return false
+			}
+			m := queue.Message{Topic: p.TopicName, Payload: string(p.Payload), Retained: p.Retain, QoS: min(p.Qos, 1)}
+			if err := s.b.Publish(m); err != nil {
+				log.Printf("[WARN] failed to publish %s: %v", p.TopicName, err)
+				return false
+			}
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				err = s.write(ack)
+			case 2:
+				// QoS 2 is downgraded, the message is delivered right away
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				err = s.write(rec)
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			err = s.write(comp)
+		case *packets.PubackPacket, *packets.PubrecPacket, *packets.PubcompPacket:
+			// QoS 1 messages are not redelivered, there is nothing to acknowledge
+		case *packets.SubscribePacket:
+			err = s.subscribe(p)
+		case *packets.UnsubscribePacket:
+			s.mu.Lock()
+			for _, f := range p.Topics {
+				delete(s.subs, f)
+				s.b.Unsubscribe(s.subID, f)
+			}
+			s.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			err = s.write(ack)
+		case *packets.PingreqPacket:
+			err = s.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return true
+		default:
+			log.Printf("[WARN] unexpected packet from %s: %s", s.id, p)
+			return false
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// subscribe acknowledges the subscriptions and then subscribes, so that the retained messages follow SUBACK
+func (s *session) subscribe(p *packets.SubscribePacket) error {
+	ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	ack.MessageID = p.MessageID
+	var filters []string
+	s.mu.Lock()
+	for i, f := range p.Topics {
+		if err := queue.ValidFilter(f); err != nil {
+			ack.ReturnCodes = append(ack.ReturnCodes, 0x80)
+			continue
+		}
+		qos := min(p.Qoss[i], 1)
+		s.subs[f] = qos
+		ack.ReturnCodes = append(ack.ReturnCodes, qos)
+		filters = append(filters, f)
+	}
+	s.mu.Unlock()
+
+	if err := s.write(ack); err != nil {
+		return err
+	}
+	for _, f := range filters {
+		// subscription to the same filter replaces the previous one
+		s.b.Unsubscribe(s.subID, f)
+		if err := s.b.Subscribe(queue.Subscription{Topic: f, Messages: s.out, Lossy: true, ID: s.subID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -24,13 +27,243 @@ type Server struct {
 //	mq_password: bar
 //	mq_client_id: baz
 //	mq_broker_url: ssl://mqtt.foobar:8883
-//	mq_root_topic: "#"
+//	mq_root_topic: "croco/cave/#"
+//	ca_file: /etc/logserver/ca.pem
+//	cert_file: /etc/logserver/client.pem
+//	key_file: /etc/logserver/client.key
+//
+// Brokers are connected with tcp://, ssl:// or tls://, ws:// and wss:// urls
 type Mqtt struct {
+	Name        string `yaml:"name"` // connection name, {broker} capture of the routes, "default" for mqtt section
+	Type        string `yaml:"type"` // mqtt (default) or local, in-process queue without a broker
 	MqUser      string `yaml:"mq_user"`
 	MqPassword  string `yaml:"mq_password"`
 	MqClientId  string `yaml:"mq_client_id"`
 	MqBrokerURL string `yaml:"mq_broker_url"`
-	MqRootTopic string `yaml:"mq_root_topic"`
+	MqRootTopic string `yaml:"mq_root_topic"` // topics seen under it are kept in the discovery catalog, off if empty
+	Persistent  bool   `yaml:"persistent"`    // keep the session on the broker between connections, requires stable mq_client_id
+	StoreDir    string `yaml:"store_dir"`     // directory of inflight QoS 1 and 2 messages, kept in memory if empty
+
+	CAFile         string        `yaml:"ca_file"`         // CA certificates to verify the broker, system pool if empty
+	CertFile       string        `yaml:"cert_file"`       // client certificate, presented along with KeyFile
+	KeyFile        string        `yaml:"key_file"`        // client certificate key
+	ServerName     string        `yaml:"server_name"`     // broker name to verify the certificate against, url host by default
+	Insecure       bool          `yaml:"insecure"`        // skip broker certificate verification, for LAN brokers only
+	KeepAlive      time.Duration `yaml:"keepalive"`       // 30s by default
+	ConnectTimeout time.Duration `yaml:"connect_timeout"` // 30s by default
+	WebsocketPath  string        `yaml:"websocket_path"`  // path of ws:// and wss:// urls without one, e.g. /mqtt
+}
+
+// Broker is the embedded mqtt broker, devices connect to it directly. The service subscribes to the broker
+// internally, the messages are forwarded to the mqtt broker configured in mqtt section if Bridge is set:
+//
+//	broker:
+//	  listen: ":1883"
+//	  tls_listen: ":8883"
+//	  tls_cert: /etc/logserver/cert.pem
+//	  tls_key: /etc/logserver/key.pem
+//	  users:
+//	    esp32: secret
+//	  bridge: true
+type Broker struct {
+	Listen       string            `yaml:"listen"`        // tcp listener address
+	TLSListen    string            `yaml:"tls_listen"`    // tls listener address
+	TLSCert      string            `yaml:"tls_cert"`      // certificate file of tls listener
+	TLSKey       string            `yaml:"tls_key"`       // key file of tls listener
+	Users        map[string]string `yaml:"users"`         // passwords by username, anonymous clients are allowed if empty
+	Bridge       bool              `yaml:"bridge"`        // forward the messages upstream
+	BridgeFilter string            `yaml:"bridge_filter"` // messages forwarded upstream, "#" by default
+}
+
+// Enabled checks if any listener is configured
+func (b Broker) Enabled() bool {
+	return b.Listen != "" || b.TLSListen != ""
+}
+
+// Publish allows to send commands to the devices with POST /api/v1/publish. Only the listed topics
+// are allowed, every command is written to the audit log:
+//
+//	publish:
+//	  users:
+//	    admin: secret
+//	  audit_log: ./audit.jsonl
+//	  topics:
+//	    - topic: croco/cave/targetTemperature
+//	      qos: 1
+//	      retained: true
+//	      validate:
+//	        numeric: true
+//	        min: 20
+//	        max: 35
+//	    - topic: croco/cave/light
+//	      values: ["on", "off"]
+type Publish struct {
+	Users    map[string]string `yaml:"users"`     // basic auth passwords by username, publishing and spool API are disabled if empty
+	AuditLog string            `yaml:"audit_log"` // audit file of the commands, required
+	Topics   []PublishTopic    `yaml:"topics"`    // whitelisted topics
+}
+
+// Enabled checks if publishing is configured
+func (p Publish) Enabled() bool {
+	return len(p.Users) > 0 && len(p.Topics) > 0
+}
+
+// PublishTopic is the topic allowed to publish to
+type PublishTopic struct {
+	Topic    string   `yaml:"topic"`    // topic or mqtt filter of the allowed topics
+	Broker   string   `yaml:"broker"`   // broker connection name, "default" if empty
+	QoS      byte     `yaml:"qos"`      // max QoS of the commands
+	Retained bool     `yaml:"retained"` // commands may be retained
+	Values   []string `yaml:"values"`   // allowed payloads, any if empty
+	Validate Validate `yaml:"validate"` // checks of the payload, see Validate
+}
+
+// Write accepts the records posted to /api/v1/write by the devices which can't publish to mqtt,
+// and InfluxDB line protocol posted to /write and /api/v2/write. The records are validated with the checks
+// of the routes rendering their module and topic, the records no route renders are rejected unless allowed:
+//
+//	write:
+//	  tokens:
+//	    - name: nas
+//	      token: secret
+//	      modules: [nas]
+//	  influx:
+//	    module: "{measurement}"
+//	    topic: "{host}/{field}"
+type Write struct {
+	Tokens        []WriteToken `yaml:"tokens"` // writing is disabled if empty
+	Influx        Influx       `yaml:"influx"`
+	AllowUnrouted bool         `yaml:"allow_unrouted"` // accept the records no route renders, without checks
+}
+
+// Influx maps the line protocol points onto the records, one per field. Templates take {measurement},
+// {field}, {tags} - tag values in order of the line joined by "/", and the tags by key like {host}
+type Influx struct {
+	Module string `yaml:"module"` // "{measurement}" by default
+	Topic  string `yaml:"topic"`  // "{tags}/{field}" by default, empty levels of the missing tags are dropped
+}
+
+// WriteToken authenticates the client writing the records
+type WriteToken struct {
+	Name    string   `yaml:"name"`    // client name, logged with the rejected records
+	Token   string   `yaml:"token"`   // bearer token, influx token or password
+	Modules []string `yaml:"modules"` // modules the client writes to, any if empty
+}
+
+// Allows checks if the client writes to the module
+func (t WriteToken) Allows(module string) bool {
+	if len(t.Modules) == 0 {
+		return true
+	}
+	for _, m := range t.Modules {
+		if m == module {
+			return true
+		}
+	}
+	return false
+}
+
+// Devices configures presence tracking. Devices are learned from the messages of the routes capturing
+// {device}, status topics like Last Will ones mark them online or offline explicitly:
+//
+//	devices:
+//	  state_file: ./devices.json
+//	  timeout: 5m
+//	  status:
+//	    - filter: "{device}/status"
+//	      online: ["online"]
+//	      offline: ["offline"]
+type Devices struct {
+	StateFile string         `yaml:"state_file"` // devices survive restarts if set
+	Timeout   time.Duration  `yaml:"timeout"`    // device is offline if nothing is received for it, 5m by default
+	Status    []DeviceStatus `yaml:"status"`     // status topics
+}
+
+// DeviceStatus is the status topic of the devices
+type DeviceStatus struct {
+	Filter  string   `yaml:"filter"`  // mqtt topic filter capturing {device}
+	Online  []string `yaml:"online"`  // online payloads, "online", "1" and "true" by default
+	Offline []string `yaml:"offline"` // offline payloads, "offline", "0" and "false" by default
+}
+
+// Archive keeps every raw message received in compressed files rotated by period,
+// to reprocess them with the routes later, see --cmd reprocess:
+//
+//	archive:
+//	  dir: ./archive
+//	  filter: "#"
+//	  rotate: 24h
+//	  keep: 365d
+type Archive struct {
+	Dir    string        `yaml:"dir"`    // archive files, messages are not archived if empty
+	Filter string        `yaml:"filter"` // mqtt filter of the archived messages, "#" by default
+	Rotate time.Duration `yaml:"rotate"` // period of a file, 24h by default
+	Keep   Duration      `yaml:"keep"`   // files older than that are removed, kept forever if not set
+}
+
+// Simulator publishes synthetic series of the devices for development without the real ones, see --cmd simulate.
+// Runs with the same seed and start time publish the same values:
+//
+//	simulator:
+//	  interval: 10s
+//	  seed: 42
+//	  devices:
+//	    - name: croco
+//	      topic: croco/cave
+//	      temperature: {min: 22, max: 30, noise: 0.1}
+//	      heater: {target: 28, hysteresis: 0.5, rate: 10}
+//	      light: {on: "08:00", off: "20:00"}
+//	      dropout: 0.001
+//	      spike: 0.005
+type Simulator struct {
+	Interval time.Duration `yaml:"interval"` // between the readings, 10s by default
+	Seed     int64         `yaml:"seed"`     // random seed of the noise, dropouts and spikes
+	Devices  []SimDevice   `yaml:"devices"`
+}
+
+// SimDevice publishes <topic>/temperature, <topic>/heater and <topic>/light readings, and retained
+// <topic>/targetTemperature of the heater
+type SimDevice struct {
+	Name            string         `yaml:"name"`             // device name, its random source is seeded with it
+	Topic           string         `yaml:"topic"`            // topic prefix of the readings, the name by default
+	Temperature     SimTemperature `yaml:"temperature"`      // ambient temperature
+	Heater          SimHeater      `yaml:"heater"`           // no heater if the target is not set
+	Light           SimLight       `yaml:"light"`            // no light if the schedule is not set
+	Dropout         float64        `yaml:"dropout"`          // probability of the device going silent after a reading
+	DropoutDuration time.Duration  `yaml:"dropout_duration"` // gap between the readings of the silent device, 5m by default
+	Spike           float64        `yaml:"spike"`            // probability of a temperature reading of 85 or -127, DS18B20 errors
+}
+
+// SimTemperature is the ambient temperature following the day curve, the lowest at 02:00 and the highest at 14:00
+type SimTemperature struct {
+	Min   float64 `yaml:"min"`   // night minimum
+	Max   float64 `yaml:"max"`   // day maximum
+	Noise float64 `yaml:"noise"` // standard deviation of the reading noise
+}
+
+// SimHeater toggles by hysteresis around the target, the temperature follows the ambient one with an hour time constant
+type SimHeater struct {
+	Target     float64 `yaml:"target"`     // heater is off forever if zero
+	Hysteresis float64 `yaml:"hysteresis"` // on below target-hysteresis, off above target+hysteresis, 0.5 by default
+	Rate       float64 `yaml:"rate"`       // degrees per hour the heater adds, 10 by default
+}
+
+// SimLight is on between the on and off times of the day, local time
+type SimLight struct {
+	On  string `yaml:"on"`  // e.g. "08:00"
+	Off string `yaml:"off"` // e.g. "20:00", before on for the night light
+}
+
+// Ingest is the bounded queue of received messages in front of the storage, one per subscription:
+//
+//	ingest:
+//	  capacity: 1000
+//	  policy: spill
+//	  spill_dir: ./spill
+type Ingest struct {
+	Capacity int    `yaml:"capacity"`  // messages buffered in memory, 1000 by default
+	Policy   string `yaml:"policy"`    // on overflow: drop-oldest (default), drop-newest, spill (default with spill_dir) or block
+	SpillDir string `yaml:"spill_dir"` // directory of the spilled messages, required by spill policy
 }
 
 // storage:
@@ -38,16 +271,169 @@ type Mqtt struct {
 //	type: sqlite
 //	database_url: file:./mqttdata.db?mode=rwc
 type Storage struct {
-	Type string `yaml:"type"` // Type of storage to use. Currently supported: sqlite
-	Path string `yaml:"path"` // Path to the database file
+	Type  string `yaml:"type"`  // Type of storage to use. Currently supported: sqlite
+	Path  string `yaml:"path"`  // Path to the database file
+	Batch Batch  `yaml:"batch"` // Write-behind buffering
+	Spool Spool  `yaml:"spool"` // Records failed to write
+}
+
+// Spool keeps the records failed to write in the file and retries them with exponential backoff:
+//
+//	spool:
+//	  path: ./spool.jsonl
+//	  backoff: 1s
+//	  max_backoff: 5m
+type Spool struct {
+	Path       string        `yaml:"path"`        // spool file, failed writes are not retried if empty
+	Backoff    time.Duration `yaml:"backoff"`     // delay of the first retry, 1s by default
+	MaxBackoff time.Duration `yaml:"max_backoff"` // max delay between retries, 5m by default
+}
+
+// Batch configures write-behind buffering: records are written in batches of Size
+// or once per Window. Records are written one by one if Size is not set
+type Batch struct {
+	Size   int           `yaml:"size"`   // records per batch
+	Window time.Duration `yaml:"window"` // max time a record waits for the batch, 1s by default
+	Buffer int           `yaml:"buffer"` // records buffered before writes block, 10 batches by default
+}
+
+// Route maps mqtt topics matching the Filter to store module and topic:
+//
+//	routes:
+//	  - filter: "croco/cave/{name}"
+//	    module: cave
+//	    topic: "{name}"
+//	    rename:
+//	      temperature: temp
+//	      targetTemperature: targetTemp
+//	  - filter: "{device}/p/ds18b20/{probe}"
+//	    module: probes
+//	    topic: "ds18b20/{probe}"
+//	  - filter: "office/{sensor}"
+//	    brokers: [office]
+//	    module: "{broker}"
+//
+// {broker} capture holds the name of the broker connection the message is received from
+type Route struct {
+	Filter   string            `yaml:"filter"`   // mqtt topic filter, {name} captures a single level, e.g. "{device}/p/ds18b20/{probe}"
+	Module   string            `yaml:"module"`   // module template, e.g. "probes"
+	Topic    string            `yaml:"topic"`    // topic template, e.g. "ds18b20/{probe}"
+	Rename   map[string]string `yaml:"rename"`   // optional map to rename the rendered topic, e.g. temperature: temp
+	Payload  Payload           `yaml:"payload"`  // optional payload format, plain scalar by default
+	Validate Validate          `yaml:"validate"` // optional sanity checks, values failing them are not stored
+	QoS      byte              `yaml:"qos"`      // subscription QoS, 0 by default
+	Brokers  []string          `yaml:"brokers"`  // names of the broker connections to subscribe to, all by default
+}
+
+// Payload describes how to extract several values from a single message:
+//
+//	payload:
+//	  format: json # scalar (default), json, kv or csv
+//	  fields:
+//	    - path: ENERGY.Power # json path, kv key, csv column name or index
+//	      topic: "{sensor}/power" # optional topic template, route topic is used by default
+//
+// Without fields all the values found in the payload are extracted,
+// {field} capture holds the path of the extracted value. Top-level json scalar is stored
+// with the topic rendered without {field}, the mqtt topic if nothing is left
+type Payload struct {
+	Format    string   `yaml:"format"`
+	Separator string   `yaml:"separator"` // kv pairs or csv columns separator
+	Columns   []string `yaml:"columns"`   // csv column names
+	Fields    []Field  `yaml:"fields"`
+}
+
+type Field struct {
+	Path     string    `yaml:"path"`
+	Topic    string    `yaml:"topic"`
+	Validate *Validate `yaml:"validate"` // overrides route validation for the field
+}
+
+// Validate describes sanity checks for values:
+//
+//	validate:
+//	  numeric: true # reject values that are not finite numbers, like "nan"
+//	  min: 0
+//	  max: 100
+//	  reject: ["-127", "85"] # sentinel values, e.g. disconnected DS18B20
+//	  max_rate: 2 # max change per second, rejects spikes
+//
+// Bounds and rate are checked for numeric values only
+type Validate struct {
+	Numeric bool     `yaml:"numeric"`
+	Min     *float64 `yaml:"min"`
+	Max     *float64 `yaml:"max"`
+	Reject  []string `yaml:"reject"`
+	MaxRate float64  `yaml:"max_rate"`
+}
+
+// Retention describes how long the records of the module are kept:
+//
+//	retention:
+//	  - module: cave
+//	    raw: 30d # raw records are kept for 30 days
+//	    rollup_5m: 365d # 5 minute rollups are kept for a year
+//	    rollup_1h: forever # hourly rollups are kept forever, same as not set
+//	    topics: # per topic overrides, not set values are taken from the module
+//	      temp:
+//	        raw: 90d
+type Retention struct {
+	Module string `yaml:"module"`
+	Keep   `yaml:",inline"`
+	Topics map[string]Keep `yaml:"topics"`
+}
+
+type Keep struct {
+	Raw      Duration `yaml:"raw"`
+	Rollup5m Duration `yaml:"rollup_5m"`
+	Rollup1h Duration `yaml:"rollup_1h"`
+}
+
+// Forever is the Duration of data kept forever
+const Forever Duration = -1
+
+// Duration is time.Duration parsed from Go duration, number of days like "30d" or "forever"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	s := strings.TrimSpace(value.Value)
+	switch {
+	case s == "" || s == "0":
+		*d = 0
+		return nil
+	case s == "forever":
+		*d = Forever
+		return nil
+	case strings.HasSuffix(s, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days <= 0 {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		*d = Duration(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil || v < 0 {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
 }
 
-// collect_raw: false
 type Config struct {
-	Server     Server  `yaml:"server"`
-	Mqtt       Mqtt    `yaml:"mqtt"`
-	Storage    Storage `yaml:"storage"`
-	CollectRaw bool    `yaml:"collect_raw"`
+	Server      Server      `yaml:"server"`
+	Mqtt        Mqtt        `yaml:"mqtt"`
+	Connections []Mqtt      `yaml:"connections"` // more named broker connections
+	Broker      Broker      `yaml:"broker"`
+	Publish     Publish     `yaml:"publish"`
+	Write       Write       `yaml:"write"`
+	Devices     Devices     `yaml:"devices"`
+	Archive     Archive     `yaml:"archive"`
+	Simulator   Simulator   `yaml:"simulator"`
+	Ingest      Ingest      `yaml:"ingest"`
+	Storage     Storage     `yaml:"storage"`
+	Routes      []Route     `yaml:"routes"`
+	Retention   []Retention `yaml:"retention"`
 }
 
 // NewConfig creates a new Config from the given file
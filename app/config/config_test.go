@@ -0,0 +1,55 @@
+package config
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewConfig(t *testing.T) {
+
+	// sample config is valid
+	c, err := NewConfig("../../config.yml")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, c.Routes)
+	assert.Equal(t, Batch{Size: 500, Window: 2 * time.Second, Buffer: 5000}, c.Storage.Batch)
+	assert.Equal(t, Ingest{Capacity: 1000, Policy: "drop-oldest"}, c.Ingest)
+	assert.Equal(t, "croco/cave/#", c.Mqtt.MqRootTopic, "discovery doesn't subscribe to every topic of the broker")
+
+	_, err = NewConfig("nosuchfile.yml")
+	assert.Error(t, err)
+}
+
+func Test_Duration(t *testing.T) {
+
+	fname := path.Join(t.TempDir(), "config.yml")
+	err := os.WriteFile(fname, []byte(`
+retention:
+  - module: cave
+    raw: 30d
+    rollup_5m: 12h
+    rollup_1h: forever
+    topics:
+      temp:
+        raw: 90d
+`), 0600)
+	assert.NoError(t, err)
+
+	c, err := NewConfig(fname)
+	assert.NoError(t, err)
+	assert.Equal(t, []Retention{{
+		Module: "cave",
+		Keep:   Keep{Raw: Duration(30 * 24 * time.Hour), Rollup5m: Duration(12 * time.Hour), Rollup1h: Forever},
+		Topics: map[string]Keep{"temp": {Raw: Duration(90 * 24 * time.Hour)}},
+	}}, c.Retention)
+
+	for _, bad := range []string{"-1d", "month", "-5h", "1.5d"} {
+		err = os.WriteFile(fname, []byte("retention:\n  - module: cave\n    raw: "+bad+"\n"), 0600)
+		assert.NoError(t, err)
+		_, err = NewConfig(fname)
+		assert.Error(t, err, bad)
+	}
+}
@@ -0,0 +1,263 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/route"
+)
+
+// Device is the presence state of the device
+type Device struct {
+	Name      string    `json:"name"`
+	Broker    string    `json:"broker"` // connection the device was last seen on
+	Online    bool      `json:"online"`
+	Reason    string    `json:"reason,omitempty"` // why the device is offline, "status" or "timeout"
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastTopic string    `json:"last_topic"`
+	Messages  int64     `json:"messages"`
+	Rate      float64   `json:"rate"`             // messages per minute, moving average
+	Status    string    `json:"status,omitempty"` // last payload of the status topic
+	StatusAt  time.Time `json:"status_at,omitempty"`
+}
+
+// record is the persisted state of the device
+type record struct {
+	Device
+	Interval float64 `json:"interval"` // moving average of seconds between messages
+	Down     bool    `json:"down"`     // offline status received after the last message
+}
+
+// status is the compiled status topic
+type status struct {
+	rule    *route.Rule
+	online  []string
+	offline []string
+}
+
+// Registry learns the devices from the messages and tracks their presence. Devices seen without
+// a message for the timeout, and the ones reported offline by the status topic, are offline
+type Registry struct {
+	timeout time.Duration
+	path    string
+	status  []status
+	now     func() time.Time
+
+	mu      sync.Mutex
+	devices map[string]*record
+	dirty   bool
+}
+
+// New creates the registry, devices are loaded from the state file if it exists
+func New(cfg config.Devices) (*Registry, error) {
+	r := &Registry{timeout: cfg.Timeout, path: cfg.StateFile, now: time.Now, devices: map[string]*record{}}
+	if r.timeout <= 0 {
+		r.timeout = 5 * time.Minute
+	}
+	for _, s := range cfg.Status {
+		rule, err := route.Compile(config.Route{Filter: s.Filter, Module: "devices"})
+		if err != nil {
+			return nil, fmt.Errorf("device status: %w", err)
+		}
+		if !strings.Contains(s.Filter, "{device}") {
+			return nil, fmt.Errorf("device status %q: filter must capture {device}", s.Filter)
+		}
+		st := status{rule: rule, online: s.Online, offline: s.Offline}
+		if len(st.online) == 0 {
+			st.online = []string{"online", "1", "true"}
+		}
+		if len(st.offline) == 0 {
+			st.offline = []string{"offline", "0", "false"}
+		}
+		r.status = append(r.status, st)
+	}
+
+	if r.path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read devices %s: %w", r.path, err)
+	}
+	var records []*record
+	if err = json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse devices %s: %w", r.path, err)
+	}
+	for _, rec := range records {
+		r.devices[rec.Name] = rec
+	}
+	log.Printf("[INFO] %d devices loaded from %s", len(records), r.path)
+	return r, nil
+}
+
+// Subscriptions returns the mqtt filters of the status topics
+func (r *Registry) Subscriptions() []string {
+	var res []string
+	for _, s := range r.status {
+		res = append(res, s.rule.Subscription())
+	}
+	return res
+}
+
+// Seen records the message of the device received on the broker connection
+func (r *Registry) Seen(broker, name, topic string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen(broker, name, topic, at)
+}
+
+func (r *Registry) seen(broker, name, topic string, at time.Time) *record {
+	d, ok := r.devices[name]
+	if !ok {
+		d = &record{Device: Device{Name: name, FirstSeen: at}}
+		r.devices[name] = d
+		log.Printf("[INFO] new device %s on %s", name, broker)
+	}
+	if d.Messages > 0 && at.After(d.LastSeen) {
+		// the average adapts to the last ten intervals or so
+		dt := at.Sub(d.LastSeen).Seconds()
+		if d.Interval == 0 {
+			d.Interval = dt
+		}
+		d.Interval = 0.9*d.Interval + 0.1*dt
+	}
+	if d.Down {
+		log.Printf("[INFO] device %s is back online", name)
+	}
+	d.Broker, d.LastSeen, d.LastTopic, d.Down = broker, at, topic, false
+	d.Messages++
+	r.dirty = true
+	return d
+}
+
+// Status handles the message of the status topics, returns false if the topic is not a status one.
+// Online status counts as a message of the device, offline status marks it offline until the next message
+func (r *Registry) Status(broker, topic, payload string, at time.Time) bool {
+	for _, s := range r.status {
+		captures, ok := s.rule.Match(topic)
+		if !ok || captures["device"] == "" {
+			continue
+		}
+		name, p := captures["device"], strings.TrimSpace(payload)
+
+		r.mu.Lock()
+		switch {
+		case containsFold(s.online, p):
+			d := r.seen(broker, name, topic, at)
+			d.Status, d.StatusAt = payload, at
+		case containsFold(s.offline, p):
+			d, ok := r.devices[name]
+			if !ok {
+				d = &record{Device: Device{Name: name, Broker: broker, FirstSeen: at}}
+				r.devices[name] = d
+			}
+			if !d.Down {
+				log.Printf("[INFO] device %s is offline: %s %q", name, topic, payload)
+			}
+			d.Status, d.StatusAt, d.Down = payload, at, true
+			r.dirty = true
+		default:
+			log.Printf("[DEBUG] unknown status of %s: %s %q", name, topic, payload)
+		}
+		r.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// Devices returns the devices ordered by name
+func (r *Registry) Devices() []Device {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	res := make([]Device, 0, len(r.devices))
+	for _, rec := range r.devices {
+		d := rec.Device
+		if rec.Interval > 0 {
+			d.Rate = 60 / rec.Interval
+		}
+		switch {
+		case rec.Down:
+			d.Reason = "status"
+		case now.Sub(d.LastSeen) > r.timeout:
+			d.Reason = "timeout"
+		default:
+			d.Online = true
+		}
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Save writes the devices to the state file if they changed, nothing is saved without the file
+func (r *Registry) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.path == "" || !r.dirty {
+		return nil
+	}
+	records := make([]*record, 0, len(r.devices))
+	for _, rec := range r.devices {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(r.path), 0o750); err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// Run saves the devices every interval and once the context is done
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.Save(); err != nil {
+				log.Printf("[ERROR] failed to save devices: %v", err)
+			}
+			return
+		case <-ticker.C:
+			if err := r.Save(); err != nil {
+				log.Printf("[WARN] failed to save devices: %v", err)
+			}
+		}
+	}
+}
+
+func containsFold(values []string, v string) bool {
+	for _, s := range values {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
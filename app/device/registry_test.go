@@ -0,0 +1,76 @@
+package device
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Registry(t *testing.T) {
+
+	cfg := config.Devices{
+		StateFile: path.Join(t.TempDir(), "devices.json"),
+		Timeout:   time.Minute,
+		Status:    []config.DeviceStatus{{Filter: "{device}/status"}, {Filter: "tele/{device}/LWT", Online: []string{"Online"}, Offline: []string{"Offline"}}},
+	}
+	r, err := New(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"+/status", "tele/+/LWT"}, r.Subscriptions())
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		r.Seen("default", "ESP32-1", "ESP32-1/p/ds18b20/1", start.Add(time.Duration(i)*10*time.Second))
+	}
+	now = start.Add(45 * time.Second)
+	devices := r.Devices()
+	require.Len(t, devices, 1)
+	assert.Equal(t, Device{Name: "ESP32-1", Broker: "default", Online: true, FirstSeen: start, LastSeen: start.Add(40 * time.Second),
+		LastTopic: "ESP32-1/p/ds18b20/1", Messages: 5, Rate: 6}, devices[0])
+
+	// last will marks the device offline until the next message
+	assert.True(t, r.Status("default", "ESP32-1/status", "offline", now))
+	assert.False(t, r.Devices()[0].Online)
+	assert.Equal(t, "status", r.Devices()[0].Reason)
+	assert.Equal(t, "offline", r.Devices()[0].Status)
+	r.Seen("default", "ESP32-1", "ESP32-1/p/ds18b20/1", now)
+	assert.True(t, r.Devices()[0].Online)
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, r.Devices()[0].Online)
+	assert.Equal(t, "timeout", r.Devices()[0].Reason)
+
+	// status topics learn the devices too
+	assert.True(t, r.Status("office", "tele/plug/LWT", "Online", now))
+	assert.True(t, r.Status("office", "tele/plug/LWT", "dunno", now), "unknown payloads are ignored")
+	assert.False(t, r.Status("office", "tele/plug/SENSOR", "{}", now))
+	devices = r.Devices()
+	require.Len(t, devices, 2)
+	assert.Equal(t, "plug", devices[1].Name)
+	assert.Equal(t, "office", devices[1].Broker)
+	assert.True(t, devices[1].Online)
+
+	// state survives restarts
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		r.Run(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+	r2, err := New(cfg)
+	require.NoError(t, err)
+	r2.now = r.now
+	assert.Equal(t, devices, r2.Devices())
+
+	_, err = New(config.Devices{Status: []config.DeviceStatus{{Filter: "{name}/status"}}})
+	assert.Error(t, err, "no device capture")
+}
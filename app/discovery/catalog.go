@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+)
+
+// maxPayload is the max length of the last payload kept in the catalog
+const maxPayload = 4096
+
+// Topic is the topic seen in discovery mode
+type Topic struct {
+	Broker    string    `json:"broker"`
+	Topic     string    `json:"topic"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Messages  int64     `json:"messages"`
+	Payload   string    `json:"payload"` // last payload, truncated to 4KB
+	Type      string    `json:"type"`    // type of the last payload: number, bool, string, json or empty
+	Routed    bool      `json:"routed"`  // topic is matched by the routes
+}
+
+// Catalog keeps every topic seen on the root topics of the broker connections, in memory.
+// New topics are not added once the catalog is full
+type Catalog struct {
+	router *route.Router
+	max    int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	topics  map[string]*Topic // by broker and topic
+	dropped int64             // messages of the topics not added to the full catalog
+}
+
+// New creates the catalog of max topics, 10000 by default. Topics are checked against the router
+func New(router *route.Router, max int) *Catalog {
+	if max <= 0 {
+		max = 10000
+	}
+	return &Catalog{router: router, max: max, now: time.Now, topics: map[string]*Topic{}}
+}
+
+// Observe adds the message received on the broker connection to the catalog
+func (c *Catalog) Observe(broker, topic, payload string) {
+	now := c.now()
+	key := broker + "\x00" + topic
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t, ok := c.topics[key]
+	if !ok {
+		if len(c.topics) >= c.max {
+			if c.dropped == 0 {
+				log.Printf("[WARN] topic catalog is full, %d topics, new topics are not added", c.max)
+			}
+			c.dropped++
+			return
+		}
+		t = &Topic{Broker: broker, Topic: topic, FirstSeen: now}
+		c.topics[key] = t
+	}
+	t.LastSeen, t.Type = now, Infer(payload)
+	t.Messages++
+	if len(payload) > maxPayload {
+		payload = payload[:maxPayload]
+	}
+	t.Payload = payload
+}
+
+// Topics returns the topics ordered by broker connection and topic
+func (c *Catalog) Topics() []Topic {
+	c.mu.Lock()
+	res := make([]Topic, 0, len(c.topics))
+	for _, t := range c.topics {
+		res = append(res, *t)
+	}
+	c.mu.Unlock()
+
+	for i := range res {
+		res[i].Routed = c.router != nil && c.router.Matches(res[i].Broker, res[i].Topic)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Broker != res[j].Broker {
+			return res[i].Broker < res[j].Broker
+		}
+		return res[i].Topic < res[j].Topic
+	})
+	return res
+}
+
+// Dropped returns the number of messages of the topics not added to the full catalog
+func (c *Catalog) Dropped() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+// Preview is the result of the route applied to the catalog
+type Preview struct {
+	Records []store.Data `json:"records"`
+	Errors  []string     `json:"errors,omitempty"` // payloads failed to decode
+}
+
+// Preview applies the route to the last payloads of the catalog topics and returns the records it
+// would store, to try the route before adding it to the config. Values are validated as by the router
+func (c *Catalog) Preview(r config.Route) (Preview, error) {
+	router, err := route.New([]config.Route{r})
+	if err != nil {
+		return Preview{}, err
+	}
+	filter := router.Subscriptions()[0]
+	res := Preview{Records: []store.Data{}}
+	for _, t := range c.Topics() {
+		data, err := router.RouteFrom(t.Broker, filter, t.Topic, t.Payload, t.LastSeen)
+		if err != nil {
+			res.Errors = append(res.Errors, err.Error())
+		}
+		res.Records = append(res.Records, data...)
+	}
+	return res, nil
+}
+
+// Infer returns the type of the payload: number, bool, string, json or empty
+func Infer(payload string) string {
+	p := strings.TrimSpace(payload)
+	if p == "" {
+		return "empty"
+	}
+	if (p[0] == '{' || p[0] == '[') && json.Valid([]byte(p)) {
+		return "json"
+	}
+	switch store.ParseValue(p).Kind() {
+	case store.KindFloat:
+		return "number"
+	case store.KindBool:
+		return "bool"
+	}
+	return "string"
+}
@@ -0,0 +1,70 @@
+package discovery
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Catalog(t *testing.T) {
+
+	router, err := route.New([]config.Route{{Filter: "croco/cave/{name}", Module: "cave", Brokers: []string{"default"}}})
+	require.NoError(t, err)
+	c := New(router, 3)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	c.now = func() time.Time { return now }
+
+	c.Observe("default", "croco/cave/temperature", "23.5")
+	now = now.Add(time.Minute)
+	c.Observe("default", "croco/cave/temperature", "23.7")
+	c.Observe("default", "tele/plug/SENSOR", `{"ENERGY":{"Power":12}}`)
+	c.Observe("office", "croco/cave/temperature", "on")
+	c.Observe("office", "tele/plug/STATE", "") // catalog is full
+
+	assert.Equal(t, []Topic{
+		{Broker: "default", Topic: "croco/cave/temperature", FirstSeen: start, LastSeen: now, Messages: 2, Payload: "23.7", Type: "number", Routed: true},
+		{Broker: "default", Topic: "tele/plug/SENSOR", FirstSeen: now, LastSeen: now, Messages: 1, Payload: `{"ENERGY":{"Power":12}}`, Type: "json"},
+		{Broker: "office", Topic: "croco/cave/temperature", FirstSeen: now, LastSeen: now, Messages: 1, Payload: "on", Type: "string"},
+	}, c.Topics())
+	assert.Equal(t, int64(1), c.Dropped())
+
+	p, err := c.Preview(config.Route{Filter: "tele/{device}/SENSOR", Module: "{device}", Payload: config.Payload{Format: "json"}})
+	require.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "plug", DateTime: now, Topic: "ENERGY.Power", Value: store.FloatValue(12)}}, p.Records)
+	assert.Empty(t, p.Errors)
+
+	p, err = c.Preview(config.Route{Filter: "+/+/{name}", Module: "all", Payload: config.Payload{Format: "json"}})
+	require.NoError(t, err)
+	assert.Equal(t, []store.Data{
+		{Module: "all", DateTime: now, Topic: "croco/cave/temperature", Value: store.FloatValue(23.7)},
+		{Module: "all", DateTime: now, Topic: "ENERGY.Power", Value: store.FloatValue(12)},
+	}, p.Records, "json scalar is the value of the topic")
+	assert.Len(t, p.Errors, 1, "string payload is not json")
+
+	_, err = c.Preview(config.Route{Filter: "croco/#/temp", Module: "cave"})
+	assert.Error(t, err)
+}
+
+func Test_Infer(t *testing.T) {
+	for in, out := range map[string]string{
+		"":             "empty",
+		" 23.5 ":       "number",
+		"true":         "bool",
+		"on":           "string",
+		`{"a":1}`:      "json",
+		`[1,2]`:        "json",
+		`{not json`:    "string",
+		"nan":          "string",
+		"-127":         "number",
+		"ESP32 online": "string",
+	} {
+		assert.Equal(t, out, Infer(in), fmt.Sprintf("%q", in))
+	}
+}
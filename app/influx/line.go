@@ -0,0 +1,232 @@
+package influx
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parMaster/logserver/app/store"
+)
+
+// Point is a line of InfluxDB line protocol:
+//
+//	measurement[,tag=value...] field=value[,field=value...] [timestamp]
+type Point struct {
+	Measurement string
+	Tags        []Tag
+	Fields      []Field
+	Time        time.Time // zero if the line has no timestamp
+}
+
+// Tag is the tag of the point
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field is the field of the point, the value is in the form store.ParseValue takes:
+// integers without the type suffix, booleans as "true" and "false", strings unescaped
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Precision returns the unit of the timestamps, nanoseconds if it is empty. Influx v1 names are accepted as well
+func Precision(p string) (time.Duration, error) {
+	switch p {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("unsupported precision %q", p)
+}
+
+// ParseLine parses the line of line protocol with the timestamps in the precision units
+func ParseLine(line string, precision time.Duration) (Point, error) {
+	var p Point
+	key, rest, err := split(line, ' ', false)
+	if err != nil {
+		return p, err
+	}
+	fields, rest, err := split(rest, ' ', true)
+	if err != nil {
+		return p, err
+	}
+	if fields == "" {
+		return p, errors.New("no fields")
+	}
+
+	parts, err := splitAll(key, ',', false)
+	if err != nil {
+		return p, err
+	}
+	if p.Measurement = unescape(parts[0]); p.Measurement == "" {
+		return p, errors.New("no measurement")
+	}
+	for _, t := range parts[1:] {
+		k, v, err := split(t, '=', false)
+		if err != nil {
+			return p, err
+		}
+		if k == "" || v == "" {
+			return p, fmt.Errorf("invalid tag %q", t)
+		}
+		p.Tags = append(p.Tags, Tag{Key: unescape(k), Value: unescape(v)})
+	}
+
+	parts, err = splitAll(fields, ',', true)
+	if err != nil {
+		return p, err
+	}
+	for _, f := range parts {
+		k, v, err := split(f, '=', true)
+		if err != nil {
+			return p, err
+		}
+		if k == "" {
+			return p, fmt.Errorf("invalid field %q", f)
+		}
+		value, err := fieldValue(v)
+		if err != nil {
+			return p, fmt.Errorf("field %s: %w", unescape(k), err)
+		}
+		p.Fields = append(p.Fields, Field{Key: unescape(k), Value: value})
+	}
+
+	if rest = strings.TrimSpace(rest); rest != "" {
+		ts, err := strconv.ParseInt(rest, 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp %q", rest)
+		}
+		p.Time = time.Unix(0, ts*int64(precision))
+	}
+	return p, nil
+}
+
+// split splits s at the first unescaped separator outside of the quoted strings if quotes are recognized,
+// the rest is empty if there is no separator
+func split(s string, sep byte, quotes bool) (string, string, error) {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			return s[:i], s[i+1:], nil
+		}
+	}
+	if quoted {
+		return "", "", errors.New("unterminated string")
+	}
+	return s, "", nil
+}
+
+func splitAll(s string, sep byte, quotes bool) ([]string, error) {
+	var res []string
+	for {
+		part, rest, err := split(s, sep, quotes)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, part)
+		if len(part) == len(s) {
+			return res, nil
+		}
+		s = rest
+	}
+}
+
+// unescaper removes the backslash of escaped commas, equal signs and spaces of the keys and tag values
+var unescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\\`, `\`)
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return unescaper.Replace(s)
+}
+
+// number matches float field values, integers have i and unsigned integers u suffix
+var number = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE][-+]?\d+)?$`)
+
+func fieldValue(v string) (string, error) {
+	switch {
+	case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(v[1 : len(v)-1]), nil
+	case v == "t" || v == "T" || v == "true" || v == "True" || v == "TRUE":
+		return "true", nil
+	case v == "f" || v == "F" || v == "false" || v == "False" || v == "FALSE":
+		return "false", nil
+	case strings.HasSuffix(v, "i") || strings.HasSuffix(v, "u"):
+		if _, err := strconv.ParseInt(strings.TrimPrefix(v[:len(v)-1], "+"), 10, 64); err != nil {
+			if _, err := strconv.ParseUint(v[:len(v)-1], 10, 64); err != nil {
+				return "", fmt.Errorf("invalid integer %q", v)
+			}
+		}
+		return v[:len(v)-1], nil
+	case number.MatchString(v):
+		return v, nil
+	}
+	return "", fmt.Errorf("invalid value %q", v)
+}
+
+// placeholder matches {name} in the templates
+var placeholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Data renders a record for every field of the point with the module and topic templates. Templates take
+// {measurement}, {field}, {tags} - tag values in order of the line joined by "/", and the tags by key like {host}.
+// Empty topic levels of the missing tags are dropped. Points without the timestamp get the received time
+func (p Point) Data(module, topic string, received time.Time) ([]store.Data, error) {
+	values := map[string]string{"measurement": p.Measurement}
+	tags := make([]string, 0, len(p.Tags))
+	for _, t := range p.Tags {
+		tags = append(tags, t.Value)
+		if _, ok := values[t.Key]; !ok {
+			values[t.Key] = t.Value
+		}
+	}
+	values["tags"] = strings.Join(tags, "/")
+	ts := p.Time
+	if ts.IsZero() {
+		ts = received
+	}
+
+	res := make([]store.Data, 0, len(p.Fields))
+	for _, f := range p.Fields {
+		values["field"] = f.Key
+		d := store.Data{Module: render(module, values), Topic: render(topic, values), DateTime: ts, Value: store.ParseValue(f.Value)}
+		if d.Module == "" || d.Topic == "" {
+			return nil, fmt.Errorf("empty module or topic of %s field %s", p.Measurement, f.Key)
+		}
+		res = append(res, d)
+	}
+	return res, nil
+}
+
+func render(tpl string, values map[string]string) string {
+	s := placeholder.ReplaceAllStringFunc(tpl, func(p string) string {
+		return values[p[1:len(p)-1]]
+	})
+	levels := strings.Split(s, "/")
+	res := levels[:0]
+	for _, l := range levels {
+		if l != "" {
+			res = append(res, l)
+		}
+	}
+	return strings.Join(res, "/")
+}
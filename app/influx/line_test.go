@@ -0,0 +1,92 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseLine(t *testing.T) {
+
+	tbl := []struct {
+		line string
+		p    Point
+		err  bool
+	}{
+		{
+			line: "cpu,host=nas,cpu=cpu0 usage_idle=98.2,usage_user=1.1 1672567200000000000",
+			p: Point{Measurement: "cpu", Tags: []Tag{{"host", "nas"}, {"cpu", "cpu0"}},
+				Fields: []Field{{"usage_idle", "98.2"}, {"usage_user", "1.1"}}, Time: time.Unix(1672567200, 0)},
+		},
+		{
+			line: `disk free=42i,total=100u,ok=t,failed=FALSE,status="all \"good\", really"`,
+			p: Point{Measurement: "disk", Fields: []Field{
+				{"free", "42"}, {"total", "100"}, {"ok", "true"}, {"failed", "false"}, {"status", `all "good", really`},
+			}},
+		},
+		{
+			line: `my\ room,sensor\,id=a\=b temp\ c=-1.5e1`,
+			p:    Point{Measurement: "my room", Tags: []Tag{{"sensor,id", "a=b"}}, Fields: []Field{{"temp c", "-1.5e1"}}},
+		},
+		{line: "cpu", err: true},
+		{line: "cpu,host usage=1", err: true},
+		{line: ",host=nas usage=1", err: true},
+		{line: "cpu usage=abc", err: true},
+		{line: "cpu usage=1.5i", err: true},
+		{line: `cpu status="open`, err: true},
+		{line: "cpu usage=1 yesterday", err: true},
+	}
+	for _, tt := range tbl {
+		p, err := ParseLine(tt.line, time.Nanosecond)
+		if tt.err {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		require.NoError(t, err, tt.line)
+		assert.Equal(t, tt.p, p, tt.line)
+	}
+
+	p, err := ParseLine("cpu usage=1 1672567200", time.Second)
+	require.NoError(t, err)
+	assert.True(t, time.Unix(1672567200, 0).Equal(p.Time))
+
+	for _, prec := range []string{"", "n", "ns", "u", "us", "ms", "s", "m", "h"} {
+		_, err := Precision(prec)
+		assert.NoError(t, err, prec)
+	}
+	_, err = Precision("d")
+	assert.Error(t, err)
+}
+
+func Test_Point_Data(t *testing.T) {
+
+	now := time.Now()
+	p, err := ParseLine("cpu,host=nas,cpu=cpu0 usage_idle=98.2,state=\"up\" 1672567200000000000", time.Nanosecond)
+	require.NoError(t, err)
+
+	data, err := p.Data("{measurement}", "{tags}/{field}", now)
+	require.NoError(t, err)
+	ts := time.Unix(1672567200, 0)
+	assert.Equal(t, []store.Data{
+		{Module: "cpu", Topic: "nas/cpu0/usage_idle", DateTime: ts, Value: store.FloatValue(98.2)},
+		{Module: "cpu", Topic: "nas/cpu0/state", DateTime: ts, Value: store.StringValue("up")},
+	}, data)
+
+	data, err = p.Data("{host}", "{measurement}/{region}/{field}", now)
+	require.NoError(t, err)
+	assert.Equal(t, "nas", data[0].Module)
+	assert.Equal(t, "cpu/usage_idle", data[0].Topic, "missing tags are dropped")
+
+	p, err = ParseLine("mem used=1", time.Nanosecond)
+	require.NoError(t, err)
+	data, err = p.Data("{measurement}", "{tags}/{field}", now)
+	require.NoError(t, err)
+	assert.Equal(t, "used", data[0].Topic)
+	assert.Equal(t, now, data[0].DateTime, "received time")
+
+	_, err = p.Data("{host}", "{field}", now)
+	assert.Error(t, err, "empty module")
+}
@@ -12,13 +12,19 @@ import (
 	"github.com/jessevdk/go-flags"
 	"github.com/parMaster/logserver/app/api"
 	"github.com/parMaster/logserver/app/config"
-	"github.com/parMaster/logserver/app/store"
 )
 
 var Options struct {
 	Config string `long:"config" env:"CONFIG" default:"config.yml" description:"YAML config file name"`
-	Cmd    string `long:"cmd" env:"CMD" description:"command to run (server, migrate)"`
+	Cmd    string `long:"cmd" env:"CMD" description:"command to run (server, service, migrate, spool, reprocess, record, replay, simulate)"`
 	Dbg    bool   `long:"dbg" env:"DBG" description:"debug mode, overrides config Serve.Dbg"`
+
+	Migrate   MigrateOptions   `group:"migrate options"`
+	Spool     SpoolOptions     `group:"spool options"`
+	Reprocess ReprocessOptions `group:"reprocess options" namespace:"reprocess"`
+	Record    RecordOptions    `group:"record options" namespace:"record"`
+	Replay    ReplayOptions    `group:"replay options" namespace:"replay"`
+	Simulate  SimulateOptions  `group:"simulate options" namespace:"simulate"`
 }
 
 func main() {
@@ -55,15 +61,52 @@ func main() {
 
 	switch Options.Cmd {
 	case "migrate":
-		store.Migrate(ctx)
+		if err := RunMigrate(ctx, *config, Options.Migrate); err != nil {
+			log.Fatalf("[ERROR] Migration failed: %v", err)
+		}
+	case "spool":
+		if err := RunSpool(ctx, *config, Options.Spool); err != nil {
+			log.Fatalf("[ERROR] Spool failed: %v", err)
+		}
+	case "reprocess":
+		if err := RunReprocess(ctx, *config, Options.Reprocess); err != nil {
+			log.Fatalf("[ERROR] Reprocessing failed: %v", err)
+		}
+	case "record":
+		if err := RunRecord(ctx, *config, Options.Record); err != nil {
+			log.Fatalf("[ERROR] Recording failed: %v", err)
+		}
+	case "replay":
+		if err := RunReplay(ctx, *config, Options.Replay); err != nil {
+			log.Fatalf("[ERROR] Replay failed: %v", err)
+		}
+	case "simulate":
+		if err := RunSimulate(ctx, *config, Options.Simulate); err != nil {
+			log.Fatalf("[ERROR] Simulation failed: %v", err)
+		}
 	case "service":
-		RunService(ctx, *config)
+		s, err := LoadService(ctx, *config)
+		if err != nil {
+			log.Fatalf("Can't configure service: %v", err)
+		}
+		RunService(ctx, s)
 	default:
+		s, err := LoadService(ctx, *config)
+		if err != nil {
+			log.Fatalf("Can't configure service: %v", err)
+		}
 
-		go RunService(ctx, *config)
+		done := make(chan struct{})
+		go func() {
+			RunService(ctx, s)
+			close(done)
+		}()
 
-		if err := api.NewApiServer(ctx, *config).Start(); err != nil {
+		// api shares the storage with the service
+		if err := api.NewApiServer(ctx, *config, s.Storer, s).Start(); err != nil {
 			log.Fatalf("Can't start logserver %e", err)
 		}
+		// wait for buffered records to be written
+		<-done
 	}
 }
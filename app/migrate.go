@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/store"
+)
+
+type MigrateOptions struct {
+	From       string   `long:"from" description:"source storage URI, type:path, e.g. sqlite:store/mqttdata.db (default: configured storage)"`
+	To         string   `long:"to" description:"target storage URI, type:path, e.g. bolt:/mnt/ramdisk/mqttdata.bolt"`
+	Modules    []string `long:"module" description:"module to migrate, repeatable (default: all)"`
+	Topics     []string `long:"topic" description:"topic to migrate, repeatable (default: all)"`
+	Since      string   `long:"since" description:"migrate records since the time, RFC3339 or 2006-01-02"`
+	Until      string   `long:"until" description:"migrate records before the time, RFC3339 or 2006-01-02"`
+	Checkpoint string   `long:"checkpoint" default:"migrate.checkpoint" description:"progress file to resume interrupted migration, empty to start over"`
+	DryRun     bool     `long:"dry-run" description:"count the records without writing"`
+}
+
+// RunMigrate copies the records between the storages and reports record counts of every module
+func RunMigrate(ctx context.Context, cfg config.Config, opts MigrateOptions) (err error) {
+	m := store.Migration{Modules: opts.Modules, Topics: opts.Topics, Checkpoint: opts.Checkpoint, DryRun: opts.DryRun}
+
+	if m.Since, err = parseTimeOption(opts.Since); err != nil {
+		return err
+	}
+	if m.Until, err = parseTimeOption(opts.Until); err != nil {
+		return err
+	}
+
+	if opts.From == "" {
+		opts.From = cfg.Storage.Type + ":" + cfg.Storage.Path
+	}
+	if opts.To == "" {
+		return fmt.Errorf("target storage is not set, use --to type:path")
+	}
+	if opts.From == opts.To {
+		return fmt.Errorf("source and target are the same storage %s", opts.From)
+	}
+	m.Source, m.Target = opts.From, opts.To
+	if m.From, err = store.Open(ctx, opts.From); err != nil {
+		return err
+	}
+	if m.To, err = store.Open(ctx, opts.To); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Migrating %s to %s, dry run: %v", opts.From, opts.To, opts.DryRun)
+	reports, err := store.Migrate(ctx, m)
+	failed := 0
+	for _, r := range reports {
+		log.Printf("[INFO] %s", r)
+		if !r.OK() {
+			failed++
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 && !opts.DryRun {
+		return fmt.Errorf("record counts of %d modules don't match", failed)
+	}
+	return nil
+}
+
+// parseTimeOption parses RFC3339 time or local date, zero time if empty
+func parseTimeOption(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339 or 2006-01-02", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,92 @@
+package publish
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Entry is the command in the audit log
+type Entry struct {
+	Time time.Time `json:"time"`
+	User string    `json:"user"`
+	Command
+	Result string `json:"result"` // Published, Rejected or Failed
+	Error  string `json:"error,omitempty"`
+}
+
+// Audit is the append-only log of the commands, a file of JSON lines
+type Audit struct {
+	mu   sync.Mutex
+	path string
+}
+
+// OpenAudit creates the directory of the audit log, the file is created on the first write
+func OpenAudit(path string) (*Audit, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	return &Audit{path: path}, nil
+}
+
+// Write appends the entry and syncs the file
+func (a *Audit) Write(e Entry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(f).Encode(e); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Last returns the last entries, the newest first, all of them if limit is not set
+func (a *Audit) Last(limit int) ([]Entry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return []Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var all []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("[WARN] skipping invalid audit entry at line %d: %v", line, err)
+			continue
+		}
+		all = append(all, e)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 || limit > len(all) {
+		limit = len(all)
+	}
+	res := make([]Entry, 0, limit)
+	for i := len(all) - 1; i >= len(all)-limit; i-- {
+		res = append(res, all[i])
+	}
+	return res, nil
+}
@@ -0,0 +1,151 @@
+package publish
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+)
+
+var (
+	ErrForbidden = errors.New("topic is not allowed")
+	ErrInvalid   = errors.New("invalid command")
+)
+
+// Sender publishes the message to the broker connection by name
+type Sender interface {
+	Publish(broker string, m queue.Message) error
+}
+
+// Command is the message to publish to the device
+type Command struct {
+	Broker   string `json:"broker,omitempty"` // broker connection name, default if empty
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	QoS      byte   `json:"qos"`
+	Retained bool   `json:"retained"`
+}
+
+// Results of the commands in the audit log
+const (
+	Published = "published"
+	Rejected  = "rejected"
+	Failed    = "failed"
+)
+
+// Publisher checks the commands against the whitelist, publishes them and writes them to the audit log
+type Publisher struct {
+	topics    []config.PublishTopic
+	send      Sender
+	audit     *Audit
+	validator *route.Validator
+	now       func() time.Time
+}
+
+// New creates the publisher of the configured topics, broker is the name of the default connection
+func New(cfg config.Publish, broker string, send Sender) (*Publisher, error) {
+	if cfg.AuditLog == "" {
+		return nil, errors.New("audit log is required to publish")
+	}
+	topics := make([]config.PublishTopic, 0, len(cfg.Topics))
+	for _, t := range cfg.Topics {
+		if err := queue.ValidFilter(t.Topic); err != nil {
+			return nil, fmt.Errorf("publish topic %q: %w", t.Topic, err)
+		}
+		if t.QoS > 2 {
+			return nil, fmt.Errorf("publish topic %q: invalid qos %d", t.Topic, t.QoS)
+		}
+		if t.Broker == "" {
+			t.Broker = broker
+		}
+		topics = append(topics, t)
+	}
+	audit, err := OpenAudit(cfg.AuditLog)
+	if err != nil {
+		return nil, err
+	}
+	return &Publisher{topics: topics, send: send, audit: audit, validator: route.NewValidator(), now: time.Now}, nil
+}
+
+// Topics returns the whitelisted topics
+func (p *Publisher) Topics() []config.PublishTopic {
+	return append([]config.PublishTopic{}, p.topics...)
+}
+
+// Publish publishes the command of the user. Every command is written to the audit log with the result,
+// ErrForbidden and ErrInvalid are returned for the commands rejected by the whitelist
+func (p *Publisher) Publish(user string, c Command) (Entry, error) {
+	e := Entry{Time: p.now().UTC(), User: user, Command: c}
+	t, err := p.check(c)
+	if t != nil {
+		e.Broker = t.Broker
+	}
+	if err == nil {
+		e.Result = Published
+		if err = p.send.Publish(e.Broker, queue.Message{Topic: c.Topic, Payload: c.Payload, QoS: c.QoS, Retained: c.Retained}); err != nil {
+			e.Result = Failed
+		}
+	} else {
+		e.Result = Rejected
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	log.Printf("[INFO] %s %s %q to %s by %s", e.Result, c.Topic, c.Payload, e.Broker, user)
+	if aerr := p.audit.Write(e); aerr != nil {
+		log.Printf("[ERROR] failed to write audit log: %v", aerr)
+	}
+	return e, err
+}
+
+// Audit returns the last entries of the audit log, the newest first, all of them if limit is not set
+func (p *Publisher) Audit(limit int) ([]Entry, error) {
+	return p.audit.Last(limit)
+}
+
+// check returns the whitelisted topic of the command or the reason it is rejected
+func (p *Publisher) check(c Command) (*config.PublishTopic, error) {
+	if err := queue.ValidTopic(c.Topic); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	var t *config.PublishTopic
+	for i := range p.topics {
+		if (c.Broker == "" || c.Broker == p.topics[i].Broker) && queue.Match(p.topics[i].Topic, c.Topic) {
+			t = &p.topics[i]
+			break
+		}
+	}
+	if t == nil {
+		return nil, ErrForbidden
+	}
+
+	if c.QoS > t.QoS {
+		return t, fmt.Errorf("%w: qos %d is above %d", ErrInvalid, c.QoS, t.QoS)
+	}
+	if c.Retained && !t.Retained {
+		return t, fmt.Errorf("%w: retained messages are not allowed", ErrInvalid)
+	}
+	if len(t.Values) > 0 && !contains(t.Values, c.Payload) {
+		return t, fmt.Errorf("%w: payload %q is not one of %v", ErrInvalid, c.Payload, t.Values)
+	}
+	d := store.Data{Module: t.Broker, Topic: c.Topic, DateTime: p.now(), Value: store.ParseValue(c.Payload)}
+	if err := p.validator.Check(&t.Validate, d); err != nil {
+		return t, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return t, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+package publish
+
+import (
+	"errors"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sender records the published messages, fails if err is set
+type sender struct {
+	sent []queue.Message
+	to   []string
+	err  error
+}
+
+func (s *sender) Publish(broker string, m queue.Message) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.sent, s.to = append(s.sent, m), append(s.to, broker)
+	return nil
+}
+
+func Test_Publisher(t *testing.T) {
+
+	min, max := 20.0, 35.0
+	cfg := config.Publish{
+		AuditLog: path.Join(t.TempDir(), "audit", "audit.jsonl"),
+		Topics: []config.PublishTopic{
+			{Topic: "croco/cave/targetTemperature", QoS: 1, Retained: true, Validate: config.Validate{Numeric: true, Min: &min, Max: &max}},
+			{Topic: "croco/+/light", Values: []string{"on", "off"}},
+			{Topic: "office/heater", Broker: "office"},
+		},
+	}
+	s := &sender{}
+	p, err := New(cfg, "default", s)
+	require.NoError(t, err)
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	e, err := p.Publish("admin", Command{Topic: "croco/cave/targetTemperature", Payload: "28", QoS: 1, Retained: true})
+	assert.NoError(t, err)
+	assert.Equal(t, Entry{Time: now, User: "admin", Result: Published,
+		Command: Command{Broker: "default", Topic: "croco/cave/targetTemperature", Payload: "28", QoS: 1, Retained: true}}, e)
+	_, err = p.Publish("admin", Command{Topic: "croco/kitchen/light", Payload: "off"})
+	assert.NoError(t, err)
+	_, err = p.Publish("admin", Command{Topic: "office/heater", Payload: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []queue.Message{
+		{Topic: "croco/cave/targetTemperature", Payload: "28", QoS: 1, Retained: true},
+		{Topic: "croco/kitchen/light", Payload: "off"},
+		{Topic: "office/heater", Payload: "1"},
+	}, s.sent)
+	assert.Equal(t, []string{"default", "default", "office"}, s.to)
+
+	for _, c := range []Command{
+		{Topic: "croco/cave/heater", Payload: "1"},
+		{Topic: "office/heater", Payload: "1", Broker: "default"},
+	} {
+		_, err = p.Publish("admin", c)
+		assert.ErrorIs(t, err, ErrForbidden, c.Topic)
+	}
+	for _, c := range []Command{
+		{Topic: "croco/#", Payload: "1"},
+		{Topic: "croco/cave/targetTemperature", Payload: "50"},
+		{Topic: "croco/cave/targetTemperature", Payload: "warm"},
+		{Topic: "croco/cave/targetTemperature", Payload: "28", QoS: 2},
+		{Topic: "croco/cave/light", Payload: "dim"},
+		{Topic: "croco/cave/light", Payload: "on", Retained: true},
+	} {
+		_, err = p.Publish("admin", c)
+		assert.ErrorIs(t, err, ErrInvalid, c.Payload)
+	}
+	assert.Len(t, s.sent, 3, "rejected commands are not published")
+
+	s.err = errors.New("not connected")
+	e, err = p.Publish("bob", Command{Topic: "croco/cave/light", Payload: "on"})
+	assert.Error(t, err)
+	assert.Equal(t, Failed, e.Result)
+
+	// every command is audited, the newest first
+	audit, err := p.Audit(0)
+	require.NoError(t, err)
+	assert.Len(t, audit, 12)
+	audit, err = p.Audit(2)
+	require.NoError(t, err)
+	require.Len(t, audit, 2)
+	assert.Equal(t, "bob", audit[0].User)
+	assert.Equal(t, Failed, audit[0].Result)
+	assert.Equal(t, "not connected", audit[0].Error)
+	assert.Equal(t, Rejected, audit[1].Result)
+	assert.Contains(t, audit[1].Error, "retained")
+
+	_, err = New(config.Publish{Topics: cfg.Topics}, "default", s)
+	assert.Error(t, err, "audit log is required")
+	_, err = New(config.Publish{AuditLog: cfg.AuditLog, Topics: []config.PublishTopic{{Topic: "croco/#/light"}}}, "default", s)
+	assert.Error(t, err, "invalid filter")
+}
@@ -2,92 +2,250 @@ package queue
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/parMaster/logserver/app/config"
 )
 
-// As soon as we have another message queue, we can:
-// 1. Create an interface for it
-// 2. Create a factory function that returns an instance of the interface
-// 3. Replace all references to mqtt.Client with the interface
-// 4. Replace the factory function with a switch statement that returns the appropriate instance
-// 5. Replace the mqtt.NewClient call with a call to the factory function
-
-// Message represents a message from mqtt queue in strings
-type Message struct {
-	Topic   string
-	Payload string
-}
-
-type Subscription struct {
-	Topic    string                      // topic to subscribe to (e.g. "croco/cave/#")
-	Handler  func(topic, payload string) // handler function to process message
-	Messages chan Message                // channel to consume messages from
-}
-
+// Client is a Queue of the mqtt broker
 type Client struct {
 	mqtt.Client
-	subs []Subscription
+	config config.Mqtt
+
+	mu        sync.Mutex
+	subs      []Subscription
+	connected bool
+	since     time.Time
+
+	received, published int64
 }
 
-// NewClient creates a new mqtt client and subscribes to the given topics
-func NewClient(ctx context.Context, config config.Config, subs ...Subscription) (*Client, error) {
+// NewClient creates a new mqtt client, it connects to the broker on Connect.
+// Messages are acknowledged by the consumer, so with persistent session the broker
+// redelivers QoS 1 and 2 messages received but not processed before restart
+func NewClient(config config.Mqtt) (*Client, error) {
+	c := &Client{config: config}
 
-	opts := mqtt.NewClientOptions().AddBroker(config.Mqtt.MqBrokerURL)
-	opts.SetUsername(config.Mqtt.MqUser)
-	opts.SetPassword(config.Mqtt.MqPassword)
-	opts.SetClientID(config.Mqtt.MqClientId)
-	opts.SetCleanSession(true)
+	broker, err := brokerURL(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg, err := tlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(broker)
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+	if config.KeepAlive > 0 {
+		opts.SetKeepAlive(config.KeepAlive)
+	}
+	if config.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(config.ConnectTimeout)
+	}
+	opts.SetUsername(config.MqUser)
+	opts.SetPassword(config.MqPassword)
+	opts.SetClientID(config.MqClientId)
+	opts.SetCleanSession(!config.Persistent)
+	opts.SetAutoAckDisabled(true)
+	opts.SetDefaultPublishHandler(c.dispatch)
+	if config.StoreDir != "" {
+		opts.SetStore(mqtt.NewFileStore(config.StoreDir))
+	}
 	opts.SetAutoReconnect(true)
 	opts.SetMaxReconnectInterval(1 * time.Second)
 	opts.SetResumeSubs(true)
 
-	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
 		log.Printf("[ERROR] Connection to mqtt broker lost: %s", err)
+		c.setConnected(false)
 	})
 
-	opts.SetReconnectingHandler(func(c mqtt.Client, opts *mqtt.ClientOptions) {
-		log.Printf("[INFO] Reconnecting to mqtt broker %s as %s", config.Mqtt.MqBrokerURL, config.Mqtt.MqClientId)
+	opts.SetReconnectingHandler(func(_ mqtt.Client, _ *mqtt.ClientOptions) {
+		log.Printf("[INFO] Reconnecting to mqtt broker %s as %s", config.MqBrokerURL, config.MqClientId)
 	})
 
-	opts.SetOnConnectHandler(func(c mqtt.Client) {
-		log.Printf("[INFO] Connected to mqtt broker %s as %s", config.Mqtt.MqBrokerURL, config.Mqtt.MqClientId)
-
-		for i, sub := range subs {
-			if token := c.Subscribe(sub.Topic, 0, func(c mqtt.Client, m mqtt.Message) {
-				// either Handler or Messages channel can be used
-				// if sub.Handler != nil {
-				// 	sub.Handler(m.Topic(), string(m.Payload()))
-				// }
-				if sub.Messages != nil {
-					subs[i].Messages <- Message{Topic: m.Topic(), Payload: string(m.Payload())}
-				}
-			}); token.Wait() && token.Error() != nil {
-				log.Printf("[ERROR] failed to subscribe to topic %s: %s", sub.Topic, token.Error())
-			}
-		}
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		log.Printf("[INFO] Connected to mqtt broker %s as %s", config.MqBrokerURL, config.MqClientId)
+		c.setConnected(true)
 
+		c.mu.Lock()
+		subs := append([]Subscription{}, c.subs...)
+		c.mu.Unlock()
+		for _, sub := range subs {
+			c.subscribe(sub)
+		}
 	})
 
-	mq := mqtt.NewClient(opts)
-	if token := mq.Connect(); token.Wait() && token.Error() != nil {
+	c.Client = mqtt.NewClient(opts)
+	return c, nil
+}
+
+// brokerURL returns the broker url, websocket path is added to ws:// and wss:// urls without one
+func brokerURL(cfg config.Mqtt) (string, error) {
+	u, err := url.Parse(cfg.MqBrokerURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker url %q: %w", cfg.MqBrokerURL, err)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "unix":
+	case "ws", "wss":
+		if (u.Path == "" || u.Path == "/") && cfg.WebsocketPath != "" {
+			u.Path = "/" + strings.TrimPrefix(cfg.WebsocketPath, "/")
+		}
+	default:
+		return "", fmt.Errorf("invalid broker url %q: scheme %q is not supported", cfg.MqBrokerURL, u.Scheme)
+	}
+	return u.String(), nil
+}
+
+// tlsConfig returns the tls config of the client, nil if the defaults are good enough
+func tlsConfig(cfg config.Mqtt) (*tls.Config, error) {
+	if cfg.CAFile == "" && cfg.CertFile == "" && cfg.KeyFile == "" && cfg.ServerName == "" && !cfg.Insecure {
+		return nil, nil
+	}
+
+	res := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.Insecure, // nolint:gosec // explicitly configured for LAN brokers
+		MinVersion:         tls.VersionTLS12,
+	}
+	if cfg.Insecure {
+		log.Printf("[WARN] mqtt broker certificate is not verified")
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %w", err)
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file %s", cfg.CAFile)
+		}
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("client certificate requires both cert_file and key_file")
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+// Connect connects to the broker and disconnects when the context is done
+func (c *Client) Connect(ctx context.Context) error {
+	if token := c.Client.Connect(); token.Wait() && token.Error() != nil {
 		log.Printf("[ERROR] failed to connect to mqtt: %s", token.Error())
-		return nil, token.Error()
+		return token.Error()
 	}
 
 	go func() {
 		<-ctx.Done()
 		log.Printf("[INFO] Terminating mqtt client")
-		mq.Disconnect(250)
+		c.Disconnect(250)
+		c.setConnected(false)
 	}()
+	return nil
+}
 
-	Client := Client{
-		mq,
-		subs,
+// Subscribe adds the subscription, it is made right away if the client is connected
+func (c *Client) Subscribe(sub Subscription) error {
+	c.mu.Lock()
+	c.subs = append(c.subs, sub)
+	connected := c.connected
+	c.mu.Unlock()
+
+	if connected {
+		return c.subscribe(sub)
 	}
+	return nil
+}
 
-	return &Client, nil
+// subscribe makes the subscription without a handler of its own, messages are delivered by dispatch
+func (c *Client) subscribe(sub Subscription) error {
+	token := c.Client.Subscribe(sub.Topic, sub.QoS, nil)
+	if token.Wait() && token.Error() != nil {
+		log.Printf("[ERROR] failed to subscribe to topic %s: %s", sub.Topic, token.Error())
+		return token.Error()
+	}
+	return nil
+}
+
+// dispatch delivers the message to every matching subscription, all of them get the same receive time.
+// The message matching no subscription is acknowledged right away
+func (c *Client) dispatch(_ mqtt.Client, mm mqtt.Message) {
+	atomic.AddInt64(&c.received, 1)
+	m := Message{Topic: mm.Topic(), Payload: string(mm.Payload()), Retained: mm.Retained(), QoS: mm.Qos(), Time: time.Now(), ack: mm.Ack}
+
+	c.mu.Lock()
+	var subs []Subscription
+	for _, sub := range c.subs {
+		if Match(sub.Topic, m.Topic) {
+			subs = append(subs, sub)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(subs) == 0 {
+		m.Ack()
+	}
+	for _, sub := range subs {
+		sub.deliver(m)
+	}
+}
+
+// Publish sends the message and waits for the broker acknowledgement of QoS 1 and 2 messages
+func (c *Client) Publish(m Message) error {
+	if err := ValidTopic(m.Topic); err != nil {
+		return err
+	}
+	token := c.Client.Publish(m.Topic, m.QoS, m.Retained, m.Payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return errors.New("publish timed out")
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.published, 1)
+	return nil
+}
+
+func (c *Client) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Status{
+		Type:      "mqtt",
+		Broker:    c.config.MqBrokerURL,
+		Connected: c.connected,
+		Since:     c.since,
+		Received:  atomic.LoadInt64(&c.received),
+		Published: atomic.LoadInt64(&c.published),
+	}
+}
+
+func (c *Client) setConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connected != connected {
+		c.connected, c.since = connected, time.Now()
+	}
 }
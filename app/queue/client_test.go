@@ -0,0 +1,60 @@
+package queue
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_brokerURL(t *testing.T) {
+
+	tbl := []struct {
+		url, path, out string
+		err            bool
+	}{
+		{"tcp://localhost:1883", "/mqtt", "tcp://localhost:1883", false},
+		{"ssl://mqtt.foobar.com:8883", "", "ssl://mqtt.foobar.com:8883", false},
+		{"wss://mqtt.foobar.com", "mqtt", "wss://mqtt.foobar.com/mqtt", false},
+		{"ws://localhost:8080/", "/mqtt", "ws://localhost:8080/mqtt", false},
+		{"wss://mqtt.foobar.com/ws", "/mqtt", "wss://mqtt.foobar.com/ws", false},
+		{"http://localhost", "", "", true},
+		{"://", "", "", true},
+	}
+	for _, tt := range tbl {
+		out, err := brokerURL(config.Mqtt{MqBrokerURL: tt.url, WebsocketPath: tt.path})
+		if tt.err {
+			assert.Error(t, err, tt.url)
+			continue
+		}
+		assert.NoError(t, err, tt.url)
+		assert.Equal(t, tt.out, out, tt.url)
+	}
+}
+
+func Test_tlsConfig(t *testing.T) {
+
+	cfg, err := tlsConfig(config.Mqtt{MqBrokerURL: "ssl://mqtt.foobar.com:8883"})
+	assert.NoError(t, err)
+	assert.Nil(t, cfg, "defaults are used without tls options")
+
+	cfg, err = tlsConfig(config.Mqtt{Insecure: true, ServerName: "broker.lan"})
+	assert.NoError(t, err)
+	assert.True(t, cfg.InsecureSkipVerify)
+	assert.Equal(t, "broker.lan", cfg.ServerName)
+
+	_, err = tlsConfig(config.Mqtt{CertFile: "client.pem"})
+	assert.Error(t, err, "key is required")
+	_, err = tlsConfig(config.Mqtt{CAFile: "nosuchfile.pem"})
+	assert.Error(t, err)
+
+	empty := path.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(empty, []byte("not a certificate"), 0o600))
+	_, err = tlsConfig(config.Mqtt{CAFile: empty})
+	assert.Error(t, err)
+
+	_, err = NewClient(config.Mqtt{MqBrokerURL: "ssl://mqtt.foobar.com:8883", CAFile: empty})
+	assert.Error(t, err)
+}
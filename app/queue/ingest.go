@@ -0,0 +1,354 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+)
+
+// Overflow policies of the Ingest
+const (
+	PolicyBlock      = "block"       // wait for the consumer, holds up the client, needs the persistent session
+	PolicyDropOldest = "drop-oldest" // drop the oldest buffered message
+	PolicyDropNewest = "drop-newest" // drop the message received
+	PolicySpill      = "spill"       // write the messages to disk until the consumer catches up
+)
+
+// Ingest is a bounded FIFO of the received messages between the queue and the consumer.
+// Messages dropped by the policy are acknowledged right away, spilled ones once written to disk
+type Ingest struct {
+	topic    string
+	capacity int
+	policy   string
+
+	mu     sync.Mutex
+	ready  chan struct{} // signals the waiting consumer and publishers
+	buf    []Message
+	spill  *spill // nil unless the policy is spill
+	closed bool
+	stats  IngestStats
+}
+
+// IngestStats are the counters of the subscription ingest queue
+type IngestStats struct {
+	Broker    string `json:"broker,omitempty"`
+	Topic     string `json:"topic"`
+	Policy    string `json:"policy"`
+	Capacity  int    `json:"capacity"`
+	Received  int64  `json:"received"`
+	Processed int64  `json:"processed"`
+	Dropped   int64  `json:"dropped"`
+	Spilled   int64  `json:"spilled"`
+	Blocked   int64  `json:"blocked"`           // messages waited for the free space
+	Pending   int    `json:"pending"`           // messages in memory and on disk
+	Archive   bool   `json:"archive,omitempty"` // queue of the archive subscription
+}
+
+// NewIngest creates the ingest queue of the broker connection subscription topic,
+// spilled messages left by the previous run are consumed first. The policy is spill if spill_dir is set,
+// drop-oldest otherwise, so that the client callback is never held up unless block is configured
+func NewIngest(broker, topic string, cfg config.Ingest) (*Ingest, error) {
+	if cfg.Capacity <= 0 {
+		cfg.Capacity = 1000
+	}
+	if cfg.Policy == "" && cfg.SpillDir != "" {
+		cfg.Policy = PolicySpill
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = PolicyDropOldest
+	}
+
+	i := &Ingest{
+		topic:    topic,
+		capacity: cfg.Capacity,
+		policy:   cfg.Policy,
+		ready:    make(chan struct{}),
+		stats:    IngestStats{Broker: broker, Topic: topic, Policy: cfg.Policy, Capacity: cfg.Capacity},
+	}
+
+	switch cfg.Policy {
+	case PolicyBlock, PolicyDropOldest, PolicyDropNewest:
+	case PolicySpill:
+		if cfg.SpillDir == "" {
+			return nil, fmt.Errorf("spill policy requires spill_dir")
+		}
+		sp, err := openSpill(filepath.Join(cfg.SpillDir, spillName(broker, topic)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open spill of %s: %w", topic, err)
+		}
+		i.spill = sp
+	default:
+		return nil, fmt.Errorf("ingest policy %s is not supported", cfg.Policy)
+	}
+	return i, nil
+}
+
+// Push adds the message, overflow is handled according to the policy
+func (i *Ingest) Push(m Message) {
+	i.mu.Lock()
+	i.stats.Received++
+	for i.policy == PolicyBlock && len(i.buf) >= i.capacity && !i.closed {
+		i.stats.Blocked++
+		ready := i.ready
+		i.mu.Unlock()
+		<-ready
+		i.mu.Lock()
+	}
+	defer i.mu.Unlock()
+
+	switch {
+	case i.closed:
+		// not acknowledged, so that the broker redelivers it to the persistent session
+		i.stats.Dropped++
+		return
+	case i.spill != nil && (i.spill.n > 0 || len(i.buf) >= i.capacity):
+		// once spilling, the messages go to disk until it is drained to keep the order
+		if err := i.spill.write(m); err != nil {
+			log.Printf("[ERROR] failed to spill message of %s: %v", m.Topic, err)
+			i.stats.Dropped++
+		} else {
+			i.stats.Spilled++
+		}
+		m.Ack()
+	case len(i.buf) >= i.capacity && i.policy == PolicyDropNewest:
+		i.stats.Dropped++
+		m.Ack()
+		return
+	case len(i.buf) >= i.capacity:
+		i.buf[0].Ack()
+		i.buf = append(i.buf[1:], m)
+		i.stats.Dropped++
+	default:
+		i.buf = append(i.buf, m)
+	}
+	i.signal()
+}
+
+// Pop returns the oldest message, waits for it if there is none. False is returned when the context is done
+func (i *Ingest) Pop(ctx context.Context) (Message, bool) {
+	for {
+		i.mu.Lock()
+		if m, ok := i.next(); ok {
+			i.stats.Processed++
+			i.signal()
+			i.mu.Unlock()
+			return m, true
+		}
+		ready := i.ready
+		i.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return Message{}, false
+		case <-ready:
+		}
+	}
+}
+
+// next takes the message from memory first, then from disk
+func (i *Ingest) next() (Message, bool) {
+	if len(i.buf) > 0 {
+		m := i.buf[0]
+		i.buf[0] = Message{}
+		i.buf = i.buf[1:]
+		return m, true
+	}
+	if i.spill == nil || i.spill.n == 0 {
+		return Message{}, false
+	}
+	m, err := i.spill.read()
+	if err != nil {
+		log.Printf("[ERROR] failed to read spilled message of %s, dropping the spill: %v", i.topic, err)
+		i.stats.Dropped += int64(i.spill.n)
+		if err = i.spill.reset(); err != nil {
+			log.Printf("[ERROR] failed to reset spill of %s: %v", i.topic, err)
+		}
+		return Message{}, false
+	}
+	return m, true
+}
+
+// signal wakes up the waiting consumer and publishers, called with the lock held
+func (i *Ingest) signal() {
+	close(i.ready)
+	i.ready = make(chan struct{})
+}
+
+// Close releases the blocked publishers, the messages pushed after are dropped. Spilled messages are kept on disk
+func (i *Ingest) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+	i.signal()
+	if i.spill != nil {
+		return i.spill.close()
+	}
+	return nil
+}
+
+// Stats returns the counters of the queue
+func (i *Ingest) Stats() IngestStats {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	s := i.stats
+	s.Pending = len(i.buf)
+	if i.spill != nil {
+		s.Pending += i.spill.n
+	}
+	return s
+}
+
+// spill is an append-only file of JSON lines read from the beginning, truncated once read to the end.
+// Lines left unread are compacted on close
+type spill struct {
+	path  string
+	dirty bool // some lines are read
+	w     *os.File
+	r     *os.File
+	b     *bufio.Reader
+	n     int // messages not read yet
+}
+
+type spilled struct {
+	Topic    string `json:"topic"`
+	Payload  string `json:"payload"`
+	Retained bool   `json:"retained,omitempty"`
+	QoS      byte   `json:"qos,omitempty"`
+	Time     int64  `json:"time,omitempty"` // unix nano, set for the replayed and simulated messages
+}
+
+func spillName(broker, topic string) string {
+	r := strings.NewReplacer("/", "_", "+", "plus", "#", "hash")
+	if broker != "" {
+		topic = broker + "/" + topic
+	}
+	return r.Replace(topic) + ".spill"
+}
+
+func openSpill(path string) (*spill, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, err
+	}
+	w, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(path) // nolint:gosec
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	s := &spill{path: path, w: w, r: r, b: bufio.NewReader(r)}
+
+	// count the messages left by the previous run
+	for {
+		if _, err = s.b.ReadBytes('\n'); err != nil {
+			break
+		}
+		s.n++
+	}
+	if err != io.EOF {
+		s.close()
+		return nil, err
+	}
+	if s.n > 0 {
+		log.Printf("[INFO] %d spilled messages found in %s", s.n, path)
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		s.close()
+		return nil, err
+	}
+	s.b.Reset(r)
+	return s, nil
+}
+
+func (s *spill) write(m Message) error {
+	sm := spilled{Topic: m.Topic, Payload: m.Payload, Retained: m.Retained, QoS: m.QoS}
+	if !m.Time.IsZero() {
+		sm.Time = m.Time.UnixNano()
+	}
+	line, err := json.Marshal(sm)
+	if err != nil {
+		return err
+	}
+	if _, err = s.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.n++
+	return nil
+}
+
+func (s *spill) read() (Message, error) {
+	line, err := s.b.ReadBytes('\n')
+	if err != nil {
+		return Message{}, err
+	}
+	var m spilled
+	if err = json.Unmarshal(line, &m); err != nil {
+		return Message{}, err
+	}
+	s.n--
+	s.dirty = true
+	if s.n == 0 {
+		if err = s.reset(); err != nil {
+			return Message{}, err
+		}
+	}
+	res := Message{Topic: m.Topic, Payload: m.Payload, Retained: m.Retained, QoS: m.QoS}
+	if m.Time != 0 {
+		res.Time = time.Unix(0, m.Time)
+	}
+	return res, nil
+}
+
+// reset truncates the file read to the end
+func (s *spill) reset() error {
+	s.n, s.dirty = 0, false
+	if err := s.w.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.b.Reset(s.r)
+	return nil
+}
+
+func (s *spill) close() error {
+	if err := s.w.Close(); err != nil {
+		s.r.Close()
+		return err
+	}
+	defer s.r.Close()
+	if !s.dirty {
+		return nil
+	}
+
+	// keep the unread lines only
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, s.b); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,144 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pop(t *testing.T, i *Ingest, n int) (res []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for k := 0; k < n; k++ {
+		m, ok := i.Pop(ctx)
+		require.True(t, ok)
+		res = append(res, m.Payload)
+	}
+	return res
+}
+
+func Test_Ingest_Drop(t *testing.T) {
+
+	_, err := NewIngest("", "croco/#", config.Ingest{Policy: "ignore"})
+	assert.Error(t, err)
+	def, err := NewIngest("", "croco/#", config.Ingest{})
+	require.NoError(t, err)
+	assert.Equal(t, PolicyDropOldest, def.Stats().Policy, "client callback is not held up by default")
+	def, err = NewIngest("", "croco/#", config.Ingest{SpillDir: t.TempDir()})
+	require.NoError(t, err)
+	assert.Equal(t, PolicySpill, def.Stats().Policy)
+	assert.NoError(t, def.Close())
+
+	acked := map[string]bool{}
+	msg := func(payload string) Message {
+		return Message{Topic: "croco/cave/temp", Payload: payload, ack: func() { acked[payload] = true }}
+	}
+
+	newest, err := NewIngest("", "croco/#", config.Ingest{Capacity: 2, Policy: PolicyDropNewest})
+	require.NoError(t, err)
+	oldest, err := NewIngest("", "croco/#", config.Ingest{Capacity: 2, Policy: PolicyDropOldest})
+	require.NoError(t, err)
+	for _, p := range []string{"1", "2", "3"} {
+		newest.Push(msg("n" + p))
+		oldest.Push(msg("o" + p))
+	}
+
+	assert.Equal(t, map[string]bool{"n3": true, "o1": true}, acked, "dropped messages are acknowledged")
+	assert.Equal(t, IngestStats{Topic: "croco/#", Policy: PolicyDropNewest, Capacity: 2, Received: 3, Dropped: 1, Pending: 2}, newest.Stats())
+	assert.Equal(t, []string{"n1", "n2"}, pop(t, newest, 2))
+	assert.Equal(t, []string{"o2", "o3"}, pop(t, oldest, 2))
+	assert.Equal(t, int64(2), oldest.Stats().Processed)
+	assert.Zero(t, oldest.Stats().Pending)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok := oldest.Pop(ctx)
+	assert.False(t, ok)
+}
+
+func Test_Ingest_Block(t *testing.T) {
+
+	i, err := NewIngest("", "croco/#", config.Ingest{Capacity: 1, Policy: PolicyBlock})
+	require.NoError(t, err)
+	i.Push(Message{Payload: "1"})
+
+	pushed := make(chan struct{})
+	go func() {
+		i.Push(Message{Payload: "2"})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push must block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, int64(1), i.Stats().Blocked)
+
+	assert.Equal(t, []string{"1"}, pop(t, i, 1))
+	<-pushed
+	assert.Equal(t, []string{"2"}, pop(t, i, 1))
+
+	// close releases the blocked publishers
+	i.Push(Message{Payload: "3"})
+	go func() {
+		i.Push(Message{Payload: "4"})
+		close(pushed)
+	}()
+	pushed = make(chan struct{})
+	assert.NoError(t, i.Close())
+	<-pushed
+	assert.Equal(t, int64(1), i.Stats().Dropped)
+}
+
+func Test_Ingest_Spill(t *testing.T) {
+
+	cfg := config.Ingest{Capacity: 2, Policy: PolicySpill, SpillDir: t.TempDir()}
+	_, err := NewIngest("", "croco/#", config.Ingest{Policy: PolicySpill})
+	assert.Error(t, err, "spill requires the directory")
+
+	i, err := NewIngest("", "croco/#", cfg)
+	require.NoError(t, err)
+	acked := 0
+	for k := 1; k <= 5; k++ {
+		i.Push(Message{Topic: "croco/cave/temp", Payload: fmt.Sprint(k), QoS: 1, ack: func() { acked++ }})
+	}
+	assert.Equal(t, 3, acked, "spilled messages are acknowledged")
+	stats := i.Stats()
+	assert.Equal(t, int64(3), stats.Spilled)
+	assert.Equal(t, 5, stats.Pending)
+
+	// memory first, then disk, the new messages follow the spilled ones
+	assert.Equal(t, []string{"1", "2", "3"}, pop(t, i, 3))
+	i.Push(Message{Topic: "croco/cave/temp", Payload: "6"})
+	assert.Equal(t, 3, i.Stats().Pending)
+	assert.NoError(t, i.Close())
+
+	// spilled messages are consumed after restart
+	i, err = NewIngest("", "croco/#", cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 3, i.Stats().Pending)
+	i.Push(Message{Topic: "croco/cave/temp", Payload: "7"})
+	assert.Equal(t, []string{"4", "5", "6", "7"}, pop(t, i, 4))
+	assert.Zero(t, i.Stats().Pending)
+
+	// drained spill is truncated, the queue is in memory again
+	i.Push(Message{Topic: "croco/cave/temp", Payload: "8"})
+	assert.Equal(t, int64(1), i.Stats().Spilled, "7 is spilled after restart, 8 is not")
+	assert.Equal(t, []string{"8"}, pop(t, i, 1))
+
+	// receive time of the replayed message is spilled along
+	received := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	for k := 0; k < 3; k++ {
+		i.Push(Message{Topic: "croco/cave/temp", Payload: "9", Time: received})
+	}
+	pop(t, i, 2)
+	m, ok := i.Pop(context.Background())
+	require.True(t, ok)
+	assert.True(t, received.Equal(m.Time))
+	assert.NoError(t, i.Close())
+}
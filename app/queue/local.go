@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Local is an in-process Queue: published messages are delivered to matching subscriptions
+// right away, retained messages are delivered to new subscriptions
+type Local struct {
+	mu       sync.RWMutex
+	subs     []Subscription
+	retained map[string]Message
+	status   Status
+}
+
+func NewLocal() *Local {
+	return &Local{
+		retained: map[string]Message{},
+		status:   Status{Type: "local", Broker: "local"},
+	}
+}
+
+// Connect marks the queue connected until the context is done
+func (l *Local) Connect(ctx context.Context) error {
+	l.mu.Lock()
+	l.status.Connected, l.status.Since = true, time.Now()
+	l.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		l.mu.Lock()
+		l.status.Connected, l.status.Since = false, time.Now()
+		l.mu.Unlock()
+	}()
+	return nil
+}
+
+// Subscribe adds the subscription and delivers the matching retained messages
+func (l *Local) Subscribe(sub Subscription) error {
+	if err := ValidFilter(sub.Topic); err != nil {
+		return fmt.Errorf("invalid filter %q: %w", sub.Topic, err)
+	}
+
+	l.mu.Lock()
+	l.subs = append(l.subs, sub)
+	var retained []Message
+	for topic, m := range l.retained {
+		if Match(sub.Topic, topic) {
+			retained = append(retained, m)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, m := range retained {
+		if m.Time.IsZero() {
+			m.Time = time.Now()
+		}
+		sub.deliver(m)
+	}
+	return nil
+}
+
+// Unsubscribe removes the subscriptions of the subscriber id to the filter, all of them if the filter is empty
+func (l *Local) Unsubscribe(id, filter string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	subs := l.subs[:0]
+	for _, s := range l.subs {
+		if s.ID == id && (filter == "" || s.Topic == filter) {
+			continue
+		}
+		subs = append(subs, s)
+	}
+	for i := len(subs); i < len(l.subs); i++ {
+		l.subs[i] = Subscription{}
+	}
+	l.subs = subs
+}
+
+// Publish delivers the message to the subscriptions matching the topic. Retained message
+// replaces the one retained before, retained message with empty payload removes it
+func (l *Local) Publish(m Message) error {
+	if err := ValidTopic(m.Topic); err != nil {
+		return fmt.Errorf("invalid topic %q: %w", m.Topic, err)
+	}
+
+	l.mu.Lock()
+	if !l.status.Connected {
+		l.mu.Unlock()
+		return errors.New("not connected")
+	}
+	if m.Retained {
+		if m.Payload == "" {
+			delete(l.retained, m.Topic)
+		} else {
+			l.retained[m.Topic] = m
+		}
+	}
+	l.status.Published++
+	var subs []Subscription
+	for _, s := range l.subs {
+		if Match(s.Topic, m.Topic) {
+			subs = append(subs, s)
+		}
+	}
+	l.status.Received += int64(len(subs))
+	l.mu.Unlock()
+
+	// messages are delivered to the subscribers as published, not retained
+	m.Retained = false
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	for _, s := range subs {
+		s.deliver(m)
+	}
+	return nil
+}
+
+func (l *Local) Status() Status {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.status
+}
@@ -0,0 +1,92 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Local(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := NewLocal()
+	var _ Queue = q
+
+	assert.Error(t, q.Publish(Message{Topic: "croco/cave/temp", Payload: "23.5"}), "not connected")
+	assert.NoError(t, q.Connect(ctx))
+	assert.True(t, q.Status().Connected)
+
+	var got []Message
+	assert.NoError(t, q.Subscribe(Subscription{Topic: "croco/+/temp", Handler: func(topic, payload string) {
+		got = append(got, Message{Topic: topic, Payload: payload})
+	}}))
+	ch := make(chan Message, 10)
+	assert.NoError(t, q.Subscribe(Subscription{Topic: "croco/#", Messages: ch}))
+	assert.Error(t, q.Subscribe(Subscription{Topic: "croco/#/temp"}))
+
+	assert.NoError(t, q.Publish(Message{Topic: "croco/cave/temp", Payload: "23.5"}))
+	assert.NoError(t, q.Publish(Message{Topic: "croco/cave/light", Payload: "1"}))
+	assert.Error(t, q.Publish(Message{Topic: "croco/+/temp", Payload: "1"}))
+
+	// messages are stamped with the receive time
+	received := func(ch chan Message) Message {
+		m := <-ch
+		assert.WithinDuration(t, time.Now(), m.Time, time.Second)
+		m.Time = time.Time{}
+		return m
+	}
+	assert.Equal(t, []Message{{Topic: "croco/cave/temp", Payload: "23.5"}}, got)
+	assert.Len(t, ch, 2)
+	assert.Equal(t, Message{Topic: "croco/cave/temp", Payload: "23.5"}, received(ch))
+	assert.Equal(t, Message{Topic: "croco/cave/light", Payload: "1"}, received(ch))
+	recorded := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, q.Publish(Message{Topic: "croco/cave/light", Payload: "0", Time: recorded}))
+	assert.Equal(t, recorded, (<-ch).Time, "replayed message keeps its time")
+
+	// retained messages are delivered to new subscriptions, empty payload removes the retained message
+	assert.NoError(t, q.Publish(Message{Topic: "croco/cave/target", Payload: "25", Retained: true}))
+	assert.NoError(t, q.Publish(Message{Topic: "croco/car/target", Payload: "20", Retained: true}))
+	assert.NoError(t, q.Publish(Message{Topic: "croco/car/target", Retained: true}))
+	<-ch
+	<-ch
+	<-ch
+	retained := make(chan Message, 10)
+	assert.NoError(t, q.Subscribe(Subscription{Topic: "croco/+/target", Messages: retained}))
+	assert.Len(t, retained, 1)
+	assert.Equal(t, Message{Topic: "croco/cave/target", Payload: "25", Retained: true}, received(retained))
+
+	st := q.Status()
+	assert.Equal(t, int64(6), st.Published)
+	assert.Equal(t, int64(7), st.Received)
+}
+
+func Test_Deliver(t *testing.T) {
+
+	acked := 0
+	m := Message{Topic: "croco/cave/temp", Payload: "23.5", ack: func() { acked++ }}
+
+	// handler messages are acknowledged after the handler
+	Subscription{Handler: func(topic, payload string) { assert.Zero(t, acked) }}.deliver(m)
+	assert.Equal(t, 1, acked)
+
+	// channel consumer acknowledges the messages, dropped ones are acknowledged right away
+	ch := make(chan Message, 1)
+	Subscription{Messages: ch, Lossy: true}.deliver(m)
+	assert.Equal(t, 1, acked)
+	Subscription{Messages: ch, Lossy: true}.deliver(m)
+	assert.Equal(t, 2, acked)
+	(<-ch).Ack()
+	assert.Equal(t, 3, acked)
+
+	// observers leave acknowledgements to other subscriptions
+	Subscription{Handler: func(topic, payload string) {}, NoAck: true}.deliver(m)
+	Subscription{Messages: ch, NoAck: true}.deliver(m)
+	(<-ch).Ack()
+	assert.Equal(t, 3, acked)
+
+	Message{}.Ack()
+}
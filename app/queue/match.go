@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"errors"
+	"strings"
+)
+
+// Match checks if the topic matches the filter. "+" matches a single level, "#" matches
+// any number of levels including the parent one, so "a/#" matches "a". Topics starting with "$"
+// are not matched by filters starting with a wildcard
+func Match(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// ValidFilter checks the subscription filter: wildcards take a whole level, "#" is the last one
+func ValidFilter(filter string) error {
+	if filter == "" {
+		return errors.New("empty filter")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch {
+		case level == "#" && i != len(levels)-1:
+			return errors.New("# is allowed as the last level only")
+		case level != "#" && level != "+" && strings.ContainsAny(level, "+#"):
+			return errors.New("wildcard must take the whole level")
+		}
+	}
+	return nil
+}
+
+// ValidTopic checks the topic of the published message, it has no wildcards
+func ValidTopic(topic string) error {
+	if topic == "" {
+		return errors.New("empty topic")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return errors.New("wildcards are not allowed in topic")
+	}
+	return nil
+}
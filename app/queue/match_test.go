@@ -0,0 +1,51 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Match(t *testing.T) {
+
+	tbl := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"croco/cave/temp", "croco/cave/temp", true},
+		{"croco/cave/temp", "croco/cave/light", false},
+		{"croco/+/temp", "croco/cave/temp", true},
+		{"croco/+/temp", "croco/cave/x/temp", false},
+		{"croco/+", "croco", false},
+		{"croco/+", "croco/", true},
+		{"+/+", "/finance", true},
+		{"+", "/finance", false},
+		{"croco/#", "croco", true},
+		{"croco/#", "croco/cave/temp", true},
+		{"croco/cave/#", "croco/car/temp", false},
+		{"#", "croco/cave/temp", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"croco/cave", "croco/cave/temp", false},
+		{"croco/cave/temp", "croco/cave", false},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.match, Match(tt.filter, tt.topic), "%s %s", tt.filter, tt.topic)
+	}
+}
+
+func Test_ValidFilter(t *testing.T) {
+
+	for _, f := range []string{"#", "+", "a/+/b", "a/#", "+/+/#", "/a"} {
+		assert.NoError(t, ValidFilter(f), f)
+	}
+	for _, f := range []string{"", "a/#/b", "a/b#", "a+/b", "##"} {
+		assert.Error(t, ValidFilter(f), f)
+	}
+
+	assert.NoError(t, ValidTopic("croco/cave/temp"))
+	for _, topic := range []string{"", "croco/+/temp", "croco/#"} {
+		assert.Error(t, ValidTopic(topic), topic)
+	}
+}
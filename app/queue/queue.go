@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+)
+
+// Queue is a message queue with MQTT topics and filters
+type Queue interface {
+	// Connect connects to the queue, subscriptions are established on every (re)connect
+	Connect(ctx context.Context) error
+	// Subscribe delivers the messages of the topics matching the subscription filter,
+	// subscription made before Connect is established on connect
+	Subscribe(sub Subscription) error
+	// Publish sends the message to the topic
+	Publish(m Message) error
+	// Status returns the connection status and message counters
+	Status() Status
+}
+
+// Message represents a message from mqtt queue in strings
+type Message struct {
+	Topic    string
+	Payload  string
+	Retained bool
+	QoS      byte
+	Time     time.Time // receive time, stamped once by the queue, replayed and simulated messages keep their own
+
+	ack func() // acknowledges the message to the broker, nil if not needed
+}
+
+// Ack acknowledges the message once it is processed, QoS 1 and 2 messages not acknowledged
+// are redelivered by the broker after reconnect to the persistent session
+func (m Message) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+type Subscription struct {
+	Topic    string                      // topic to subscribe to (e.g. "croco/cave/#")
+	Handler  func(topic, payload string) // handler function to process message
+	Messages chan Message                // channel to consume messages from, consumer acknowledges them
+	Lossy    bool                        // drop messages while Messages channel is full instead of waiting
+	ID       string                      // subscriber id to unsubscribe by, optional
+	QoS      byte                        // QoS to subscribe to the broker with
+	Ingest   *Ingest                     // bounded queue to consume messages from, takes precedence over Messages
+	NoAck    bool                        // messages are acknowledged by other subscriptions, for observers subscribed with QoS 0
+}
+
+// deliver sends the message to Messages channel, or calls the Handler if there is no channel.
+// Messages passed to the Handler or dropped are acknowledged here unless NoAck is set
+func (s Subscription) deliver(m Message) {
+	if s.NoAck {
+		m.ack = nil
+	}
+	if s.Ingest != nil {
+		s.Ingest.Push(m)
+		return
+	}
+	if s.Messages != nil && s.Lossy {
+		select {
+		case s.Messages <- m:
+		default:
+			m.Ack()
+		}
+		return
+	}
+	if s.Messages != nil {
+		s.Messages <- m
+		return
+	}
+	if s.Handler != nil {
+		s.Handler(m.Topic, m.Payload)
+	}
+	m.Ack()
+}
+
+// Status is the state of the queue connection
+type Status struct {
+	Name      string    `json:"name,omitempty"` // broker connection name
+	Type      string    `json:"type"`
+	Broker    string    `json:"broker"`
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"` // last connection state change
+	Received  int64     `json:"received"`
+	Published int64     `json:"published"`
+	Clients   int       `json:"clients,omitempty"` // connected clients of the embedded broker
+}
+
+// New creates the configured queue, mqtt client by default
+func New(cfg config.Mqtt) (Queue, error) {
+	switch cfg.Type {
+	case "", "mqtt":
+		if cfg.Persistent && cfg.MqClientId == "" {
+			return nil, fmt.Errorf("persistent session requires mq_client_id")
+		}
+		return NewClient(cfg)
+	case "local":
+		return NewLocal(), nil
+	}
+	return nil, fmt.Errorf("queue type %s is not supported", cfg.Type)
+}
+
+// Retry connects the queue in background, retrying every interval until it succeeds or the context is done
+func Retry(ctx context.Context, q Queue, interval time.Duration) {
+	go func() {
+		for q.Connect(ctx) != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/parMaster/logserver/app/archive"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+)
+
+type RecordOptions struct {
+	File     string        `long:"file" default:"traffic.jsonl.gz" description:"recording file, gzip compressed if the name ends with .gz"`
+	Filter   string        `long:"filter" default:"#" description:"topic filter of the recorded messages"`
+	Duration time.Duration `long:"duration" description:"stop recording after the duration, record until interrupted if zero"`
+}
+
+// RunRecord records the messages of the broker connections to the file to replay them later.
+// The service may keep running, recording connects with its own client ids and clean sessions.
+// Embedded broker is not started, its devices can't be recorded
+func RunRecord(ctx context.Context, cfg config.Config, opts RecordOptions) error {
+	if err := queue.ValidFilter(opts.Filter); err != nil {
+		return fmt.Errorf("invalid filter %q: %w", opts.Filter, err)
+	}
+	queues, err := loadQueues(clientConfig(cfg, "record"))
+	if err != nil {
+		return err
+	}
+	rec, err := archive.Create(opts.File)
+	if err != nil {
+		return err
+	}
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	log.Printf("[INFO] Recording %s to %s", opts.Filter, opts.File)
+	err = Record(ctx, queues, opts.Filter, rec)
+	if cerr := rec.Close(); err == nil {
+		err = cerr
+	}
+	log.Printf("[INFO] %d messages recorded to %s", rec.Count(), opts.File)
+	return err
+}
+
+// clientConfig returns the config of the broker connections of the command running along the service:
+// client ids get the suffix so that the session of the service is not taken over, the embedded broker is not started
+func clientConfig(cfg config.Config, suffix string) config.Config {
+	cfg.Broker = config.Broker{}
+	conns := append([]config.Mqtt{cfg.Mqtt}, cfg.Connections...)
+	for i := range conns {
+		if conns[i].MqClientId != "" {
+			conns[i].MqClientId += "-" + suffix
+		}
+		conns[i].Persistent, conns[i].StoreDir = false, ""
+	}
+	cfg.Mqtt, cfg.Connections = conns[0], conns[1:]
+	return cfg
+}
+
+// Record writes the messages of the filter received on the connections to the recorder until the context is done
+func Record(ctx context.Context, queues map[string]queue.Queue, filter string, rec *archive.Recorder) error {
+	if len(queues) == 0 {
+		return errors.New("no broker connections to record")
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for name, q := range queues {
+		sub := queue.Subscription{Topic: filter, Messages: make(chan queue.Message, 1000)}
+		if err := q.Subscribe(sub); err != nil {
+			return fmt.Errorf("failed to subscribe to %s on %s: %w", filter, name, err)
+		}
+		wg.Add(1)
+		go func(name string, sub queue.Subscription) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case m := <-sub.Messages:
+					if err := rec.Write(name, m, m.Time); err != nil {
+						log.Printf("[ERROR] failed to record message on %s: %v", m.Topic, err)
+					}
+					m.Ack()
+				}
+			}
+		}(name, sub)
+	}
+
+	for name, q := range queues {
+		if err := q.Connect(ctx); err != nil {
+			if _, ok := q.(*queue.Client); !ok {
+				return fmt.Errorf("failed to connect %s: %w", name, err)
+			}
+			log.Printf("[WARN] failed to connect %s, retrying: %v", name, err)
+			queue.Retry(ctx, q, 10*time.Second)
+		}
+	}
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-flush.C:
+			if err := rec.Flush(); err != nil {
+				log.Printf("[WARN] failed to flush recording: %v", err)
+			}
+		}
+	}
+}
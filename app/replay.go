@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/parMaster/logserver/app/archive"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/store"
+)
+
+type ReplayOptions struct {
+	File  string  `long:"file" description:"recording to replay, made by record command or an archive file"`
+	Speed float64 `long:"speed" default:"1" description:"replay speed factor, e.g. 10 replays ten times faster, 0 replays instantly"`
+	Store string  `long:"store" description:"storage to write the records to, type:path, the configured one if empty"`
+}
+
+// RunReplay runs the service with the recorded messages instead of the broker connections: routing, validation
+// and storage are the same as for the live messages, records are timestamped with the recorded receive time.
+// The service stops once every message is consumed. Archive, publishing, device state file and storage spool
+// are not used, spilled ingest messages are kept in a temporary directory
+func RunReplay(ctx context.Context, cfg config.Config, opts ReplayOptions) error {
+	if opts.File == "" {
+		return errors.New("recording is not set, see --replay.file")
+	}
+	if opts.Speed < 0 {
+		return fmt.Errorf("invalid replay speed %v", opts.Speed)
+	}
+	if opts.Store != "" {
+		parts := strings.SplitN(opts.Store, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid storage URI %q, expected type:path", opts.Store)
+		}
+		cfg.Storage.Type, cfg.Storage.Path = parts[0], strings.TrimPrefix(parts[1], "//")
+	}
+	cfg.Storage.Spool = config.Spool{}
+	cfg.Archive, cfg.Publish = config.Archive{}, config.Publish{}
+	cfg.Devices.StateFile = ""
+	if cfg.Ingest.Policy == "" {
+		// nothing is lost waiting for the consumer of the local queues
+		cfg.Ingest.Policy = queue.PolicyBlock
+	}
+	if cfg.Ingest.Policy == queue.PolicySpill {
+		dir, err := os.MkdirTemp("", "logserver-replay-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		cfg.Ingest.SpillDir = dir
+	}
+
+	// local queue of every configured and recorded broker connection
+	configured, err := loadQueues(cfg)
+	if err != nil {
+		return err
+	}
+	locals := map[string]*queue.Local{}
+	for name := range configured {
+		locals[name] = queue.NewLocal()
+	}
+	err = archive.ReadFile(opts.File, func(r archive.Record) error {
+		if _, ok := locals[r.Broker]; !ok {
+			locals[r.Broker] = queue.NewLocal()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't read recording: %w", err)
+	}
+	queues := map[string]queue.Queue{}
+	for name, l := range locals {
+		queues[name] = l
+	}
+
+	// buffered records are written once the service is stopped
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, err := loadService(ctx, cfg, queues)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Replaying %s at speed %v", opts.File, opts.Speed)
+	n, err := Replay(ctx, s, opts.File, opts.Speed, locals)
+	cancel()
+	store.Wait(s.Storer)
+
+	var dropped int64
+	for _, st := range s.Ingest() {
+		dropped += st.Dropped
+	}
+	log.Printf("[INFO] %d messages replayed, %d dropped by ingest queues", n, dropped)
+	return err
+}
+
+// Replay runs the service with the recorded messages published to the local queues of their broker
+// connections, the service is stopped once the messages are consumed. Returns the number of messages published
+func Replay(ctx context.Context, s *Service, path string, speed float64, queues map[string]*queue.Local) (int64, error) {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+
+	// subscriptions are made before the queues are connected
+	for !connected(queues) {
+		select {
+		case err := <-done:
+			if err == nil {
+				err = ctx.Err()
+			}
+			return 0, err
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	n, err := play(ctx, path, speed, queues)
+	// consumers take the messages left in the ingest queues before they stop
+	stop()
+	if rerr := <-done; err == nil {
+		err = rerr
+	}
+	return n, err
+}
+
+func connected(queues map[string]*queue.Local) bool {
+	for _, q := range queues {
+		if !q.Status().Connected {
+			return false
+		}
+	}
+	return true
+}
+
+// play publishes the recorded messages keeping the intervals between them divided by speed,
+// all at once if speed is zero
+func play(ctx context.Context, path string, speed float64, queues map[string]*queue.Local) (int64, error) {
+	var n int64
+	var first time.Time
+	start := time.Now()
+	err := archive.ReadFile(path, func(r archive.Record) error {
+		if first.IsZero() {
+			first = r.Time
+		}
+		if speed > 0 {
+			// waiting for the offset from the start doesn't accumulate the timer errors
+			at := start.Add(time.Duration(float64(r.Time.Sub(first)) / speed))
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Until(at)):
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q, ok := queues[r.Broker]
+		if !ok {
+			return fmt.Errorf("no queue of broker connection %q", r.Broker)
+		}
+		m := queue.Message{Topic: r.Topic, Payload: r.Payload, Retained: r.Retained, Time: r.Time}
+		if err := q.Publish(m); err != nil {
+			log.Printf("[WARN] failed to replay message on %s: %v", r.Topic, err)
+			return nil
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
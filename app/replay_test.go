@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/archive"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Record(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "traffic.jsonl.gz")
+	rec, err := archive.Create(path)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := queue.NewLocal()
+	done := make(chan error)
+	go func() { done <- Record(ctx, map[string]queue.Queue{"office": q}, "croco/#", rec) }()
+	require.Eventually(t, func() bool { return q.Status().Connected }, time.Second, time.Millisecond)
+
+	require.NoError(t, q.Publish(queue.Message{Topic: "croco/cave/temperature", Payload: "23.5"}))
+	require.NoError(t, q.Publish(queue.Message{Topic: "office/temp", Payload: "21"}))
+	require.NoError(t, q.Publish(queue.Message{Topic: "croco/cave/light", Payload: "on"}))
+	require.Eventually(t, func() bool { return rec.Count() == 2 }, time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	require.NoError(t, rec.Close())
+
+	var records []archive.Record
+	require.NoError(t, archive.ReadFile(path, func(r archive.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	require.Len(t, records, 2)
+	assert.Equal(t, "office", records[0].Broker)
+	assert.Equal(t, "croco/cave/temperature", records[0].Topic)
+	assert.Equal(t, "on", records[1].Payload)
+
+	_, err = archive.Create(path)
+	assert.Error(t, err)
+	assert.Error(t, Record(context.Background(), nil, "#", rec), "nothing to record")
+}
+
+func Test_Replay(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	rec, err := archive.Create(path)
+	require.NoError(t, err)
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i, m := range []queue.Message{
+		{Topic: "croco/cave/temperature", Payload: "23.5"},
+		{Topic: "ESP32/p/ds18b20/1", Payload: "-127"},
+		{Topic: "croco/cave/temperature", Payload: "23.7"},
+		{Topic: "ESP32/p/ds18b20/1", Payload: "21"},
+	} {
+		require.NoError(t, rec.Write(DefaultBroker, m, start.Add(time.Duration(i)*50*time.Millisecond)))
+	}
+	require.NoError(t, rec.Write("office", queue.Message{Topic: "office/temp", Payload: "22"}, start.Add(200*time.Millisecond)))
+	require.NoError(t, rec.Close())
+
+	router, err := route.New([]config.Route{
+		{Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}"},
+		{Filter: "{device}/p/ds18b20/{probe}", Module: "probes", Topic: "ds18b20/{probe}", Validate: config.Validate{Reject: []string{"-127"}}},
+		{Filter: "office/{sensor}", Module: "{broker}", Topic: "{sensor}", Brokers: []string{"office"}},
+	})
+	require.NoError(t, err)
+
+	for _, speed := range []float64{0, 2} {
+		db := store.NewMemoryStore()
+		locals := map[string]*queue.Local{DefaultBroker: queue.NewLocal(), "office": queue.NewLocal()}
+		s := NewService(map[string]queue.Queue{DefaultBroker: locals[DefaultBroker], "office": locals["office"]}, db, router, config.Ingest{})
+
+		began := time.Now()
+		n, err := Replay(context.Background(), s, path, speed, locals)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), n)
+		if speed > 0 {
+			assert.True(t, time.Since(began) >= 100*time.Millisecond, "recorded intervals are kept")
+		}
+
+		// every message is consumed by the time replay returns, records keep the recorded time
+		cave, err := db.Range(store.Query{Module: "cave"})
+		require.NoError(t, err)
+		require.Len(t, cave, 2)
+		assert.True(t, start.Equal(cave[0].DateTime))
+		assert.Equal(t, store.FloatValue(23.7), cave[1].Value)
+		probes, err := db.Range(store.Query{Module: "probes"})
+		require.NoError(t, err)
+		require.Len(t, probes, 1)
+		assert.True(t, start.Add(150*time.Millisecond).Equal(probes[0].DateTime))
+		office, err := db.Range(store.Query{Module: "office"})
+		require.NoError(t, err)
+		assert.Len(t, office, 1)
+
+		devices := s.Devices()
+		require.Len(t, devices, 1)
+		assert.Equal(t, int64(2), devices[0].Messages)
+	}
+
+	s := NewService(map[string]queue.Queue{}, store.NewMemoryStore(), router, config.Ingest{})
+	_, err = Replay(context.Background(), s, filepath.Join(t.TempDir(), "missing"), 0, nil)
+	assert.Error(t, err)
+}
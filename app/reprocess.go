@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/parMaster/logserver/app/archive"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+)
+
+type ReprocessOptions struct {
+	Since  string `long:"since" description:"reprocess messages received since the time, RFC3339 or 2006-01-02"`
+	Until  string `long:"until" description:"reprocess messages received before the time, RFC3339 or 2006-01-02"`
+	DryRun bool   `long:"dry-run" description:"count the records without writing"`
+}
+
+// ReprocessReport counts the archived messages routed and the records written
+type ReprocessReport struct {
+	Messages int64 // archived messages within the window
+	Routed   int64 // messages producing records
+	Records  int64 // records written
+	Errors   int64 // payloads failed to decode and records failed to write
+}
+
+func (r ReprocessReport) String() string {
+	return fmt.Sprintf("%d messages, %d routed, %d records, %d errors", r.Messages, r.Routed, r.Records, r.Errors)
+}
+
+// RunReprocess routes the archived messages of the time window with the current routes and writes
+// the records timestamped with the receive time. Records are stored with the receive time the messages
+// are archived with, so the ones written before are replaced by the stores keeping a record per topic and time
+func RunReprocess(ctx context.Context, cfg config.Config, opts ReprocessOptions) error {
+	if cfg.Archive.Dir == "" {
+		return errors.New("archive is not configured, see archive.dir")
+	}
+	since, err := parseTimeOption(opts.Since)
+	if err != nil {
+		return err
+	}
+	until, err := parseTimeOption(opts.Until)
+	if err != nil {
+		return err
+	}
+	router, err := route.New(cfg.Routes)
+	if err != nil {
+		return fmt.Errorf("can't configure routes: %w", err)
+	}
+
+	var db store.Storer
+	if !opts.DryRun {
+		// the spool is owned by the service, records failed to write are counted as errors
+		cfg.Storage.Spool = config.Spool{}
+		// buffered records are written once the store context is done
+		storeCtx, cancel := context.WithCancel(context.Background())
+		if err = store.Load(storeCtx, cfg, &db); err != nil {
+			cancel()
+			return fmt.Errorf("can't configure database: %w", err)
+		}
+		defer store.Wait(db)
+		defer cancel()
+	}
+
+	log.Printf("[INFO] Reprocessing %s since %v until %v, dry run: %v", cfg.Archive.Dir, since, until, opts.DryRun)
+	report, err := Reprocess(ctx, cfg.Archive.Dir, since, until, router, db)
+	log.Printf("[INFO] Reprocessed %s", report)
+	return err
+}
+
+// Reprocess routes the archived messages received within [since, until) and writes the records
+// to the storage, nothing is written if it is nil
+func Reprocess(ctx context.Context, dir string, since, until time.Time, router *route.Router, db store.Storer) (ReprocessReport, error) {
+	var report ReprocessReport
+	err := archive.Read(dir, since, until, func(r archive.Record) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		report.Messages++
+		routed := false
+		// the message is routed by every subscription it would be delivered to
+		for _, filter := range router.SubscriptionsOf(r.Broker) {
+			if !queue.Match(filter, r.Topic) {
+				continue
+			}
+			data, err := router.RouteFrom(r.Broker, filter, r.Topic, r.Payload, r.Time)
+			if err != nil {
+				log.Printf("[WARN] %v", err)
+				report.Errors++
+			}
+			for _, d := range data {
+				routed = true
+				if db == nil {
+					report.Records++
+					continue
+				}
+				if err := db.Write(d); err != nil {
+					log.Printf("[ERROR] failed to write %s/%s: %v", d.Module, d.Topic, err)
+					report.Errors++
+					continue
+				}
+				report.Records++
+			}
+		}
+		if routed {
+			report.Routed++
+		}
+		if report.Messages%100000 == 0 {
+			log.Printf("[INFO] %s, at %s", report, r.Time.Format(time.RFC3339))
+		}
+		return nil
+	})
+	return report, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/archive"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Reprocess(t *testing.T) {
+
+	dir := t.TempDir()
+	w, err := archive.NewWriter(config.Archive{Dir: dir})
+	require.NoError(t, err)
+	start := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i, m := range []queue.Message{
+		{Topic: "croco/cave/temperature", Payload: "23.5"},
+		{Topic: "ESP32/p/ds18b20/1", Payload: "21"},
+		{Topic: "croco/cave/temperature", Payload: "23.7"},
+		{Topic: "croco/cave/light", Payload: "{broken"},
+		{Topic: "croco/cave/temperature", Payload: "24"},
+	} {
+		require.NoError(t, w.Write(DefaultBroker, m, start.Add(time.Duration(i)*time.Minute)))
+	}
+	require.NoError(t, w.Close())
+
+	// the rule added after the messages were received
+	router, err := route.New([]config.Route{
+		{Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}", Rename: map[string]string{"temperature": "temp"}, Payload: config.Payload{Format: "json"}},
+		{Filter: "croco/cave/temperature", Module: "raw"},
+	})
+	require.NoError(t, err)
+
+	report, err := Reprocess(context.Background(), dir, time.Time{}, start.Add(4*time.Minute), router, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ReprocessReport{Messages: 4, Routed: 2, Records: 4, Errors: 1}, report, "dry run")
+
+	db := store.NewMemoryStore()
+	report, err = Reprocess(context.Background(), dir, start.Add(time.Minute), time.Time{}, router, db)
+	require.NoError(t, err)
+	assert.Equal(t, ReprocessReport{Messages: 4, Routed: 2, Records: 4, Errors: 1}, report)
+	data, err := db.Range(store.Query{Module: "cave", Topics: []string{"temp"}})
+	require.NoError(t, err)
+	require.Len(t, data, 2)
+	assert.True(t, start.Add(2*time.Minute).Equal(data[0].DateTime), "records keep the receive time")
+	assert.Equal(t, store.FloatValue(23.7), data[0].Value)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Reprocess(ctx, dir, time.Time{}, time.Time{}, router, db)
+	assert.Error(t, err)
+}
+
+func Test_Reprocess_Stored(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	router, err := route.New([]config.Route{{Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}"}})
+	require.NoError(t, err)
+	db, err := store.NewSQLite(ctx, t.TempDir()+"/reprocess.db")
+	require.NoError(t, err)
+	dir := t.TempDir()
+
+	// the service archives the messages and stores the records
+	q := queue.NewLocal()
+	s := NewService(map[string]queue.Queue{DefaultBroker: q}, db, router, config.Ingest{})
+	s.archived = "#"
+	s.archive, err = archive.NewWriter(config.Archive{Dir: dir})
+	require.NoError(t, err)
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, s.Run(runCtx))
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return q.Status().Connected }, time.Second, time.Millisecond)
+	// messages received a second apart, the queue stamps the receive time
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 20; i++ {
+		m := queue.Message{Topic: "croco/cave/temp", Payload: strconv.Itoa(i), Time: start.Add(time.Duration(i) * time.Second)}
+		require.NoError(t, q.Publish(m))
+	}
+	require.Eventually(t, func() bool {
+		data, _ := db.Range(store.Query{Module: "cave"})
+		return len(data) == 20
+	}, time.Second, time.Millisecond)
+	stop()
+	<-done
+	ingest := s.Ingest()
+	require.Len(t, ingest, 2)
+	assert.Equal(t, queue.IngestStats{Broker: DefaultBroker, Topic: "#", Policy: "drop-oldest", Capacity: 1000, Received: 20, Processed: 20, Archive: true}, ingest[1])
+
+	before, err := db.Range(store.Query{Module: "cave"})
+	require.NoError(t, err)
+
+	// reprocessing the stored window replaces the records
+	report, err := Reprocess(ctx, dir, time.Time{}, time.Time{}, router, db)
+	require.NoError(t, err)
+	assert.Equal(t, ReprocessReport{Messages: 20, Routed: 20, Records: 20}, report)
+	after, err := db.Range(store.Query{Module: "cave"})
+	require.NoError(t, err)
+	assert.Equal(t, before, after)
+}
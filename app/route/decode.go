@@ -0,0 +1,186 @@
+package route
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/parMaster/logserver/app/config"
+)
+
+// Field is a single value extracted from the payload
+type Field struct {
+	Path  string // json path, kv key or csv column, empty for scalar payloads
+	Value string
+}
+
+// Decoder extracts values from the message payload
+type Decoder interface {
+	Decode(payload string) ([]Field, error)
+}
+
+// DecoderFunc is an adapter to use ordinary functions as Decoders
+type DecoderFunc func(payload string) ([]Field, error)
+
+// Decode calls f(payload)
+func (f DecoderFunc) Decode(payload string) ([]Field, error) {
+	return f(payload)
+}
+
+// formats holds registered decoder constructors by payload format name
+var formats = map[string]func(config.Payload) (Decoder, error){
+	"":       newScalar,
+	"scalar": newScalar,
+	"json":   newJSON,
+	"kv":     newKV,
+	"csv":    newCSV,
+}
+
+// RegisterFormat makes the decoder available for routes by the format name
+func RegisterFormat(name string, f func(config.Payload) (Decoder, error)) {
+	formats[name] = f
+}
+
+// NewDecoder returns the decoder for the payload format
+func NewDecoder(p config.Payload) (Decoder, error) {
+	f, ok := formats[p.Format]
+	if !ok {
+		return nil, fmt.Errorf("payload format %q is not supported", p.Format)
+	}
+	return f(p)
+}
+
+// pick returns the fields with configured paths in the order of config,
+// or all the extracted fields sorted by path if no paths configured
+func pick(all map[string]string, p config.Payload) []Field {
+	var res []Field
+	if len(p.Fields) == 0 {
+		for path, v := range all {
+			res = append(res, Field{Path: path, Value: v})
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+		return res
+	}
+	for _, f := range p.Fields {
+		if v, ok := all[f.Path]; ok {
+			res = append(res, Field{Path: f.Path, Value: v})
+		}
+	}
+	return res
+}
+
+func newScalar(config.Payload) (Decoder, error) {
+	return DecoderFunc(func(payload string) ([]Field, error) {
+		return []Field{{Value: strings.TrimSpace(payload)}}, nil
+	}), nil
+}
+
+// newJSON decodes json objects, nested values are addressed with dotted paths, e.g. "ENERGY.Power" or "probes.0.temp".
+// Top-level scalar is the single value with empty path whatever fields are configured
+func newJSON(p config.Payload) (Decoder, error) {
+	return DecoderFunc(func(payload string) ([]Field, error) {
+		dec := json.NewDecoder(bytes.NewBufferString(payload))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+		all := map[string]string{}
+		flatten("", v, all)
+		if value, ok := all[""]; ok {
+			return []Field{{Value: value}}, nil
+		}
+		return pick(all, p), nil
+	}), nil
+}
+
+func flatten(prefix string, v interface{}, res map[string]string) {
+	join := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range v {
+			flatten(join(k), vv, res)
+		}
+	case []interface{}:
+		for i, vv := range v {
+			flatten(join(strconv.Itoa(i)), vv, res)
+		}
+	case json.Number:
+		res[prefix] = v.String()
+	case string:
+		res[prefix] = v
+	case bool:
+		res[prefix] = strconv.FormatBool(v)
+	}
+}
+
+// newKV decodes "k=v" pairs, separated by whitespace, commas or semicolons unless the separator is set
+func newKV(p config.Payload) (Decoder, error) {
+	split := func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == ';'
+	}
+	return DecoderFunc(func(payload string) ([]Field, error) {
+		var pairs []string
+		if p.Separator != "" {
+			pairs = strings.Split(payload, p.Separator)
+		} else {
+			pairs = strings.FieldsFunc(payload, split)
+		}
+		all := map[string]string{}
+		for _, pair := range pairs {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, fmt.Errorf("invalid pair %q", pair)
+			}
+			all[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		return pick(all, p), nil
+	}), nil
+}
+
+// newCSV decodes a single csv record, columns are addressed by configured names or indexes
+func newCSV(p config.Payload) (Decoder, error) {
+	comma := ','
+	if p.Separator != "" {
+		if len([]rune(p.Separator)) != 1 {
+			return nil, fmt.Errorf("csv separator must be a single character, got %q", p.Separator)
+		}
+		comma = []rune(p.Separator)[0]
+	}
+	return DecoderFunc(func(payload string) ([]Field, error) {
+		r := csv.NewReader(strings.NewReader(payload))
+		r.Comma = comma
+		r.TrimLeadingSpace = true
+		record, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv: %w", err)
+		}
+		all := map[string]string{}
+		for i, v := range record {
+			name := strconv.Itoa(i)
+			if i < len(p.Columns) && p.Columns[i] != "" {
+				name = p.Columns[i]
+				// the column is still addressable by index when named
+				if len(p.Fields) > 0 {
+					all[strconv.Itoa(i)] = strings.TrimSpace(v)
+				}
+			}
+			all[name] = strings.TrimSpace(v)
+		}
+		return pick(all, p), nil
+	}), nil
+}
@@ -0,0 +1,66 @@
+package route
+
+import (
+	"testing"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Decoders(t *testing.T) {
+
+	tbl := []struct {
+		payload config.Payload
+		in      string
+		out     []Field
+		err     bool
+	}{
+		{config.Payload{}, " 23.75\n", []Field{{Value: "23.75"}}, false},
+		{config.Payload{Format: "scalar"}, "on", []Field{{Value: "on"}}, false},
+
+		{config.Payload{Format: "json"}, `{"t":23.5,"h":40,"probes":[{"v":1},{"v":2}],"name":"x","n":null}`,
+			[]Field{{"h", "40"}, {"name", "x"}, {"probes.0.v", "1"}, {"probes.1.v", "2"}, {"t", "23.5"}}, false},
+		{config.Payload{Format: "json", Fields: []config.Field{{Path: "t"}, {Path: "missing"}, {Path: "probes.1.v"}}}, `{"t":23.5,"probes":[{"v":1},{"v":2}]}`,
+			[]Field{{"t", "23.5"}, {"probes.1.v", "2"}}, false},
+		{config.Payload{Format: "json"}, `{"t":`, nil, true},
+		{config.Payload{Format: "json"}, `23.5`, []Field{{Value: "23.5"}}, false},
+		{config.Payload{Format: "json", Fields: []config.Field{{Path: "t"}}}, `"on"`, []Field{{Value: "on"}}, false},
+
+		{config.Payload{Format: "kv"}, "temp=23.5 hum=40, bat=3.1;rssi=-60", []Field{{"bat", "3.1"}, {"hum", "40"}, {"rssi", "-60"}, {"temp", "23.5"}}, false},
+		{config.Payload{Format: "kv", Separator: "&"}, "a=1 2&b=3", []Field{{"a", "1 2"}, {"b", "3"}}, false},
+		{config.Payload{Format: "kv", Fields: []config.Field{{Path: "hum"}}}, "temp=23.5 hum=40", []Field{{"hum", "40"}}, false},
+		{config.Payload{Format: "kv"}, "temp=23.5 garbage", nil, true},
+
+		{config.Payload{Format: "csv"}, "23.5, 40", []Field{{"0", "23.5"}, {"1", "40"}}, false},
+		{config.Payload{Format: "csv", Columns: []string{"temp", "hum"}}, "23.5,40", []Field{{"hum", "40"}, {"temp", "23.5"}}, false},
+		{config.Payload{Format: "csv", Separator: ";", Columns: []string{"temp"}, Fields: []config.Field{{Path: "1"}, {Path: "temp"}}}, "23.5;40", []Field{{"1", "40"}, {"temp", "23.5"}}, false},
+	}
+
+	for i, tt := range tbl {
+		d, err := NewDecoder(tt.payload)
+		assert.NoError(t, err)
+		out, err := d.Decode(tt.in)
+		if tt.err {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		assert.NoError(t, err, "case %d", i)
+		assert.Equal(t, tt.out, out, "case %d", i)
+	}
+
+	_, err := NewDecoder(config.Payload{Format: "xml"})
+	assert.Error(t, err)
+	_, err = NewDecoder(config.Payload{Format: "csv", Separator: "::"})
+	assert.Error(t, err)
+
+	RegisterFormat("upper", func(config.Payload) (Decoder, error) {
+		return DecoderFunc(func(payload string) ([]Field, error) {
+			return []Field{{Path: "up", Value: payload + "!"}}, nil
+		}), nil
+	})
+	d, err := NewDecoder(config.Payload{Format: "upper"})
+	assert.NoError(t, err)
+	out, err := d.Decode("x")
+	assert.NoError(t, err)
+	assert.Equal(t, []Field{{"up", "x!"}}, out)
+}
@@ -0,0 +1,446 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/store"
+)
+
+// ErrRejected is returned for the values failing validation
+var ErrRejected = errors.New("rejected")
+
+// ErrUnrouted is returned by Check for the records no rule renders
+var ErrUnrouted = fmt.Errorf("%w: no route renders the module and topic", ErrRejected)
+
+// placeholder matches {name} in filters and templates
+var placeholder = regexp.MustCompile(`\{([a-zA-Z0-9_]+)\}`)
+
+// Rule is a compiled routing rule, see config.Route
+type Rule struct {
+	filter []string // filter levels, captures are replaced with "+"
+	names  []string // capture name for every filter level, empty for literal levels
+	module string
+	topic  string
+	rename map[string]string
+	qos    byte
+	broker map[string]bool // connections the rule applies to, all if empty
+
+	decoder  Decoder
+	fields   map[string]string           // topic templates by payload field path
+	validate *config.Validate            // route checks, nil if not configured
+	checks   map[string]*config.Validate // checks by payload field path
+
+	modulePattern *regexp.Regexp // module and topics rendered by the rule, see Validation
+	topicPattern  *regexp.Regexp
+	fieldPatterns []fieldPattern
+}
+
+type fieldPattern struct {
+	path    string
+	pattern *regexp.Regexp
+}
+
+// routed is the Data with checks to be applied before writing
+type routed struct {
+	store.Data
+	check *config.Validate
+}
+
+// Compile validates the route and prepares it for matching
+func Compile(r config.Route) (*Rule, error) {
+	if r.Filter == "" {
+		return nil, fmt.Errorf("route filter is empty")
+	}
+	if r.Module == "" {
+		return nil, fmt.Errorf("route %q: module is empty", r.Filter)
+	}
+	if r.QoS > 2 {
+		return nil, fmt.Errorf("route %q: invalid qos %d", r.Filter, r.QoS)
+	}
+
+	decoder, err := NewDecoder(r.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("route %q: %w", r.Filter, err)
+	}
+
+	rule := &Rule{module: r.Module, topic: r.Topic, rename: r.Rename, decoder: decoder, qos: r.QoS,
+		fields: map[string]string{}, checks: map[string]*config.Validate{}, broker: map[string]bool{}}
+	for _, b := range r.Brokers {
+		rule.broker[b] = true
+	}
+	if !isZero(r.Validate) {
+		v := r.Validate
+		rule.validate = &v
+	}
+	known := map[string]bool{}
+	levels := strings.Split(r.Filter, "/")
+	for i, l := range levels {
+		name := ""
+		switch {
+		case l == "#":
+			if i != len(levels)-1 {
+				return nil, fmt.Errorf("route %q: # is only allowed as the last level", r.Filter)
+			}
+			name = "#"
+		case placeholder.MatchString(l):
+			m := placeholder.FindStringSubmatch(l)
+			if m[0] != l {
+				return nil, fmt.Errorf("route %q: capture must take the whole level, got %q", r.Filter, l)
+			}
+			name, l = m[1], "+"
+		case strings.ContainsAny(l, "+#"):
+			if l != "+" {
+				return nil, fmt.Errorf("route %q: wildcard must take the whole level, got %q", r.Filter, l)
+			}
+		}
+		if name == "topic" || name == "field" || name == "broker" {
+			return nil, fmt.Errorf("route %q: capture name %q is reserved", r.Filter, name)
+		}
+		if name != "" {
+			if known[name] {
+				return nil, fmt.Errorf("route %q: duplicate capture %q", r.Filter, name)
+			}
+			known[name] = true
+		}
+		rule.filter = append(rule.filter, l)
+		rule.names = append(rule.names, name)
+	}
+
+	// the default topic is the whole mqtt topic for scalar payloads
+	// and the field path for structured ones
+	structured := r.Payload.Format != "" && r.Payload.Format != "scalar"
+	if rule.topic == "" {
+		rule.topic = "{topic}"
+		if structured {
+			rule.topic = "{field}"
+		}
+	}
+	known["topic"] = true
+	known["field"] = structured
+	known["broker"] = true
+
+	templates := []string{rule.module, rule.topic}
+	for _, f := range r.Payload.Fields {
+		if f.Path == "" {
+			return nil, fmt.Errorf("route %q: payload field path is empty", r.Filter)
+		}
+		if f.Topic != "" {
+			rule.fields[f.Path] = f.Topic
+			templates = append(templates, f.Topic)
+		}
+		if f.Validate != nil {
+			rule.checks[f.Path] = f.Validate
+		}
+	}
+
+	for _, tpl := range templates {
+		for _, m := range placeholder.FindAllStringSubmatch(tpl, -1) {
+			if !known[m[1]] {
+				return nil, fmt.Errorf("route %q: unknown capture %q in template %q", r.Filter, m[1], tpl)
+			}
+		}
+	}
+
+	rule.modulePattern, rule.topicPattern = pattern(rule.module), pattern(rule.topic)
+	for _, f := range r.Payload.Fields {
+		switch {
+		case f.Topic != "":
+			rule.fieldPatterns = append(rule.fieldPatterns, fieldPattern{path: f.Path, pattern: pattern(f.Topic)})
+		case strings.Contains(rule.topic, "{field}"):
+			tpl := strings.ReplaceAll(rule.topic, "{field}", f.Path)
+			rule.fieldPatterns = append(rule.fieldPatterns, fieldPattern{path: f.Path, pattern: pattern(tpl)})
+		}
+	}
+	return rule, nil
+}
+
+// pattern matches the values rendered from the template. Captures of a filter level don't contain "/",
+// the whole topic and the field path may
+func pattern(tpl string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(tpl, -1) {
+		b.WriteString(regexp.QuoteMeta(tpl[last:loc[0]]))
+		switch tpl[loc[2]:loc[3]] {
+		case "topic", "field", "broker":
+			b.WriteString(".*")
+		default:
+			b.WriteString("[^/]*")
+		}
+		last = loc[1]
+	}
+	b.WriteString(regexp.QuoteMeta(tpl[last:]))
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+// Validation returns the checks of the record with the module and topic if the rule can render it,
+// nil checks if the rule doesn't validate it
+func (r *Rule) Validation(module, topic string) (*config.Validate, bool) {
+	if !r.modulePattern.MatchString(module) {
+		return nil, false
+	}
+	for _, f := range r.fieldPatterns {
+		if f.pattern.MatchString(topic) {
+			if c, ok := r.checks[f.path]; ok {
+				return c, true
+			}
+			return r.validate, true
+		}
+	}
+	for from, to := range r.rename {
+		if to == topic && r.topicPattern.MatchString(from) {
+			return r.validate, true
+		}
+	}
+	if r.topicPattern.MatchString(topic) {
+		return r.validate, true
+	}
+	return nil, false
+}
+
+// Accepts checks if the rule applies to the messages of the broker connection, any broker is accepted if it is empty
+func (r *Rule) Accepts(broker string) bool {
+	return broker == "" || len(r.broker) == 0 || r.broker[broker]
+}
+
+// Subscription returns the mqtt topic filter to subscribe to
+func (r *Rule) Subscription() string {
+	return strings.Join(r.filter, "/")
+}
+
+// Match checks the topic against the rule filter and returns named captures.
+// The "topic" capture always holds the whole topic, "#" holds the multi-level remainder
+func (r *Rule) Match(topic string) (map[string]string, bool) {
+	levels := strings.Split(topic, "/")
+	captures := map[string]string{"topic": topic}
+
+	for i, f := range r.filter {
+		if f == "#" {
+			captures["#"] = strings.Join(levels[i:], "/")
+			return captures, true
+		}
+		if i >= len(levels) {
+			return nil, false
+		}
+		if f != "+" && f != levels[i] {
+			return nil, false
+		}
+		if r.names[i] != "" {
+			captures[r.names[i]] = levels[i]
+		}
+	}
+
+	if len(levels) != len(r.filter) {
+		return nil, false
+	}
+	return captures, true
+}
+
+func isZero(v config.Validate) bool {
+	return !v.Numeric && v.Min == nil && v.Max == nil && len(v.Reject) == 0 && v.MaxRate == 0
+}
+
+// Apply matches the topic, decodes the payload and renders the Data to be stored,
+// one record for every value extracted from the payload. Values are not validated
+func (r *Rule) Apply(topic, payload string, received time.Time) ([]store.Data, error) {
+	rd, err := r.apply("", topic, payload, received)
+	var res []store.Data
+	for _, d := range rd {
+		res = append(res, d.Data)
+	}
+	return res, err
+}
+
+func (r *Rule) apply(broker, topic, payload string, received time.Time) ([]routed, error) {
+	captures, ok := r.Match(topic)
+	if !ok {
+		return nil, nil
+	}
+	captures["broker"] = broker
+
+	fields, err := r.decoder.Decode(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s payload %q: %w", topic, payload, err)
+	}
+
+	var res []routed
+	module := render(r.module, captures)
+	for _, f := range fields {
+		captures["field"] = f.Path
+		tpl := r.topic
+		if ft, ok := r.fields[f.Path]; ok {
+			tpl = ft
+		}
+		d := store.Data{
+			Module:   module,
+			DateTime: received,
+			Topic:    render(tpl, captures),
+			Value:    store.ParseValue(f.Value),
+		}
+		if f.Path == "" && strings.Contains(tpl, "{field}") {
+			// scalar of the structured payload is the value of the route topic without the field,
+			// of the whole mqtt topic if nothing is left
+			d.Topic = strings.Trim(strings.ReplaceAll(d.Topic, "//", "/"), "/")
+			if d.Topic == "" {
+				d.Topic = topic
+			}
+		}
+		if renamed, ok := r.rename[d.Topic]; ok {
+			d.Topic = renamed
+		}
+		check := r.validate
+		if c, ok := r.checks[f.Path]; ok {
+			check = c
+		}
+		if d.Module != "" && d.Topic != "" {
+			res = append(res, routed{Data: d, check: check})
+		}
+	}
+	return res, nil
+}
+
+func render(tpl string, captures map[string]string) string {
+	return placeholder.ReplaceAllStringFunc(tpl, func(p string) string {
+		return captures[p[1:len(p)-1]]
+	})
+}
+
+// Router holds compiled rules grouped by subscription filter
+type Router struct {
+	rules     []*Rule
+	groups    map[string][]*Rule
+	validator *Validator
+}
+
+// New compiles the routes from config
+func New(routes []config.Route) (*Router, error) {
+	r := &Router{groups: map[string][]*Rule{}, validator: NewValidator()}
+	for _, cr := range routes {
+		rule, err := Compile(cr)
+		if err != nil {
+			return nil, err
+		}
+		r.rules = append(r.rules, rule)
+		r.groups[rule.Subscription()] = append(r.groups[rule.Subscription()], rule)
+	}
+	return r, nil
+}
+
+// Subscriptions returns distinct mqtt filters in the order of rules
+func (r *Router) Subscriptions() []string {
+	return r.SubscriptionsOf("")
+}
+
+// SubscriptionsOf returns distinct mqtt filters of the rules applied to the broker connection
+func (r *Router) SubscriptionsOf(broker string) []string {
+	var res []string
+	seen := map[string]bool{}
+	for _, rule := range r.rules {
+		if !rule.Accepts(broker) {
+			continue
+		}
+		if s := rule.Subscription(); !seen[s] {
+			seen[s] = true
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// QoS returns the max QoS of the rules subscribed with the given filter
+func (r *Router) QoS(filter string) (qos byte) {
+	for _, rule := range r.groups[filter] {
+		if rule.qos > qos {
+			qos = rule.qos
+		}
+	}
+	return qos
+}
+
+// Route applies the rules subscribed with the given filter to the message.
+// Rules are grouped by filter, so the message delivered to several subscriptions is routed once per rule.
+// Values failing validation are logged and dropped.
+// The rule failing to decode the payload doesn't prevent other rules from being applied, the first error is returned.
+// Records are timestamped with the message receive time
+func (r *Router) Route(filter, topic, payload string, received time.Time) (res []store.Data, err error) {
+	return r.RouteFrom("", filter, topic, payload, received)
+}
+
+// RouteFrom routes the message received from the broker connection, see Route.
+// Only the rules accepting the broker are applied, {broker} capture holds its name
+func (r *Router) RouteFrom(broker, filter, topic, payload string, received time.Time) (res []store.Data, err error) {
+	for _, rule := range r.groups[filter] {
+		if !rule.Accepts(broker) {
+			continue
+		}
+		data, rerr := rule.apply(broker, topic, payload, received)
+		if rerr != nil && err == nil {
+			err = rerr
+		}
+		for _, d := range data {
+			if verr := r.validator.Check(d.check, d.Data); verr != nil {
+				log.Printf("[WARN] rejected %s/%s value %q from %s: %v", d.Module, d.Topic, d.Value.String(), topic, verr)
+				continue
+			}
+			res = append(res, d.Data)
+		}
+	}
+	return res, err
+}
+
+// Matches checks if any rule applied to the broker connection matches the topic
+func (r *Router) Matches(broker, topic string) bool {
+	for _, rule := range r.rules {
+		if _, ok := rule.Match(topic); ok && rule.Accepts(broker) {
+			return true
+		}
+	}
+	return false
+}
+
+// Device returns the {device} capture of the first rule of the filter matching the topic,
+// empty if the rules don't capture devices
+func (r *Router) Device(broker, filter, topic string) string {
+	for _, rule := range r.groups[filter] {
+		if !rule.Accepts(broker) {
+			continue
+		}
+		if captures, ok := rule.Match(topic); ok && captures["device"] != "" {
+			return captures["device"]
+		}
+	}
+	return ""
+}
+
+// Check validates the record written bypassing mqtt, e.g. over http, with the checks of the first rule
+// rendering its module and topic, rejections are counted as the routed ones. ErrUnrouted is returned
+// if no rule renders it, the rollup modules are always rejected
+func (r *Router) Check(d store.Data) error {
+	if store.IsRollup(d.Module) {
+		return fmt.Errorf("%w: module %s is reserved for rollups", ErrRejected, d.Module)
+	}
+	for _, rule := range r.rules {
+		c, ok := rule.Validation(d.Module, d.Topic)
+		if !ok {
+			continue
+		}
+		if err := r.validator.Check(c, d); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+		return nil
+	}
+	return ErrUnrouted
+}
+
+// Rejected returns statistics of values rejected by validation, by module/topic
+func (r *Router) Rejected() map[string]Rejected {
+	return r.validator.Rejected()
+}
@@ -0,0 +1,181 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Compile(t *testing.T) {
+
+	bad := []config.Route{
+		{Filter: "", Module: "m"},
+		{Filter: "a/b", Module: ""},
+		{Filter: "a/#/b", Module: "m"},
+		{Filter: "a/b+", Module: "m"},
+		{Filter: "a/x{dev}", Module: "m"},
+		{Filter: "{dev}/{dev}", Module: "m"},
+		{Filter: "{topic}/a", Module: "m"},
+		{Filter: "{dev}/a", Module: "m", Topic: "{probe}"},
+	}
+	for _, r := range bad {
+		_, err := Compile(r)
+		assert.Error(t, err, r.Filter)
+	}
+
+	rule, err := Compile(config.Route{Filter: "{device}/p/ds18b20/{probe}", Module: "probes", Topic: "ds18b20/{probe}"})
+	assert.NoError(t, err)
+	assert.Equal(t, "+/p/ds18b20/+", rule.Subscription())
+
+	rule, err = Compile(config.Route{Filter: "croco/#", Module: "cave"})
+	assert.NoError(t, err)
+	assert.Equal(t, "croco/#", rule.Subscription())
+}
+
+func Test_Rule_Match(t *testing.T) {
+
+	rule, err := Compile(config.Route{Filter: "{device}/p/+/{probe}", Module: "m"})
+	assert.NoError(t, err)
+
+	c, ok := rule.Match("ESP32-A473F53A7D80/p/ds18b20/1")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"topic": "ESP32-A473F53A7D80/p/ds18b20/1", "device": "ESP32-A473F53A7D80", "probe": "1"}, c)
+
+	for _, topic := range []string{"ESP32/p/ds18b20", "ESP32/p/ds18b20/1/2", "ESP32/x/ds18b20/1"} {
+		_, ok = rule.Match(topic)
+		assert.False(t, ok, topic)
+	}
+
+	rule, err = Compile(config.Route{Filter: "croco/{place}/#", Module: "m"})
+	assert.NoError(t, err)
+	c, ok = rule.Match("croco/cave/sensors/temp")
+	assert.True(t, ok)
+	assert.Equal(t, "sensors/temp", c["#"])
+	assert.Equal(t, "cave", c["place"])
+
+	c, ok = rule.Match("croco/cave")
+	assert.True(t, ok)
+	assert.Equal(t, "", c["#"])
+}
+
+func Test_Router(t *testing.T) {
+
+	now := time.Now()
+	r, err := New([]config.Route{
+		{Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}", Rename: map[string]string{"temperature": "temp"}},
+		{Filter: "{device}/p/ds18b20/{probe}", Module: "probes", Topic: "ds18b20/{probe}"},
+		{Filter: "{device}/p/ds18b20/{probe}", Module: "{device}", QoS: 1},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"croco/cave/+", "+/p/ds18b20/+"}, r.Subscriptions())
+	assert.Equal(t, byte(0), r.QoS("croco/cave/+"))
+	assert.Equal(t, byte(1), r.QoS("+/p/ds18b20/+"))
+
+	_, err = New([]config.Route{{Filter: "croco/#", Module: "cave", QoS: 3}})
+	assert.Error(t, err)
+
+	data, err := r.Route("croco/cave/+", "croco/cave/temperature", "23.5", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "cave", DateTime: now, Topic: "temp", Value: store.ParseValue("23.5")}}, data)
+	data, err = r.Route("croco/cave/+", "croco/cave/light", "1", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "cave", DateTime: now, Topic: "light", Value: store.ParseValue("1")}}, data)
+
+	data, err = r.Route("+/p/ds18b20/+", "ESP32/p/ds18b20/2", "24.00", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{
+		{Module: "probes", DateTime: now, Topic: "ds18b20/2", Value: store.ParseValue("24.00")},
+		{Module: "ESP32", DateTime: now, Topic: "ESP32/p/ds18b20/2", Value: store.ParseValue("24.00")},
+	}, data)
+
+	assert.Equal(t, "ESP32", r.Device("", "+/p/ds18b20/+", "ESP32/p/ds18b20/2"))
+	assert.Empty(t, r.Device("", "croco/cave/+", "croco/cave/temperature"), "no device capture")
+	assert.True(t, r.Matches("", "ESP32/p/ds18b20/2"))
+	assert.False(t, r.Matches("", "croco/kitchen/temperature"))
+
+	// the rule is applied only to messages of its own subscription
+	data, err = r.Route("croco/cave/+", "ESP32/p/ds18b20/2", "24.00", now)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	data, err = r.Route("#", "croco/cave/temperature", "23.5", now)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func Test_Router_Brokers(t *testing.T) {
+
+	now := time.Now()
+	r, err := New([]config.Route{
+		{Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}"},
+		{Filter: "office/{name}", Module: "{broker}", Topic: "{name}", Brokers: []string{"office", "lab"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"croco/cave/+", "office/+"}, r.Subscriptions())
+	assert.Equal(t, []string{"croco/cave/+"}, r.SubscriptionsOf("default"))
+	assert.Equal(t, []string{"croco/cave/+", "office/+"}, r.SubscriptionsOf("lab"))
+
+	data, err := r.RouteFrom("lab", "office/+", "office/temp", "21", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "lab", DateTime: now, Topic: "temp", Value: store.ParseValue("21")}}, data)
+	data, err = r.RouteFrom("default", "office/+", "office/temp", "21", now)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	data, err = r.RouteFrom("default", "croco/cave/+", "croco/cave/temp", "21", now)
+	assert.NoError(t, err)
+	assert.Len(t, data, 1)
+
+	_, err = New([]config.Route{{Filter: "{broker}/temp", Module: "cave"}})
+	assert.Error(t, err, "broker is reserved")
+}
+
+func Test_Router_Payload(t *testing.T) {
+
+	now := time.Now()
+	r, err := New([]config.Route{
+		{
+			Filter: "tele/{sensor}/SENSOR", Module: "tasmota", Topic: "{sensor}/{field}",
+			Payload: config.Payload{Format: "json", Fields: []config.Field{
+				{Path: "ENERGY.Power"},
+				{Path: "ENERGY.Voltage", Topic: "{sensor}/volts"},
+			}},
+		},
+		{
+			Filter: "zigbee2mqtt/{device}", Module: "zigbee",
+			Payload: config.Payload{Format: "json"},
+		},
+	})
+	assert.NoError(t, err)
+
+	data, err := r.Route("tele/+/SENSOR", "tele/plug/SENSOR", `{"Time":"2023-01-01T00:00:00","ENERGY":{"Power":12,"Voltage":229.5,"Current":0.1}}`, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{
+		{Module: "tasmota", DateTime: now, Topic: "plug/ENERGY.Power", Value: store.ParseValue("12")},
+		{Module: "tasmota", DateTime: now, Topic: "plug/volts", Value: store.ParseValue("229.5")},
+	}, data)
+
+	data, err = r.Route("zigbee2mqtt/+", "zigbee2mqtt/door", `{"contact":true,"battery":91}`, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{
+		{Module: "zigbee", DateTime: now, Topic: "battery", Value: store.ParseValue("91")},
+		{Module: "zigbee", DateTime: now, Topic: "contact", Value: store.ParseValue("true")},
+	}, data)
+
+	// top-level scalar is the value of the route topic
+	data, err = r.Route("tele/+/SENSOR", "tele/plug/SENSOR", `12`, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "tasmota", DateTime: now, Topic: "plug", Value: store.ParseValue("12")}}, data)
+	data, err = r.Route("zigbee2mqtt/+", "zigbee2mqtt/door", `true`, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "zigbee", DateTime: now, Topic: "zigbee2mqtt/door", Value: store.ParseValue("true")}}, data)
+
+	data, err = r.Route("zigbee2mqtt/+", "zigbee2mqtt/door", `not a json`, now)
+	assert.Error(t, err)
+	assert.Empty(t, data)
+
+	// {field} is not available for scalar payloads
+	_, err = New([]config.Route{{Filter: "a/b", Module: "m", Topic: "{field}"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package route
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/store"
+)
+
+// Validator checks values against the route rules. It keeps the last accepted value
+// of every module/topic for rate checks and counts rejected values
+type Validator struct {
+	mu       sync.Mutex
+	last     map[string]sample
+	rejected map[string]Rejected
+	now      func() time.Time
+}
+
+type sample struct {
+	value float64
+	time  time.Time
+}
+
+// Rejected holds rejection statistics of a module/topic
+type Rejected struct {
+	Count  int64     `json:"count"`
+	Reason string    `json:"reason"` // last rejection reason
+	Value  string    `json:"value"`  // last rejected value
+	Time   time.Time `json:"time"`   // last rejection time
+}
+
+func NewValidator() *Validator {
+	return &Validator{
+		last:     map[string]sample{},
+		rejected: map[string]Rejected{},
+		now:      time.Now,
+	}
+}
+
+// Check returns an error if the value fails the checks, rejection is counted.
+// Nil checks accept any value
+func (v *Validator) Check(c *config.Validate, d store.Data) error {
+	if c == nil {
+		return nil
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := d.Module + "/" + d.Topic
+	now := d.DateTime
+	if now.IsZero() {
+		now = v.now()
+	}
+	err := v.check(c, key, d.Value, now)
+	if err != nil {
+		r := v.rejected[key]
+		r.Count++
+		r.Reason, r.Value, r.Time = err.Error(), d.Value.String(), now
+		v.rejected[key] = r
+	}
+	return err
+}
+
+func (v *Validator) check(c *config.Validate, key string, value store.Value, now time.Time) error {
+	num, _ := value.Float()
+	numeric := value.Kind() == store.KindFloat
+
+	for _, r := range c.Reject {
+		rv := store.ParseValue(r)
+		if rv.Kind() == value.Kind() && rv.String() == value.String() {
+			return fmt.Errorf("sentinel value %s", r)
+		}
+	}
+
+	if !numeric {
+		if c.Numeric {
+			return fmt.Errorf("not a number")
+		}
+		return nil
+	}
+
+	if c.Min != nil && num < *c.Min {
+		return fmt.Errorf("below min %g", *c.Min)
+	}
+	if c.Max != nil && num > *c.Max {
+		return fmt.Errorf("above max %g", *c.Max)
+	}
+
+	if c.MaxRate > 0 {
+		if last, ok := v.last[key]; ok {
+			// readings more often than once a second are rated as a second apart
+			dt := now.Sub(last.time).Seconds()
+			if dt < 1 {
+				dt = 1
+			}
+			if rate := math.Abs(num-last.value) / dt; rate > c.MaxRate {
+				return fmt.Errorf("rate of change %g/s exceeds %g/s", rate, c.MaxRate)
+			}
+		}
+		v.last[key] = sample{value: num, time: now}
+	}
+
+	return nil
+}
+
+// Rejected returns rejection statistics by module/topic
+func (v *Validator) Rejected() map[string]Rejected {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	res := make(map[string]Rejected, len(v.rejected))
+	for k, r := range v.rejected {
+		res[k] = r
+	}
+	return res
+}
@@ -0,0 +1,146 @@
+package route
+
+import (
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Validator(t *testing.T) {
+
+	min, max := 0.0, 100.0
+	c := &config.Validate{Numeric: true, Min: &min, Max: &max, Reject: []string{"-127", "85"}, MaxRate: 1}
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := NewValidator()
+	v.now = func() time.Time { return now }
+
+	d := func(val string) store.Data {
+		return store.Data{Module: "probes", Topic: "ds18b20/1", Value: store.ParseValue(val)}
+	}
+
+	assert.NoError(t, v.Check(nil, d("garbage")))
+	assert.NoError(t, v.Check(&config.Validate{}, d("garbage")))
+	assert.NoError(t, v.Check(&config.Validate{Min: &min}, d("nan")), "bounds are checked for numbers only")
+
+	assert.NoError(t, v.Check(c, d("23.75")))
+	assert.Error(t, v.Check(c, d("nan")))
+	assert.Error(t, v.Check(c, d("")))
+	assert.Error(t, v.Check(c, d("-127")))
+	assert.Error(t, v.Check(c, d("85.00")))
+	assert.Error(t, v.Check(c, d("-0.5")))
+	assert.Error(t, v.Check(c, d("100.5")))
+
+	// spike is rejected, slow change is accepted
+	now = now.Add(time.Second)
+	assert.Error(t, v.Check(c, d("30")))
+	assert.NoError(t, v.Check(c, d("24.5")))
+	now = now.Add(10 * time.Second)
+	assert.NoError(t, v.Check(c, d("30")))
+
+	rejected := v.Rejected()
+	assert.Equal(t, int64(7), rejected["probes/ds18b20/1"].Count)
+	assert.Equal(t, "30", rejected["probes/ds18b20/1"].Value)
+	assert.Contains(t, rejected["probes/ds18b20/1"].Reason, "rate of change")
+}
+
+func Test_Router_Validate(t *testing.T) {
+
+	now := time.Now()
+	min := 0.0
+	r, err := New([]config.Route{
+		{
+			Filter: "{device}/p/ds18b20/{probe}", Module: "probes", Topic: "ds18b20/{probe}",
+			Validate: config.Validate{Numeric: true, Min: &min, Reject: []string{"-127"}},
+		},
+		{
+			Filter: "sensor/{name}", Module: "sensor",
+			Payload: config.Payload{Format: "json", Fields: []config.Field{
+				{Path: "temp"},
+				{Path: "state", Validate: &config.Validate{Reject: []string{"unknown"}}},
+			}},
+			Validate: config.Validate{Numeric: true},
+		},
+	})
+	assert.NoError(t, err)
+
+	data, err := r.Route("+/p/ds18b20/+", "ESP32/p/ds18b20/1", "-127", now)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	data, err = r.Route("+/p/ds18b20/+", "ESP32/p/ds18b20/1", "23.5", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "probes", DateTime: now, Topic: "ds18b20/1", Value: store.ParseValue("23.5")}}, data)
+
+	data, err = r.Route("sensor/+", "sensor/x", `{"temp":"nan","state":"on"}`, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "sensor", DateTime: now, Topic: "state", Value: store.ParseValue("on")}}, data)
+
+	data, err = r.Route("sensor/+", "sensor/x", `{"temp":21,"state":"unknown"}`, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []store.Data{{Module: "sensor", DateTime: now, Topic: "temp", Value: store.ParseValue("21")}}, data)
+
+	assert.Equal(t, int64(1), r.Rejected()["probes/ds18b20/1"].Count)
+	assert.Equal(t, int64(1), r.Rejected()["sensor/temp"].Count)
+	assert.Equal(t, int64(1), r.Rejected()["sensor/state"].Count)
+}
+
+func Test_Router_Check(t *testing.T) {
+
+	now := time.Now()
+	min := 0.0
+	r, err := New([]config.Route{
+		{
+			Filter: "{device}/p/ds18b20/{probe}", Module: "probes", Topic: "ds18b20/{probe}",
+			Validate: config.Validate{Numeric: true, Min: &min, Reject: []string{"-127"}},
+		},
+		{
+			Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}", Rename: map[string]string{"temperature": "temp"},
+			Validate: config.Validate{Max: &min},
+		},
+		{
+			Filter: "sensor/{name}", Module: "sensor",
+			Payload: config.Payload{Format: "json", Fields: []config.Field{
+				{Path: "state", Validate: &config.Validate{Reject: []string{"unknown"}}},
+				{Path: "ENERGY.Power", Topic: "{name}/power", Validate: &config.Validate{Numeric: true}},
+			}},
+			Validate: config.Validate{Numeric: true},
+		},
+	})
+	assert.NoError(t, err)
+
+	d := func(module, topic, value string) store.Data {
+		return store.Data{Module: module, Topic: topic, Value: store.ParseValue(value), DateTime: now}
+	}
+	for _, tt := range []struct {
+		data     store.Data
+		rejected bool
+		unrouted bool
+	}{
+		{d("probes", "ds18b20/1", "23.5"), false, false},
+		{d("probes", "ds18b20/1", "-127"), true, false},
+		{d("probes", "ds18b20/1/x", "23.5"), true, true}, // a capture takes a single level
+		{d("cave", "temp", "1"), true, false},            // renamed topic
+		{d("cave", "light", "1"), true, false},
+		{d("cave@5m", "temp", "-1"), true, false}, // rollups are not written directly
+		{d("sensor", "state", "unknown"), true, false},
+		{d("sensor", "state", "on"), false, false},
+		{d("sensor", "plug/power", "high"), true, false},
+		{d("sensor", "voltage", "high"), true, false},
+		{d("nas", "disk", "-127"), true, true}, // no rule renders it
+	} {
+		err := r.Check(tt.data)
+		if tt.unrouted {
+			assert.ErrorIs(t, err, ErrUnrouted, "%+v", tt.data)
+		}
+		if tt.rejected {
+			assert.ErrorIs(t, err, ErrRejected, "%+v", tt.data)
+		} else {
+			assert.NoError(t, err, "%+v", tt.data)
+		}
+	}
+	assert.Equal(t, int64(1), r.Rejected()["probes/ds18b20/1"].Count)
+}
@@ -2,114 +2,475 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
-	"strconv"
-	"strings"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
+	"github.com/parMaster/logserver/app/archive"
+	"github.com/parMaster/logserver/app/broker"
 	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/device"
+	"github.com/parMaster/logserver/app/discovery"
+	"github.com/parMaster/logserver/app/publish"
 	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
 	"github.com/parMaster/logserver/app/store"
 )
 
+// DefaultBroker is the name of the connection of mqtt config section
+const DefaultBroker = "default"
+
 type Service struct {
 	store.Storer
-	q *queue.Client
+	queues map[string]queue.Queue // by broker connection name
+	router *route.Router
+	ingest config.Ingest
+
+	publisher *publish.Publisher // nil if publishing is not configured
+	devices   *device.Registry
+	roots     map[string]string  // discovery root topics by broker connection name
+	catalog   *discovery.Catalog // nil if discovery is not configured
+	archive   *archive.Writer    // nil if archive is not configured
+	archived  string             // filter of the archived messages
+	unrouted  bool               // submitted records no route renders are accepted
+
+	mu       sync.Mutex
+	ingests  []*queue.Ingest
+	archives []*queue.Ingest // archive subscription ingest queues
 }
 
-// RunService consumes messages from mqtt queue and writes them to database
-// It is intended to be run as a service/daemon
-func RunService(ctx context.Context, config config.Config) {
+func NewService(queues map[string]queue.Queue, s store.Storer, router *route.Router, ingest config.Ingest) *Service {
+	devices, _ := device.New(config.Devices{}) // can't fail without status topics and state file
+	return &Service{Storer: s, queues: queues, router: router, ingest: ingest, devices: devices}
+}
 
-	s := &Service{}
+// LoadService configures the storage, routes and message queues of the service
+func LoadService(ctx context.Context, config config.Config) (*Service, error) {
+	queues, err := loadQueues(config)
+	if err != nil {
+		return nil, err
+	}
+	return loadService(ctx, config, queues)
+}
+
+// loadService configures the service consuming the queues of the broker connections by name
+func loadService(ctx context.Context, config config.Config, queues map[string]queue.Queue) (*Service, error) {
 
 	// Initialize database
-	var err error
-	err = store.Load(ctx, config, &s.Storer)
+	var db store.Storer
+	if err := store.Load(ctx, config, &db); err != nil {
+		return nil, fmt.Errorf("can't configure database: %w", err)
+	}
+
+	// Roll up and prune expired records
+	if r, ok := db.(*store.Retention); ok {
+		go r.Run(ctx, 5*time.Minute)
+	}
+
+	// Compile routing rules
+	router, err := route.New(config.Routes)
 	if err != nil {
-		log.Fatalf("Can't configure database %e", err)
+		return nil, fmt.Errorf("can't configure routes: %w", err)
+	}
+
+	for _, r := range config.Routes {
+		for _, b := range r.Brokers {
+			if _, ok := queues[b]; !ok {
+				return nil, fmt.Errorf("route %q: unknown broker connection %q", r.Filter, b)
+			}
+		}
 	}
 
-	// Describe subscriptions
-	var subs []queue.Subscription
-	subs = append(subs, queue.Subscription{
-		Topic:    "croco/cave/#",
-		Handler:  s.crocoCaveLogs, // either Handler or Messages channel can be used
-		Messages: make(chan queue.Message, 10),
-	})
+	s := NewService(queues, db, router, config.Ingest)
+	s.unrouted = config.Write.AllowUnrouted
+	if s.devices, err = device.New(config.Devices); err != nil {
+		return nil, fmt.Errorf("can't configure devices: %w", err)
+	}
 
-	if config.CollectRaw {
-		subs = append(subs, queue.Subscription{
-			Topic:    "ESP32-A473F53A7D80/p/ds18b20/#",
-			Handler:  s.crocoCaveRaw, // either Handler or Messages channel can be used
-			Messages: make(chan queue.Message, 10),
-		})
+	// Discover the topics under mq_root_topic of the connections
+	if s.roots, err = loadRoots(config, queues); err != nil {
+		return nil, err
+	}
+	if len(s.roots) > 0 {
+		s.catalog = discovery.New(router, 0)
 	}
 
-	// Inititalize message queue, subscribe to topics
-	s.q, err = queue.NewClient(ctx, config, subs...)
-	if err != nil {
-		log.Fatalf("Can't configure mqtt client %e", err)
+	// Archive raw messages to reprocess them later
+	if config.Archive.Dir != "" {
+		if s.archived = config.Archive.Filter; s.archived == "" {
+			s.archived = "#"
+		}
+		if err := queue.ValidFilter(s.archived); err != nil {
+			return nil, fmt.Errorf("invalid archive filter %q: %w", s.archived, err)
+		}
+		if s.archive, err = archive.NewWriter(config.Archive); err != nil {
+			return nil, fmt.Errorf("can't configure archive: %w", err)
+		}
 	}
+	if config.Publish.Enabled() {
+		name := config.Mqtt.Name
+		if name == "" {
+			name = DefaultBroker
+		}
+		if s.publisher, err = publish.New(config.Publish, name, s); err != nil {
+			return nil, fmt.Errorf("can't configure publishing: %w", err)
+		}
+		for _, t := range config.Publish.Topics {
+			if _, ok := queues[t.Broker]; t.Broker != "" && !ok {
+				return nil, fmt.Errorf("publish topic %q: unknown broker connection %q", t.Topic, t.Broker)
+			}
+		}
+	}
+	return s, nil
+}
+
+// loadQueues creates the queues of the broker connections by name. The connection of mqtt section is
+// skipped if it is not configured while there are other connections. Embedded broker replaces it,
+// it becomes the bridge target if enabled
+func loadQueues(cfg config.Config) (map[string]queue.Queue, error) {
+	res := map[string]queue.Queue{}
+	conns := cfg.Connections
+	if cfg.Mqtt.MqBrokerURL != "" || cfg.Mqtt.Type != "" || len(conns) == 0 || cfg.Broker.Bridge {
+		if cfg.Mqtt.Name == "" {
+			cfg.Mqtt.Name = DefaultBroker
+		}
+		conns = append([]config.Mqtt{cfg.Mqtt}, conns...)
+	}
+
+	for i, c := range conns {
+		if c.Name == "" {
+			return nil, fmt.Errorf("broker connection %d has no name", i)
+		}
+		if _, ok := res[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate broker connection %q", c.Name)
+		}
+		q, err := queue.New(c)
+		if err != nil {
+			return nil, fmt.Errorf("can't configure message queue %s: %w", c.Name, err)
+		}
+		if _, ok := q.(*queue.Client); ok && cfg.Ingest.Policy == queue.PolicyBlock && !c.Persistent {
+			log.Printf("[WARN] ingest policy block holds up %s, messages are lost on timeout without persistent session", c.Name)
+		}
+		res[c.Name] = q
+	}
+
+	if cfg.Broker.Enabled() {
+		name := cfg.Mqtt.Name
+		if name == "" {
+			name = DefaultBroker
+		}
+		var upstream queue.Queue
+		if cfg.Broker.Bridge {
+			upstream = res[name]
+		}
+		res[name] = broker.New(cfg.Broker, upstream)
+	}
+	return res, nil
+}
+
+// loadRoots returns the discovery root topics of the broker connections by name
+func loadRoots(cfg config.Config, queues map[string]queue.Queue) (map[string]string, error) {
+	if cfg.Mqtt.Name == "" {
+		cfg.Mqtt.Name = DefaultBroker
+	}
+	res := map[string]string{}
+	for _, c := range append([]config.Mqtt{cfg.Mqtt}, cfg.Connections...) {
+		if _, ok := queues[c.Name]; !ok || c.MqRootTopic == "" {
+			continue
+		}
+		if err := queue.ValidFilter(c.MqRootTopic); err != nil {
+			return nil, fmt.Errorf("invalid root topic %q of %s: %w", c.MqRootTopic, c.Name, err)
+		}
+		res[c.Name] = c.MqRootTopic
+	}
+	return res, nil
+}
+
+// RunService consumes messages from mqtt queues and writes them to database
+// It is intended to be run as a service/daemon
+func RunService(ctx context.Context, s *Service) {
+	if err := s.Run(ctx); err != nil {
+		log.Fatalf("Can't connect to message queue %e", err)
+	}
+
+	log.Printf("[INFO] Terminating service")
+	store.Wait(s.Storer)
+}
+
+// names returns the broker connection names in order
+func (s *Service) names() []string {
+	res := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Run subscribes to the route filters of every broker connection, connects to the queues
+// and consumes messages until the context is done
+func (s *Service) Run(ctx context.Context) error {
+
+	// Describe subscriptions, one per distinct route filter of the connection and device status filter,
+	// messages are buffered by the ingest queues
+	subs := map[string][]queue.Subscription{}
+	total := 0
+	for _, name := range s.names() {
+		for _, filter := range s.filters(name) {
+			ingest, err := queue.NewIngest(name, filter, s.ingest)
+			if err != nil {
+				return fmt.Errorf("failed to create ingest queue of %s %s: %w", name, filter, err)
+			}
+			defer ingest.Close()
+			subs[name] = append(subs[name], queue.Subscription{Topic: filter, Ingest: ingest, QoS: s.router.QoS(filter)})
+			total++
+		}
+	}
+	if total == 0 {
+		log.Printf("[WARN] No routes configured, nothing to subscribe to")
+	}
+
+	s.mu.Lock()
+	for _, name := range s.names() {
+		for _, sub := range subs[name] {
+			s.ingests = append(s.ingests, sub.Ingest)
+		}
+	}
+	s.mu.Unlock()
+
+	// Subscribe to topics, subscriptions are made on connect
+	for name, q := range s.queues {
+		for _, sub := range subs[name] {
+			if err := q.Subscribe(sub); err != nil {
+				return fmt.Errorf("failed to subscribe to %s on %s: %w", sub.Topic, name, err)
+			}
+		}
+	}
+
+	// Observe every topic under the root topics, messages are acknowledged by the route subscriptions
+	for _, name := range s.names() {
+		root, ok := s.roots[name]
+		if !ok {
+			continue
+		}
+		observe := func(name string) func(topic, payload string) {
+			return func(topic, payload string) { s.catalog.Observe(name, topic, payload) }
+		}(name)
+		if err := s.queues[name].Subscribe(queue.Subscription{Topic: root, Handler: observe, NoAck: true}); err != nil {
+			return fmt.Errorf("failed to subscribe to root topic %s on %s: %w", root, name, err)
+		}
+		log.Printf("[INFO] Discovering topics on %s of %s", root, name)
+	}
+
+	var wg sync.WaitGroup
+
+	// Archive every message of the archive filter, messages are acknowledged by the route subscriptions.
+	// Archive has the ingest queue of its own, the overflow is handled by the ingest policy and counted
+	if s.archive != nil {
+		var archivers sync.WaitGroup
+		cfg := s.ingest
+		if cfg.SpillDir != "" {
+			cfg.SpillDir = filepath.Join(cfg.SpillDir, "archive")
+		}
+		for _, name := range s.names() {
+			ingest, err := queue.NewIngest(name, s.archived, cfg)
+			if err != nil {
+				return fmt.Errorf("failed to create archive ingest queue of %s: %w", name, err)
+			}
+			defer ingest.Close()
+			s.mu.Lock()
+			s.archives = append(s.archives, ingest)
+			s.mu.Unlock()
+			sub := queue.Subscription{Topic: s.archived, Ingest: ingest, NoAck: true}
+			if err := s.queues[name].Subscribe(sub); err != nil {
+				return fmt.Errorf("failed to subscribe archive to %s on %s: %w", s.archived, name, err)
+			}
+			archivers.Add(1)
+			go func(name string, sub queue.Subscription) {
+				defer archivers.Done()
+				// messages left in the queue are archived before it stops
+				for {
+					m, ok := sub.Ingest.Pop(ctx)
+					if !ok {
+						return
+					}
+					if err := s.archive.Write(name, m, m.Time); err != nil {
+						log.Printf("[ERROR] failed to archive message on %s: %v", m.Topic, err)
+					}
+				}
+			}(name, sub)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.archive.Run(ctx, time.Second)
+			archivers.Wait()
+			if err := s.archive.Close(); err != nil {
+				log.Printf("[ERROR] failed to close archive: %v", err)
+			}
+		}()
+		log.Printf("[INFO] Archiving %s messages", s.archived)
+	}
+
+	// Keep devices across restarts
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.devices.Run(ctx, time.Minute)
+	}()
 
 	// Start consuming messages
-	// Either Handler or Messages channels with consumer goroutine like this can be used
-	for _, sub := range subs {
-		log.Printf("[INFO] Subscribed to channel on %s", sub.Topic)
-		go func(sub queue.Subscription) {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				case m := <-sub.Messages:
-					sub.Handler(m.Topic, m.Payload)
+	for name := range s.queues {
+		for _, sub := range subs[name] {
+			log.Printf("[INFO] Subscribed to channel on %s of %s", sub.Topic, name)
+			wg.Add(1)
+			go func(name string, sub queue.Subscription) {
+				defer wg.Done()
+				for {
+					m, ok := sub.Ingest.Pop(ctx)
+					if !ok {
+						return
+					}
+					// acknowledge once the records are committed, unacknowledged ones are redelivered after restart
+					if err := s.handle(name, sub.Topic, m); err != nil {
+						log.Printf("[WARN] message on %s is not acknowledged: %v", m.Topic, err)
+						continue
+					}
+					if err := store.Commit(s.Storer, m.Ack); err != nil {
+						log.Printf("[WARN] message on %s is not acknowledged: %v", m.Topic, err)
+					}
 				}
+			}(name, sub)
+		}
+	}
+
+	// Connections are independent, the clients failed to connect on start keep retrying
+	for _, name := range s.names() {
+		q := s.queues[name]
+		if err := q.Connect(ctx); err != nil {
+			if _, ok := q.(*queue.Client); !ok {
+				return fmt.Errorf("failed to connect %s: %w", name, err)
 			}
-		}(sub)
+			log.Printf("[WARN] failed to connect %s, retrying: %v", name, err)
+			queue.Retry(ctx, q, 10*time.Second)
+		}
 	}
 
 	<-ctx.Done()
-	log.Printf("[INFO] Terminating service")
+	wg.Wait()
+	return nil
 }
 
-func (s *Service) crocoCaveLogs(topic, payload string) {
-	log.Printf("DEBUG [%s] \t %s\r\n", topic, payload)
-	// croco/cave/temperature
-	// croco/cave/targetTemperature
-	// croco/cave/heater
-	// croco/cave/light
+// filters returns distinct subscription filters of the broker connection, route filters go first
+func (s *Service) filters(broker string) []string {
+	res := s.router.SubscriptionsOf(broker)
+	seen := map[string]bool{}
+	for _, f := range res {
+		seen[f] = true
+	}
+	for _, f := range s.devices.Subscriptions() {
+		if !seen[f] {
+			seen[f] = true
+			res = append(res, f)
+		}
+	}
+	return res
+}
 
-	topicParts := strings.Split(topic, "/")
-	switch topicParts[2] {
-	case "temperature":
-		s.Write(store.Data{Module: "cave", Topic: "temp", Value: payload})
-	case "targetTemperature":
-		s.Write(store.Data{Module: "cave", Topic: "targetTemp", Value: payload})
-	case "heater":
-		s.Write(store.Data{Module: "cave", Topic: "heater", Value: payload})
-	case "light":
-		s.Write(store.Data{Module: "cave", Topic: "light", Value: payload})
+// Queues returns the status of the broker connections
+func (s *Service) Queues() []queue.Status {
+	var res []queue.Status
+	for _, name := range s.names() {
+		st := s.queues[name].Status()
+		st.Name = name
+		res = append(res, st)
 	}
+	return res
 }
 
-func (s *Service) crocoCaveRaw(topic, payload string) {
-	// ESP32 probes raw logs
-	// ESP32-A473F53A7D80/p/ds18b20/#
-	// ESP32-A473F53A7D80/p/ds18b20/1	23.75
-	// ESP32-A473F53A7D80/p/ds18b20/2	24.00
+// Publish publishes the message to the broker connection
+func (s *Service) Publish(broker string, m queue.Message) error {
+	q, ok := s.queues[broker]
+	if !ok {
+		return fmt.Errorf("unknown broker connection %q", broker)
+	}
+	return q.Publish(m)
+}
 
-	topicParts := strings.Split(topic, "/")
-	if len(topicParts) == 4 && topicParts[3] > "0" {
-		val, err := strconv.ParseFloat(payload, 64)
-		if err != nil {
-			log.Printf("ERROR [%s] \t %s \t %e \r\n", topic, payload, err)
-			return
+// Submit validates the record written bypassing mqtt with the checks of the route rendering it and writes it,
+// route.ErrRejected is returned for the rejected one. Records no route renders are rejected unless allowed.
+// The record bypasses the write-behind buffer and is written to the storage right away, it is committed once accepted
+func (s *Service) Submit(d store.Data) error {
+	if err := s.router.Check(d); err != nil && !(s.unrouted && errors.Is(err, route.ErrUnrouted)) {
+		return err
+	}
+	return store.WriteThrough(s.Storer, d)
+}
+
+// Publisher returns the publisher of the commands, nil if publishing is not configured
+func (s *Service) Publisher() *publish.Publisher {
+	return s.publisher
+}
+
+// Devices returns the presence state of the devices
+func (s *Service) Devices() []device.Device {
+	return s.devices.Devices()
+}
+
+// Catalog returns the catalog of the discovered topics, nil if discovery is not configured
+func (s *Service) Catalog() *discovery.Catalog {
+	return s.catalog
+}
+
+// Rejected returns the counters of the values rejected by validation, by module/topic
+func (s *Service) Rejected() map[string]route.Rejected {
+	return s.router.Rejected()
+}
+
+// Ingest returns the counters of the subscription ingest queues, the archive ones go last
+func (s *Service) Ingest() []queue.IngestStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]queue.IngestStats, 0, len(s.ingests)+len(s.archives))
+	for _, i := range s.ingests {
+		res = append(res, i.Stats())
+	}
+	for _, i := range s.archives {
+		st := i.Stats()
+		st.Archive = true
+		res = append(res, st)
+	}
+	return res
+}
+
+// handle routes the message received on the filter subscription of the broker connection and writes the results.
+// Records are timestamped with the receive time of the message, the same the message is archived with.
+// Returns the error of the failed write, messages not routed or rejected are handled
+func (s *Service) handle(broker, filter string, m queue.Message) (err error) {
+	topic, payload := m.Topic, m.Payload
+	log.Printf("[DEBUG] [%s] \t %s", topic, payload)
+	now := m.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if !s.devices.Status(broker, topic, payload, now) {
+		if d := s.router.Device(broker, filter, topic); d != "" {
+			s.devices.Seen(broker, d, topic, now)
 		}
-		// Ignore invalid values
-		if val < 0 || val > 100 {
-			return
+	}
+	data, rerr := s.router.RouteFrom(broker, filter, topic, payload, now)
+	if rerr != nil {
+		log.Printf("[WARN] %v", rerr)
+	}
+	for _, d := range data {
+		if werr := s.Write(d); werr != nil {
+			log.Printf("[ERROR] failed to write %s/%s: %v", d.Module, d.Topic, werr)
+			err = fmt.Errorf("failed to write %s/%s: %w", d.Module, d.Topic, werr)
 		}
-
-		log.Printf("DEBUG [%s] \t %s\r\n", topic, payload)
-		s.Write(store.Data{Module: "probes", Topic: "ds18b20" + "/" + topicParts[3], Value: payload})
 	}
+	return err
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/broker"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/discovery"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/route"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Service(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	router, err := route.New([]config.Route{
+		{Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}", Rename: map[string]string{"temperature": "temp"}},
+		{Filter: "{device}/p/ds18b20/{probe}", Module: "probes", Topic: "ds18b20/{probe}", Validate: config.Validate{Reject: []string{"-127"}}},
+		{Filter: "office/{sensor}", Module: "{broker}", Topic: "{sensor}", Brokers: []string{"office"}},
+	})
+	assert.NoError(t, err)
+
+	q, office := queue.NewLocal(), queue.NewLocal()
+	db := store.NewMemoryStore()
+	s := NewService(map[string]queue.Queue{DefaultBroker: q, "office": office}, db, router, config.Ingest{})
+	s.roots, s.catalog = map[string]string{DefaultBroker: "#"}, discovery.New(router, 0)
+	go s.Run(ctx)
+	assert.Eventually(t, func() bool { return q.Status().Connected && office.Status().Connected }, time.Second, time.Millisecond)
+
+	for _, m := range []queue.Message{
+		{Topic: "croco/cave/temperature", Payload: "23.5"},
+		{Topic: "croco/cave/light", Payload: "on"},
+		{Topic: "ESP32/p/ds18b20/1", Payload: "-127"},
+		{Topic: "ESP32/p/ds18b20/1", Payload: "21"},
+		{Topic: "unrouted/topic", Payload: "1"},
+		{Topic: "office/temp", Payload: "1"}, // office route doesn't apply to the default broker
+	} {
+		assert.NoError(t, q.Publish(m))
+	}
+	assert.NoError(t, office.Publish(queue.Message{Topic: "office/temp", Payload: "22"}))
+
+	assert.Eventually(t, func() bool {
+		cave, _ := db.Range(store.Query{Module: "cave"})
+		probes, _ := db.Range(store.Query{Module: "probes"})
+		officeData, _ := db.Range(store.Query{Module: "office"})
+		return len(cave) == 2 && len(probes) == 1 && len(officeData) == 1
+	}, time.Second, time.Millisecond)
+
+	// every topic of the root topic is discovered, the messages are routed once
+	topics := s.Catalog().Topics()
+	assert.Len(t, topics, 5)
+	assert.Equal(t, "ESP32/p/ds18b20/1", topics[0].Topic)
+	assert.Equal(t, int64(2), topics[0].Messages)
+	assert.True(t, topics[0].Routed)
+	assert.Equal(t, "unrouted/topic", topics[4].Topic)
+	assert.False(t, topics[4].Routed)
+
+	// devices are learned from {device} captures, rejected values count as well
+	devices := s.Devices()
+	assert.Len(t, devices, 1)
+	assert.Equal(t, "ESP32", devices[0].Name)
+	assert.Equal(t, int64(2), devices[0].Messages)
+	assert.True(t, devices[0].Online)
+
+	rejected := s.Rejected()
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, int64(1), rejected["probes/ds18b20/1"].Count)
+	assert.Equal(t, "-127", rejected["probes/ds18b20/1"].Value)
+
+	cave, err := db.Range(store.Query{Module: "cave"})
+	assert.NoError(t, err)
+	assert.Equal(t, "light", cave[0].Topic)
+	assert.Equal(t, store.StringValue("on"), cave[0].Value)
+	assert.Equal(t, "temp", cave[1].Topic)
+	assert.Equal(t, store.FloatValue(23.5), cave[1].Value)
+
+	probes, err := db.Range(store.Query{Module: "probes"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ds18b20/1", probes[0].Topic)
+	assert.Equal(t, store.FloatValue(21), probes[0].Value)
+
+	modules, err := db.Modules()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cave", "office", "probes"}, modules)
+	officeData, err := db.Range(store.Query{Module: "office"})
+	assert.NoError(t, err)
+	assert.Equal(t, store.FloatValue(22), officeData[0].Value)
+
+	// default broker subscriptions go first, office one has the office route in addition
+	ingest := s.Ingest()
+	assert.Len(t, ingest, 5)
+	assert.Equal(t, queue.IngestStats{Broker: DefaultBroker, Topic: "croco/cave/+", Policy: "drop-oldest", Capacity: 1000, Received: 2, Processed: 2}, ingest[0])
+	assert.Equal(t, int64(2), ingest[1].Processed)
+	assert.Equal(t, "office", ingest[4].Broker)
+	assert.Equal(t, "office/+", ingest[4].Topic)
+	assert.Equal(t, int64(1), ingest[4].Processed)
+
+	queues := s.Queues()
+	assert.Len(t, queues, 2)
+	assert.Equal(t, DefaultBroker, queues[0].Name)
+	assert.Equal(t, "office", queues[1].Name)
+	assert.True(t, queues[1].Connected)
+}
+
+func Test_loadQueues(t *testing.T) {
+
+	queues, err := loadQueues(config.Config{Mqtt: config.Mqtt{MqBrokerURL: "tcp://localhost:1883"}})
+	assert.NoError(t, err)
+	assert.Len(t, queues, 1, "mqtt section is the default connection")
+	assert.IsType(t, &queue.Client{}, queues[DefaultBroker])
+
+	queues, err = loadQueues(config.Config{Connections: []config.Mqtt{{Name: "cave", Type: "local"}, {Name: "office", MqBrokerURL: "tcp://office:1883"}}})
+	assert.NoError(t, err)
+	assert.Len(t, queues, 2, "empty mqtt section is skipped")
+	assert.IsType(t, &queue.Local{}, queues["cave"])
+
+	queues, err = loadQueues(config.Config{Mqtt: config.Mqtt{Name: "cave", MqBrokerURL: "tcp://cave:1883"}, Broker: config.Broker{Listen: ":0"}})
+	assert.NoError(t, err)
+	assert.Len(t, queues, 1)
+	assert.IsType(t, &broker.Broker{}, queues["cave"], "embedded broker replaces the mqtt section")
+
+	_, err = loadQueues(config.Config{Connections: []config.Mqtt{{Type: "local"}}})
+	assert.Error(t, err, "connection name is required")
+	_, err = loadQueues(config.Config{Mqtt: config.Mqtt{Type: "local"}, Connections: []config.Mqtt{{Name: DefaultBroker, Type: "local"}}})
+	assert.Error(t, err, "duplicate name")
+}
+
+// lockedStore fails every write
+type lockedStore struct {
+	*store.Store
+}
+
+func (lockedStore) Write(store.Data) error {
+	return errors.New("database is locked")
+}
+
+func Test_Service_handle(t *testing.T) {
+
+	router, err := route.New([]config.Route{{Filter: "croco/cave/{name}", Module: "cave", Topic: "{name}"}})
+	assert.NoError(t, err)
+	s := NewService(map[string]queue.Queue{}, lockedStore{store.NewMemoryStore()}, router, config.Ingest{})
+
+	// failed write keeps the message unacknowledged, unrouted one is handled
+	assert.Error(t, s.handle(DefaultBroker, "croco/cave/+", queue.Message{Topic: "croco/cave/temp", Payload: "23.5"}))
+	assert.NoError(t, s.handle(DefaultBroker, "#", queue.Message{Topic: "unrouted/topic", Payload: "1"}))
+}
+
+func Test_Service_Submit(t *testing.T) {
+
+	router, err := route.New([]config.Route{{Filter: "nas/{name}", Module: "nas", Topic: "{name}"}})
+	assert.NoError(t, err)
+	db := store.NewMemoryStore()
+	s := NewService(map[string]queue.Queue{}, db, router, config.Ingest{})
+
+	now := time.Now()
+	assert.NoError(t, s.Submit(store.Data{Module: "nas", Topic: "disk", DateTime: now, Value: store.FloatValue(42)}))
+	assert.ErrorIs(t, s.Submit(store.Data{Module: "plug", Topic: "power", DateTime: now, Value: store.FloatValue(1)}), route.ErrUnrouted)
+	assert.ErrorIs(t, s.Submit(store.Data{Module: "nas@1h", Topic: "disk", DateTime: now, Value: store.FloatValue(1)}), route.ErrRejected)
+
+	// unrouted records are written if allowed, rollups are never
+	s.unrouted = true
+	assert.NoError(t, s.Submit(store.Data{Module: "plug", Topic: "power", DateTime: now, Value: store.FloatValue(1)}))
+	assert.ErrorIs(t, s.Submit(store.Data{Module: "nas@1h", Topic: "disk", DateTime: now, Value: store.FloatValue(1)}), route.ErrRejected)
+
+	modules, err := db.Modules()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nas", "plug"}, modules)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/parMaster/logserver/app/api"
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/parMaster/logserver/app/simulate"
+)
+
+type SimulateOptions struct {
+	Local  bool   `long:"local" description:"run the service and the api server on the in-process queue instead of publishing to the broker"`
+	Broker string `long:"broker" default:"default" description:"broker connection to publish to"`
+	Seed   int64  `long:"seed" description:"random seed, overrides simulator.seed"`
+	Since  string `long:"since" description:"simulate the readings since the time at once first, RFC3339 or 2006-01-02, local only"`
+}
+
+// RunSimulate publishes the readings of the simulated devices to the broker connection until the context is done.
+// Local simulation runs the service and the api server on the in-process queues instead, the readings are stored
+// with the simulated time, so that the history since the start time is filled at once
+func RunSimulate(ctx context.Context, cfg config.Config, opts SimulateOptions) error {
+	if len(cfg.Simulator.Devices) == 0 {
+		return errors.New("no simulated devices, see simulator.devices")
+	}
+	if opts.Seed != 0 {
+		cfg.Simulator.Seed = opts.Seed
+	}
+	sim, err := simulate.New(cfg.Simulator)
+	if err != nil {
+		return fmt.Errorf("can't configure simulator: %w", err)
+	}
+	start, err := parseTimeOption(opts.Since)
+	if err != nil {
+		return err
+	}
+	if !start.IsZero() && !opts.Local {
+		return errors.New("readings published to the broker are timestamped on receive, simulate since the time locally")
+	}
+	if start.IsZero() {
+		start = time.Now()
+	}
+
+	if !opts.Local {
+		queues, err := loadQueues(clientConfig(cfg, "simulate"))
+		if err != nil {
+			return err
+		}
+		q, ok := queues[opts.Broker]
+		if !ok {
+			return fmt.Errorf("unknown broker connection %q", opts.Broker)
+		}
+		if err := q.Connect(ctx); err != nil {
+			if _, ok := q.(*queue.Client); !ok {
+				return fmt.Errorf("failed to connect %s: %w", opts.Broker, err)
+			}
+			log.Printf("[WARN] failed to connect %s, retrying: %v", opts.Broker, err)
+			queue.Retry(ctx, q, 10*time.Second)
+		}
+		log.Printf("[INFO] Simulating %d devices on %s, seed %d", len(cfg.Simulator.Devices), opts.Broker, cfg.Simulator.Seed)
+		sim.Run(ctx, start, q.Publish)
+		return nil
+	}
+
+	// local queue of every configured broker connection
+	configured, err := loadQueues(cfg)
+	if err != nil {
+		return err
+	}
+	locals := map[string]*queue.Local{}
+	queues := map[string]queue.Queue{}
+	for name := range configured {
+		locals[name] = queue.NewLocal()
+		queues[name] = locals[name]
+	}
+	if _, ok := locals[opts.Broker]; !ok {
+		return fmt.Errorf("unknown broker connection %q", opts.Broker)
+	}
+	s, err := loadService(ctx, cfg, queues)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		RunService(ctx, s)
+		close(done)
+	}()
+	// subscriptions are made before the queues are connected
+	for !connected(locals) {
+		select {
+		case <-ctx.Done():
+			<-done
+			return nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	log.Printf("[INFO] Simulating %d devices locally since %s, seed %d", len(cfg.Simulator.Devices), start.Format(time.RFC3339), cfg.Simulator.Seed)
+	go sim.Run(ctx, start, locals[opts.Broker].Publish)
+
+	if err := api.NewApiServer(ctx, cfg, s.Storer, s).Start(); err != nil {
+		return fmt.Errorf("can't start api server: %w", err)
+	}
+	<-done
+	return nil
+}
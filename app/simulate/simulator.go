@@ -0,0 +1,230 @@
+package simulate
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+)
+
+// Simulator generates the readings of the simulated devices. Every device has its own random source
+// seeded with the seed and its name, so adding a device doesn't change the readings of the others
+type Simulator struct {
+	interval time.Duration
+	devices  []*device
+}
+
+// device is the state of the simulated device
+type device struct {
+	cfg     config.SimDevice
+	topic   string
+	rnd     *rand.Rand
+	light   bool          // light is scheduled
+	on, off time.Duration // light schedule, since midnight
+
+	temp   float64   // temperature without the reading noise
+	heater bool      // heater is on
+	last   time.Time // time of the previous step, zero before the first one
+	silent time.Time // readings are not published until then
+}
+
+// New validates the devices of the simulator config
+func New(cfg config.Simulator) (*Simulator, error) {
+	s := &Simulator{interval: cfg.Interval}
+	if s.interval <= 0 {
+		s.interval = 10 * time.Second
+	}
+	seen := map[string]bool{}
+	for i, c := range cfg.Devices {
+		if c.Name == "" {
+			return nil, fmt.Errorf("simulated device %d has no name", i)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("duplicate simulated device %q", c.Name)
+		}
+		seen[c.Name] = true
+
+		d, err := newDevice(c, cfg.Seed)
+		if err != nil {
+			return nil, fmt.Errorf("simulated device %s: %w", c.Name, err)
+		}
+		s.devices = append(s.devices, d)
+	}
+	return s, nil
+}
+
+func newDevice(c config.SimDevice, seed int64) (*device, error) {
+	d := &device{cfg: c, topic: c.Topic}
+	if d.topic == "" {
+		d.topic = c.Name
+	}
+	if err := queue.ValidTopic(d.topic + "/temperature"); err != nil {
+		return nil, fmt.Errorf("invalid topic %q: %w", d.topic, err)
+	}
+	if c.Temperature.Min > c.Temperature.Max {
+		return nil, fmt.Errorf("temperature min %v is above max %v", c.Temperature.Min, c.Temperature.Max)
+	}
+	for _, p := range []float64{c.Dropout, c.Spike} {
+		if p < 0 || p > 1 {
+			return nil, fmt.Errorf("probability %v is out of [0, 1]", p)
+		}
+	}
+	if d.cfg.Heater.Hysteresis <= 0 {
+		d.cfg.Heater.Hysteresis = 0.5
+	}
+	if d.cfg.Heater.Rate <= 0 {
+		d.cfg.Heater.Rate = 10
+	}
+	if d.cfg.DropoutDuration <= 0 {
+		d.cfg.DropoutDuration = 5 * time.Minute
+	}
+	if c.Light.On != "" || c.Light.Off != "" {
+		var err error
+		if d.on, err = parseClock(c.Light.On); err != nil {
+			return nil, fmt.Errorf("invalid light on time: %w", err)
+		}
+		if d.off, err = parseClock(c.Light.Off); err != nil {
+			return nil, fmt.Errorf("invalid light off time: %w", err)
+		}
+		d.light = true
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(c.Name))
+	d.rnd = rand.New(rand.NewSource(seed ^ int64(h.Sum64()))) // nolint:gosec // reproducible, not for security
+	return d, nil
+}
+
+// parseClock parses the time of the day like "08:00"
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Interval returns the time between the readings
+func (s *Simulator) Interval() time.Duration {
+	return s.interval
+}
+
+// Step advances the devices to the time and returns their readings timestamped with it
+func (s *Simulator) Step(now time.Time) []queue.Message {
+	var res []queue.Message
+	for _, d := range s.devices {
+		res = append(res, d.step(now)...)
+	}
+	return res
+}
+
+// Run publishes the readings of the steps since the start, the steps already due are published at once,
+// the next ones every interval until the context is done
+func (s *Simulator) Run(ctx context.Context, start time.Time, publish func(queue.Message) error) {
+	next := start.Truncate(s.interval)
+	for {
+		if wait := time.Until(next); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+		for _, m := range s.Step(next) {
+			if err := publish(m); err != nil {
+				log.Printf("[WARN] failed to publish %s: %v", m.Topic, err)
+			}
+		}
+		next = next.Add(s.interval)
+	}
+}
+
+// step starts at the ambient temperature, then approaches the ambient one, raised by the heater if it is on,
+// with an hour time constant
+func (d *device) step(now time.Time) []queue.Message {
+	var res []queue.Message
+	heater := d.cfg.Heater
+	ambient := d.ambient(now)
+	if d.last.IsZero() {
+		d.temp = ambient
+		if heater.Target != 0 {
+			res = append(res, queue.Message{Topic: d.topic + "/targetTemperature", Payload: format(heater.Target), Retained: true, Time: now})
+		}
+	} else {
+		steady := ambient
+		if d.heater {
+			steady += heater.Rate
+		}
+		d.temp = steady + (d.temp-steady)*math.Exp(-now.Sub(d.last).Hours())
+	}
+	d.last = now
+	if heater.Target != 0 {
+		switch {
+		case d.temp < heater.Target-heater.Hysteresis:
+			d.heater = true
+		case d.temp > heater.Target+heater.Hysteresis:
+			d.heater = false
+		}
+	}
+
+	// random values are drawn on every step, silent steps don't shift the sequence
+	noise := d.rnd.NormFloat64() * d.cfg.Temperature.Noise
+	spike := d.rnd.Float64() < d.cfg.Spike
+	glitch := []string{"85", "-127"}[d.rnd.Intn(2)]
+	dropout := d.rnd.Float64() < d.cfg.Dropout
+	if now.Before(d.silent) {
+		return res
+	}
+	if dropout {
+		d.silent = now.Add(d.cfg.DropoutDuration)
+	}
+
+	temp := format(d.temp + noise)
+	if spike {
+		temp = glitch
+	}
+	res = append(res, queue.Message{Topic: d.topic + "/temperature", Payload: temp, Time: now})
+	if heater.Target != 0 {
+		res = append(res, queue.Message{Topic: d.topic + "/heater", Payload: onOff(d.heater, "1", "0"), Time: now})
+	}
+	if d.light {
+		res = append(res, queue.Message{Topic: d.topic + "/light", Payload: onOff(d.lightOn(now), "on", "off"), Time: now})
+	}
+	return res
+}
+
+// ambient follows the cosine day curve, the lowest at 02:00 and the highest at 14:00
+func (d *device) ambient(now time.Time) float64 {
+	t := d.cfg.Temperature
+	hour := float64(now.Hour()) + float64(now.Minute())/60 + float64(now.Second())/3600
+	return (t.Min+t.Max)/2 - (t.Max-t.Min)/2*math.Cos(2*math.Pi*(hour-2)/24)
+}
+
+// lightOn checks the schedule, the light scheduled to go off before on is on overnight
+func (d *device) lightOn(now time.Time) bool {
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	if d.on <= d.off {
+		return clock >= d.on && clock < d.off
+	}
+	return clock >= d.on || clock < d.off
+}
+
+func format(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func onOff(v bool, on, off string) string {
+	if v {
+		return on
+	}
+	return off
+}
@@ -0,0 +1,142 @@
+package simulate
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_New(t *testing.T) {
+
+	for _, devices := range [][]config.SimDevice{
+		{{Topic: "croco/cave"}},
+		{{Name: "croco"}, {Name: "croco"}},
+		{{Name: "croco", Topic: "croco/#"}},
+		{{Name: "croco", Temperature: config.SimTemperature{Min: 30, Max: 20}}},
+		{{Name: "croco", Spike: 1.5}},
+		{{Name: "croco", Light: config.SimLight{On: "08:00"}}},
+		{{Name: "croco", Light: config.SimLight{On: "8am", Off: "20:00"}}},
+	} {
+		_, err := New(config.Simulator{Devices: devices})
+		assert.Error(t, err, "%+v", devices)
+	}
+
+	s, err := New(config.Simulator{})
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, s.Interval())
+}
+
+func Test_Simulator(t *testing.T) {
+
+	cfg := config.Simulator{Interval: time.Minute, Seed: 42, Devices: []config.SimDevice{
+		{
+			Name:        "croco",
+			Topic:       "croco/cave",
+			Temperature: config.SimTemperature{Min: 20, Max: 26, Noise: 0.1},
+			Heater:      config.SimHeater{Target: 28},
+			Light:       config.SimLight{On: "08:00", Off: "20:00"},
+		},
+		{Name: "porch", Temperature: config.SimTemperature{Min: 10, Max: 20}, Light: config.SimLight{On: "20:00", Off: "06:00"}},
+	}}
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	run := func(cfg config.Simulator) map[time.Time][]queue.Message {
+		s, err := New(cfg)
+		require.NoError(t, err)
+		res := map[time.Time][]queue.Message{}
+		for now := start; now.Before(start.Add(24 * time.Hour)); now = now.Add(time.Minute) {
+			res[now] = s.Step(now)
+		}
+		return res
+	}
+	values := func(msgs []queue.Message) map[string]string {
+		res := map[string]string{}
+		for _, m := range msgs {
+			res[m.Topic] = m.Payload
+		}
+		return res
+	}
+
+	day := run(cfg)
+	assert.Equal(t, day, run(cfg), "same seed, same readings")
+	cfg.Seed = 43
+	assert.NotEqual(t, day, run(cfg))
+
+	first := day[start]
+	require.Len(t, first, 6)
+	assert.Equal(t, queue.Message{Topic: "croco/cave/targetTemperature", Payload: "28.00", Retained: true, Time: start}, first[0])
+	assert.Equal(t, "porch/temperature", first[4].Topic)
+	assert.Len(t, day[start.Add(time.Minute)], 5, "target is published once")
+
+	// the porch follows the day curve with a lag: the lowest at 02:00, the highest at 14:00
+	porch := func(hour time.Duration) float64 {
+		v, err := strconv.ParseFloat(values(day[start.Add(hour*time.Hour)])["porch/temperature"], 64)
+		require.NoError(t, err)
+		return v
+	}
+	assert.InDelta(t, 10, porch(2), 0.5)
+	assert.InDelta(t, 20, porch(14), 0.5)
+	assert.True(t, porch(2) < porch(8) && porch(8) < porch(14) && porch(14) > porch(20))
+
+	// the heater keeps the cave around the target once warmed up
+	on := 0
+	for now := start.Add(3 * time.Hour); now.Before(start.Add(24 * time.Hour)); now = now.Add(time.Minute) {
+		v := values(day[now])
+		temp, err := strconv.ParseFloat(v["croco/cave/temperature"], 64)
+		require.NoError(t, err)
+		assert.InDelta(t, 28, temp, 1, now.String())
+		if v["croco/cave/heater"] == "1" {
+			on++
+		}
+	}
+	assert.True(t, on > 0 && on < 21*60, "heater toggles, on for %d minutes", on)
+
+	// lights follow the schedule, the porch light is on overnight
+	assert.Equal(t, "off", values(day[start.Add(7*time.Hour+59*time.Minute)])["croco/cave/light"])
+	assert.Equal(t, "on", values(day[start.Add(8*time.Hour)])["croco/cave/light"])
+	assert.Equal(t, "off", values(day[start.Add(20*time.Hour)])["croco/cave/light"])
+	assert.Equal(t, "on", values(day[start.Add(23*time.Hour)])["porch/light"])
+	assert.Equal(t, "off", values(day[start.Add(12*time.Hour)])["porch/light"])
+}
+
+func Test_Simulator_Faults(t *testing.T) {
+
+	s, err := New(config.Simulator{Interval: time.Minute, Devices: []config.SimDevice{
+		{Name: "glitchy", Spike: 1},
+		{Name: "flaky", Dropout: 1, DropoutDuration: 3 * time.Minute},
+	}})
+	require.NoError(t, err)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var silent int
+	for now := start; now.Before(start.Add(time.Hour)); now = now.Add(time.Minute) {
+		msgs := s.Step(now)
+		assert.Contains(t, []string{"85", "-127"}, msgs[0].Payload, "every reading is a spike")
+		if len(msgs) == 1 {
+			silent++
+		}
+	}
+	assert.Equal(t, 40, silent, "a reading every 3 minutes")
+}
+
+func Test_Simulator_Run(t *testing.T) {
+
+	s, err := New(config.Simulator{Interval: time.Minute, Devices: []config.SimDevice{{Name: "croco"}}})
+	require.NoError(t, err)
+
+	// the steps since the start are published at once, the next one is a minute away
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var msgs []queue.Message
+	s.Run(ctx, time.Now().Add(-time.Hour), func(m queue.Message) error {
+		msgs = append(msgs, m)
+		return nil
+	})
+	require.Len(t, msgs, 61)
+	assert.Equal(t, time.Minute, msgs[1].Time.Sub(msgs[0].Time))
+}
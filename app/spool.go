@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/store"
+)
+
+type SpoolOptions struct {
+	Flush bool `long:"flush" description:"write the spooled records to the storage"`
+	List  bool `long:"list" description:"list the spooled records"`
+}
+
+// RunSpool reports the records spooled by the stopped service, lists and writes them if requested.
+// It refuses to run while the service holds the spool file, use the API of the running service instead
+func RunSpool(ctx context.Context, cfg config.Config, opts SpoolOptions) error {
+	if cfg.Storage.Spool.Path == "" {
+		return errors.New("spool is not configured, see storage.spool.path")
+	}
+	// the spool is locked before the storage is opened, the storage of the running service may block on its lock
+	sp, err := store.OpenSpool(nil, cfg.Storage.Spool)
+	if errors.Is(err, store.ErrLocked) {
+		return fmt.Errorf("spool is held by the running service, use /api/v1/spool: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+
+	records, err := sp.Records()
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] %d records in spool %s", len(records), cfg.Storage.Spool.Path)
+	if opts.List {
+		for _, d := range records {
+			fmt.Printf("%s\t%s\t%s\t%s\n", d.DateTime.Format("2006-01-02T15:04:05.000Z07:00"), d.Module, d.Topic, d.Value)
+		}
+	}
+
+	if !opts.Flush || len(records) == 0 {
+		return nil
+	}
+	if sp.Storer, err = store.Open(ctx, cfg.Storage.Type+":"+cfg.Storage.Path); err != nil {
+		return err
+	}
+	n, err := sp.Flush()
+	log.Printf("[INFO] %d spooled records written, %d left", n, sp.Stats().Pending)
+	return err
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/parMaster/logserver/app/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RunSpool(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir := t.TempDir()
+	cfg := config.Config{}
+	cfg.Storage.Type, cfg.Storage.Path = "bolt", path.Join(dir, "data.db")
+	cfg.Storage.Spool = config.Spool{Path: path.Join(dir, "spool.jsonl")}
+
+	// the running service holds the spool and the database
+	db, err := store.Open(ctx, cfg.Storage.Type+":"+cfg.Storage.Path)
+	require.NoError(t, err)
+	sp, err := store.OpenSpool(db, cfg.Storage.Spool)
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = RunSpool(ctx, cfg, SpoolOptions{Flush: true})
+	assert.ErrorIs(t, err, store.ErrLocked)
+	assert.Contains(t, err.Error(), "held by the running service")
+	assert.Less(t, time.Since(start), time.Second, "the database lock is not waited for")
+	require.NoError(t, sp.Close())
+}
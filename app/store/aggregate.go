@@ -0,0 +1,175 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Agg is the aggregate function applied to the records of a time bucket
+type Agg string
+
+const (
+	AggAvg    Agg = "avg"
+	AggMin    Agg = "min"
+	AggMax    Agg = "max"
+	AggFirst  Agg = "first"
+	AggLast   Agg = "last"
+	AggCount  Agg = "count"
+	AggSum    Agg = "sum"
+	AggStddev Agg = "stddev"
+)
+
+// ParseAgg validates the aggregate function name. Percentiles are named "p" and the percent, e.g. "p95".
+// Empty name is avg
+func ParseAgg(s string) (Agg, error) {
+	switch a := Agg(strings.ToLower(s)); a {
+	case "":
+		return AggAvg, nil
+	case AggAvg, AggMin, AggMax, AggFirst, AggLast, AggCount, AggSum, AggStddev:
+		return a, nil
+	}
+	if _, ok := Agg(s).percentile(); ok {
+		return Agg(strings.ToLower(s)), nil
+	}
+	return "", fmt.Errorf("unknown aggregate function %q", s)
+}
+
+// percentile returns the percent of "pNN" function
+func (a Agg) percentile() (float64, bool) {
+	if !strings.HasPrefix(string(a), "p") && !strings.HasPrefix(string(a), "P") {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(string(a[1:]), 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, false
+	}
+	return p, true
+}
+
+// steps are the bucket sizes AutoStep chooses from
+var steps = []time.Duration{
+	time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour,
+}
+
+// MaxPoints is the number of buckets per series AutoStep aims for
+const MaxPoints = 2000
+
+// AutoStep returns the smallest step giving at most MaxPoints buckets for the range.
+// The range without lower bound gets hourly buckets
+func AutoStep(from, to time.Time) time.Duration {
+	if from.IsZero() {
+		return time.Hour
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	for _, s := range steps {
+		if to.Sub(from)/s <= MaxPoints {
+			return s
+		}
+	}
+	return steps[len(steps)-1]
+}
+
+// bucket truncates the time to the step, buckets are aligned to unix epoch.
+// Records are kept with millisecond precision, shorter steps are a millisecond
+func bucket(t time.Time, step time.Duration) time.Time {
+	ms := t.UnixMilli()
+	s := step.Milliseconds()
+	if s < 1 {
+		s = 1
+	}
+	b := ms - ms%s
+	if ms < 0 && ms%s != 0 {
+		b -= s
+	}
+	return time.UnixMilli(b).UTC()
+}
+
+// Aggregate groups the records ordered by topic and DateTime into buckets of step
+// and applies the aggregate function. Bucket records are timestamped with the bucket start.
+// Non-numeric values are only counted and taken as first and last. Steps under a millisecond are a millisecond
+func Aggregate(data []Data, step time.Duration, agg Agg) []Data {
+	if step <= 0 {
+		return data
+	}
+
+	var res []Data
+	for i := 0; i < len(data); {
+		j := i
+		b := bucket(data[i].DateTime, step)
+		for j < len(data) && data[j].Topic == data[i].Topic && bucket(data[j].DateTime, step).Equal(b) {
+			j++
+		}
+		if v, ok := aggregate(data[i:j], agg); ok {
+			res = append(res, Data{Module: data[i].Module, DateTime: b, Topic: data[i].Topic, Value: v})
+		}
+		i = j
+	}
+	return res
+}
+
+// aggregate applies the function to the records of a single bucket
+func aggregate(data []Data, agg Agg) (Value, bool) {
+	switch agg {
+	case AggFirst:
+		return data[0].Value, true
+	case AggLast:
+		return data[len(data)-1].Value, true
+	case AggCount:
+		return FloatValue(float64(len(data))), true
+	}
+
+	var nums []float64
+	for _, d := range data {
+		if d.Value.Kind() == KindString {
+			continue
+		}
+		if f, ok := d.Value.Float(); ok {
+			nums = append(nums, f)
+		}
+	}
+	if len(nums) == 0 {
+		return Value{}, false
+	}
+
+	sum := 0.0
+	for _, n := range nums {
+		sum += n
+	}
+
+	switch agg {
+	case AggSum:
+		return FloatValue(sum), true
+	case AggMin, AggMax:
+		m := nums[0]
+		for _, n := range nums {
+			if (agg == AggMin && n < m) || (agg == AggMax && n > m) {
+				m = n
+			}
+		}
+		return FloatValue(m), true
+	case AggStddev:
+		mean, sq := sum/float64(len(nums)), 0.0
+		for _, n := range nums {
+			sq += (n - mean) * (n - mean)
+		}
+		return FloatValue(math.Sqrt(sq / float64(len(nums)))), true
+	}
+
+	if p, ok := agg.percentile(); ok {
+		sort.Float64s(nums)
+		// linear interpolation between closest ranks
+		rank := p / 100 * float64(len(nums)-1)
+		lo := int(math.Floor(rank))
+		hi := int(math.Ceil(rank))
+		return FloatValue(nums[lo] + (nums[hi]-nums[lo])*(rank-float64(lo))), true
+	}
+
+	return FloatValue(sum / float64(len(nums))), true
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ParseAgg(t *testing.T) {
+	for _, s := range []string{"avg", "MIN", "max", "first", "last", "count", "sum", "stddev", "p95", "P50", "p99.9", "p100"} {
+		_, err := ParseAgg(s)
+		assert.NoError(t, err, s)
+	}
+	a, err := ParseAgg("")
+	assert.NoError(t, err)
+	assert.Equal(t, AggAvg, a)
+
+	for _, s := range []string{"median", "p0", "p101", "p", "px"} {
+		_, err := ParseAgg(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func Test_AutoStep(t *testing.T) {
+	to := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Minute, AutoStep(to.Add(-24*time.Hour), to))
+	assert.Equal(t, 10*time.Minute, AutoStep(to.AddDate(0, 0, -7), to))
+	assert.Equal(t, 2*time.Hour, AutoStep(to.AddDate(0, -3, 0), to))
+	assert.Equal(t, 7*24*time.Hour, AutoStep(to.AddDate(-100, 0, 0), to))
+	assert.Equal(t, time.Hour, AutoStep(time.Time{}, to))
+}
+
+func Test_Aggregate(t *testing.T) {
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var data []Data
+	for i := 0; i < 10; i++ {
+		data = append(data, Data{Module: "m", DateTime: start.Add(time.Duration(i) * 30 * time.Second), Topic: "a", Value: FloatValue(float64(i))})
+	}
+	data = append(data,
+		Data{Module: "m", DateTime: start, Topic: "b", Value: StringValue("on")},
+		Data{Module: "m", DateTime: start.Add(time.Second), Topic: "b", Value: BoolValue(true)},
+		Data{Module: "m", DateTime: start.Add(2 * time.Second), Topic: "b", Value: BoolValue(false)},
+		Data{Module: "m", DateTime: start.Add(time.Hour), Topic: "b", Value: StringValue("off")},
+	)
+
+	assert.Equal(t, data, Aggregate(data, 0, AggAvg))
+	sub := Aggregate(data[:3], 500*time.Microsecond, AggCount)
+	assert.Len(t, sub, 3, "sub-millisecond step is a millisecond")
+	assert.Equal(t, start.Add(30*time.Second), sub[1].DateTime)
+
+	values := func(res []Data) (out []string) {
+		for _, d := range res {
+			out = append(out, d.Topic+"="+d.Value.String())
+		}
+		return out
+	}
+
+	tbl := []struct {
+		agg Agg
+		out []string
+	}{
+		{AggAvg, []string{"a=1.5", "a=5.5", "a=8.5", "b=0.5"}},
+		{"", []string{"a=1.5", "a=5.5", "a=8.5", "b=0.5"}},
+		{AggMin, []string{"a=0", "a=4", "a=8", "b=0"}},
+		{AggMax, []string{"a=3", "a=7", "a=9", "b=1"}},
+		{AggSum, []string{"a=6", "a=22", "a=17", "b=1"}},
+		{AggCount, []string{"a=4", "a=4", "a=2", "b=3", "b=1"}},
+		{AggFirst, []string{"a=0", "a=4", "a=8", "b=on", "b=off"}},
+		{AggLast, []string{"a=3", "a=7", "a=9", "b=false", "b=off"}},
+		{"p50", []string{"a=1.5", "a=5.5", "a=8.5", "b=0.5"}},
+		{"p100", []string{"a=3", "a=7", "a=9", "b=1"}},
+	}
+	for _, tt := range tbl {
+		res := Aggregate(data, 2*time.Minute, tt.agg)
+		assert.Equal(t, tt.out, values(res), string(tt.agg))
+		assert.Equal(t, start, res[0].DateTime)
+		assert.Equal(t, start.Add(2*time.Minute), res[1].DateTime)
+	}
+
+	res := Aggregate(data[:4], time.Hour, AggStddev)
+	assert.Len(t, res, 1)
+	f, _ := res[0].Value.Float()
+	assert.InDelta(t, math.Sqrt(1.25), f, 1e-9)
+}
+
+// testAggregate checks aggregated Range of the Storer
+func testAggregate(t *testing.T, s Storer) {
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 120; i++ {
+		assert.NoError(t, s.Write(Data{Module: "agg", DateTime: start.Add(time.Duration(i) * 30 * time.Second), Topic: "temp", Value: FloatValue(float64(i))}))
+		assert.NoError(t, s.Write(Data{Module: "agg", DateTime: start.Add(time.Duration(i) * 30 * time.Second), Topic: "heater", Value: BoolValue(i%4 == 0)}))
+	}
+	assert.NoError(t, s.Write(Data{Module: "agg", DateTime: start.Add(time.Millisecond), Topic: "heater", Value: StringValue("unknown")}))
+
+	for _, agg := range []Agg{AggAvg, AggMin, AggMax, AggSum, AggCount, AggFirst, AggLast, AggStddev, "p90"} {
+		data, err := s.Range(Query{Module: "agg", From: start.Add(10 * time.Minute), To: start.Add(40 * time.Minute), Step: 5 * time.Minute, Agg: agg})
+		assert.NoError(t, err)
+		raw, err := s.Range(Query{Module: "agg", From: start.Add(10 * time.Minute), To: start.Add(40 * time.Minute)})
+		assert.NoError(t, err)
+		assert.Equal(t, Aggregate(raw, 5*time.Minute, agg), data, string(agg))
+		assert.Len(t, data, 12, string(agg))
+	}
+
+	data, err := s.Range(Query{Module: "agg", Topics: []string{"heater"}, To: start.Add(time.Hour), Step: time.Hour, Agg: AggCount})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "agg", DateTime: start, Topic: "heater", Value: FloatValue(121)}}, data)
+	data, err = s.Range(Query{Module: "agg", Topics: []string{"heater"}, To: start.Add(time.Hour), Step: time.Hour, Agg: AggAvg})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "agg", DateTime: start, Topic: "heater", Value: FloatValue(0.25)}}, data)
+}
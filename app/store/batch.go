@@ -0,0 +1,286 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/parMaster/logserver/app/config"
+)
+
+// BatchWriter is implemented by the storages able to write several records in a single transaction
+type BatchWriter interface {
+	WriteBatch([]Data) error
+}
+
+// ErrStopped is returned by Write of the stopped Batcher
+var ErrStopped = errors.New("batcher is stopped")
+
+// Batcher is a write-behind Storer. Records are buffered and written in batches of configured size
+// or once per window, whichever comes first. Write blocks while the buffer is full.
+// Buffered records are written when the context is done, then the backend is stopped.
+// Reads go to the backend directly and don't see the buffered records
+type Batcher struct {
+	Storer
+	in     chan entry
+	size   int
+	window time.Duration
+	done   chan struct{}
+
+	mu    sync.Mutex
+	stats BatchStats
+}
+
+// entry is either a record or a commit callback queued after the records
+type entry struct {
+	Data
+	commit func()
+}
+
+// BatchStats are the counters of written batches
+type BatchStats struct {
+	Batches     int64         `json:"batches"`
+	Records     int64         `json:"records"`
+	Failed      int64         `json:"failed"`  // records failed to write
+	Pending     int           `json:"pending"` // records in the buffer
+	LastLatency time.Duration `json:"last_latency"`
+	MaxLatency  time.Duration `json:"max_latency"`
+	AvgLatency  time.Duration `json:"avg_latency"`
+}
+
+// NewBatcher starts writing the records to the backend in batches, stop is called when the buffer is flushed
+func NewBatcher(ctx context.Context, s Storer, cfg config.Batch, stop func()) *Batcher {
+	if cfg.Size <= 0 {
+		cfg.Size = 1
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = time.Second
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 10 * cfg.Size
+	}
+
+	b := &Batcher{
+		Storer: s,
+		in:     make(chan entry, cfg.Buffer),
+		size:   cfg.Size,
+		window: cfg.Window,
+		done:   make(chan struct{}),
+	}
+	go b.run(ctx, stop)
+	return b
+}
+
+// Write adds the record to the buffer, DateTime is set here if it is empty
+func (b *Batcher) Write(d Data) error {
+	if d.Module == "" {
+		return errors.New("module name is empty")
+	}
+	if d.Topic == "" {
+		return errors.New("topic is empty")
+	}
+	d = normalize(d)
+	return b.push(entry{Data: d})
+}
+
+// Commit calls fn once the records written before are committed to the backend.
+// It is not called if the batcher is stopped before or the records failed to write
+func (b *Batcher) Commit(fn func()) error {
+	return b.push(entry{commit: fn})
+}
+
+func (b *Batcher) push(e entry) error {
+	select {
+	case <-b.done:
+		return ErrStopped
+	default:
+	}
+	select {
+	case b.in <- e:
+		return nil
+	case <-b.done:
+		return ErrStopped
+	}
+}
+
+// Done is closed when the buffered records are written after the context is done
+func (b *Batcher) Done() <-chan struct{} {
+	return b.done
+}
+
+// Stats returns the counters of written batches
+func (b *Batcher) Stats() BatchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := b.stats
+	s.Pending = len(b.in)
+	return s
+}
+
+func (b *Batcher) run(ctx context.Context, stop func()) {
+	defer close(b.done)
+	defer stop()
+
+	ticker := time.NewTicker(b.window)
+	defer ticker.Stop()
+
+	batch := make([]Data, 0, b.size)
+	// commits are called if the records of the batch before them are written
+	type commit struct {
+		after int
+		fn    func()
+	}
+	var commits []commit
+	flush := func() {
+		written := len(batch)
+		if len(batch) > 0 {
+			written = b.flush(batch)
+			batch = batch[:0]
+		}
+		for _, c := range commits {
+			if c.after > written {
+				break
+			}
+			c.fn()
+		}
+		commits = commits[:0]
+	}
+	add := func(e entry) {
+		switch {
+		case e.commit != nil && len(batch) == 0:
+			e.commit()
+		case e.commit != nil:
+			commits = append(commits, commit{after: len(batch), fn: e.commit})
+		default:
+			batch = append(batch, e.Data)
+			if len(batch) >= b.size {
+				flush()
+			}
+		}
+	}
+
+	for {
+		select {
+		case e := <-b.in:
+			add(e)
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case e := <-b.in:
+					add(e)
+				default:
+					flush()
+					log.Printf("[INFO] write buffer flushed, %s", b.Stats())
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes the batch, records of the failed batch are retried one by one.
+// Returns the number of records written before the first failed one
+func (b *Batcher) flush(batch []Data) (written int) {
+	start := time.Now()
+	failed := 0
+	written = len(batch)
+	if err := writeBatch(b.Storer, batch); err != nil {
+		log.Printf("[WARN] failed to write batch of %d records, retrying one by one: %v", len(batch), err)
+		for i, d := range batch {
+			if err := b.Storer.Write(d); err != nil {
+				log.Printf("[ERROR] failed to write %s/%s: %v", d.Module, d.Topic, err)
+				failed++
+				if i < written {
+					written = i
+				}
+			}
+		}
+	}
+	latency := time.Since(start)
+	log.Printf("[DEBUG] wrote batch of %d records in %v", len(batch), latency)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stats.Batches++
+	b.stats.Records += int64(len(batch) - failed)
+	b.stats.Failed += int64(failed)
+	b.stats.LastLatency = latency
+	if latency > b.stats.MaxLatency {
+		b.stats.MaxLatency = latency
+	}
+	b.stats.AvgLatency += (latency - b.stats.AvgLatency) / time.Duration(b.stats.Batches)
+	return written
+}
+
+func (s BatchStats) String() string {
+	return fmt.Sprintf("batches: %d, records: %d, failed: %d, latency avg: %v, max: %v",
+		s.Batches, s.Records, s.Failed, s.AvgLatency, s.MaxLatency)
+}
+
+// writeBatch writes the records in a single transaction if the storage supports it
+func writeBatch(s Storer, data []Data) error {
+	if bw, ok := s.(BatchWriter); ok {
+		return bw.WriteBatch(data)
+	}
+	for _, d := range data {
+		if err := s.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit calls fn once the records written to the storage before are committed,
+// right away unless the storage writes behind. fn is not called if the records failed to write
+func Commit(s Storer, fn func()) error {
+	switch s := s.(type) {
+	case *Retention:
+		return Commit(s.Storer, fn)
+	case *Batcher:
+		return s.Commit(fn)
+	}
+	fn()
+	return nil
+}
+
+// WriteThrough writes the record bypassing the write-behind buffer, so that the error of the backend
+// is returned and the record is committed once it returns
+func WriteThrough(s Storer, d Data) error {
+	switch s := s.(type) {
+	case *Retention:
+		return WriteThrough(s.Storer, d)
+	case *Batcher:
+		if d.Module == "" || d.Topic == "" {
+			return s.Write(d)
+		}
+		return s.Storer.Write(normalize(d))
+	}
+	return s.Write(d)
+}
+
+// unbuffered returns the storage under the write-behind buffer, the records written to it are committed
+// once the write returns
+func unbuffered(s Storer) Storer {
+	switch s := s.(type) {
+	case *Retention:
+		return unbuffered(s.Storer)
+	case *Batcher:
+		return s.Storer
+	}
+	return s
+}
+
+// Wait blocks until the buffered records of the storage are written after its context is done
+func Wait(s Storer) {
+	switch s := s.(type) {
+	case *Retention:
+		Wait(s.Storer)
+	case *Batcher:
+		<-s.Done()
+	}
+}
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedStore blocks batch writes until the gate is opened
+type gatedStore struct {
+	*Store
+	gate chan struct{}
+}
+
+func (g *gatedStore) WriteBatch(data []Data) error {
+	<-g.gate
+	for _, d := range data {
+		if err := g.Store.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Test_Batcher(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := false
+	b := NewBatcher(ctx, NewMemoryStore(), config.Batch{Size: 3, Window: 50 * time.Millisecond}, func() { stopped = true })
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, b.Write(Data{Module: "batch", DateTime: start.Add(time.Duration(i) * time.Second), Topic: "temp", Value: FloatValue(float64(i))}))
+	}
+	assert.Error(t, b.Write(Data{Module: "batch", Value: FloatValue(1)}), "empty topic is rejected right away")
+
+	// the last record is written by the window timer, stats are counted after the write
+	assert.Eventually(t, func() bool {
+		data, err := b.Range(Query{Module: "batch"})
+		return err == nil && len(data) == 7 && b.Stats().Records == 7
+	}, time.Second, 10*time.Millisecond)
+	stats := b.Stats()
+	assert.Equal(t, int64(3), stats.Batches)
+	assert.Equal(t, int64(7), stats.Records)
+	assert.Zero(t, stats.Pending)
+
+	// buffered records are written on shutdown
+	assert.NoError(t, b.Write(Data{Module: "batch", DateTime: start.Add(time.Minute), Topic: "temp", Value: FloatValue(60)}))
+	cancel()
+	Wait(NewRetention(b, nil))
+	assert.True(t, stopped)
+	data, err := b.Range(Query{Module: "batch"})
+	assert.NoError(t, err)
+	assert.Len(t, data, 8)
+	assert.ErrorIs(t, b.Write(Data{Module: "batch", Topic: "temp", Value: FloatValue(1)}), ErrStopped)
+}
+
+func Test_Batcher_Backpressure(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g := &gatedStore{Store: NewMemoryStore(), gate: make(chan struct{})}
+	b := NewBatcher(ctx, g, config.Batch{Size: 1, Buffer: 2}, func() {})
+
+	// the first record is being written, the next two are buffered
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, b.Write(Data{Module: "batch", Topic: fmt.Sprintf("t%d", i), Value: FloatValue(1)}))
+	}
+	assert.Eventually(t, func() bool { return b.Stats().Pending == 2 }, time.Second, time.Millisecond)
+
+	written := make(chan struct{})
+	go func() {
+		assert.NoError(t, b.Write(Data{Module: "batch", Topic: "t3", Value: FloatValue(1)}))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write must block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(g.gate)
+	<-written
+	cancel()
+	<-b.Done()
+	topics, err := g.Topics("batch")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"t0", "t1", "t2", "t3"}, topics)
+}
+
+func Test_Batcher_Commit(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	committed := false
+	assert.NoError(t, Commit(NewMemoryStore(), func() { committed = true }))
+	assert.True(t, committed, "storage writing right away commits right away")
+
+	g := &gatedStore{Store: NewMemoryStore(), gate: make(chan struct{})}
+	b := NewBatcher(ctx, g, config.Batch{Size: 2, Window: 10 * time.Millisecond}, func() {})
+
+	commits := make(chan string, 10)
+	assert.NoError(t, b.Write(Data{Module: "batch", Topic: "t0", Value: FloatValue(1)}))
+	assert.NoError(t, Commit(NewRetention(b, nil), func() { commits <- "t0" }))
+	select {
+	case c := <-commits:
+		t.Fatalf("%s is committed before the batch is written", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// written through the buffer right away
+	assert.NoError(t, WriteThrough(NewRetention(b, nil), Data{Module: "direct", Topic: "t1", Value: FloatValue(2)}))
+	topics, err := g.Topics("direct")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"t1"}, topics)
+	assert.Error(t, WriteThrough(b, Data{Module: "direct", Value: FloatValue(2)}))
+
+	close(g.gate)
+	assert.Equal(t, "t0", <-commits)
+	topics, err = g.Topics("batch")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"t0"}, topics)
+
+	cancel()
+	<-b.Done()
+	assert.ErrorIs(t, b.Commit(func() { commits <- "late" }), ErrStopped)
+}
+
+func Test_Batcher_Commit_Failed(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := &failingStore{Store: NewMemoryStore(), broken: true}
+	b := NewBatcher(ctx, db, config.Batch{Size: 10, Window: 10 * time.Millisecond}, func() {})
+
+	// records failed to write are not committed, nor the ones written after them
+	commits := make(chan string, 10)
+	assert.NoError(t, b.Write(Data{Module: "batch", Topic: "t0", Value: FloatValue(1)}))
+	assert.NoError(t, b.Commit(func() { commits <- "t0" }))
+	assert.NoError(t, b.Commit(func() { commits <- "t0 again" }))
+	assert.NoError(t, b.Write(Data{Module: "batch", Topic: "t1", Value: FloatValue(2)}))
+	assert.NoError(t, b.Commit(func() { commits <- "t1" }))
+	assert.Eventually(t, func() bool { return b.Stats().Failed == 2 }, time.Second, time.Millisecond)
+	assert.Empty(t, commits)
+
+	db.setBroken(false)
+	assert.NoError(t, b.Write(Data{Module: "batch", Topic: "t2", Value: FloatValue(3)}))
+	assert.NoError(t, b.Commit(func() { commits <- "t2" }))
+	assert.Equal(t, "t2", <-commits)
+	assert.Empty(t, commits)
+}
+
+func Test_WriteBatch(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := path.Join(tempDir(), "batch.bolt")
+	defer os.Remove(file)
+	b, err := NewBolt(ctx, file)
+	assert.NoError(t, err)
+	s, err := NewSQLite(ctx, fmt.Sprintf("file:%s/test_batch.db?mode=rwc", tempDir()))
+	assert.NoError(t, err)
+	s.Cleanup("batch")
+	s.Cleanup("other")
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	batch := []Data{
+		{Module: "batch", DateTime: start, Topic: "temp", Value: FloatValue(23.5)},
+		{Module: "batch", DateTime: start.Add(time.Second), Topic: "heater", Value: BoolValue(true)},
+		{Module: "other", DateTime: start, Topic: "state", Value: StringValue("on")},
+	}
+	for _, w := range []BatchWriter{b, s} {
+		assert.NoError(t, w.WriteBatch(batch))
+		data, err := w.(Storer).Range(Query{Module: "batch"})
+		assert.NoError(t, err)
+		assert.Equal(t, []Data{batch[1], batch[0]}, data)
+		data, err = w.(Storer).Range(Query{Module: "other"})
+		assert.NoError(t, err)
+		assert.Equal(t, batch[2:], data)
+
+		// the batch is written as a whole or not at all
+		assert.Error(t, w.WriteBatch([]Data{{Module: "batch", DateTime: start.Add(time.Hour), Topic: "temp"}, {Module: "batch"}}))
+		data, err = w.(Storer).Range(Query{Module: "batch", From: start.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Empty(t, data)
+	}
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -30,7 +32,115 @@ func NewBolt(ctx context.Context, dbFile string) (b *Bolt, err error) {
 		db.Close()
 	}()
 
-	return &Bolt{db: db, ctx: ctx}, nil
+	b = &Bolt{db: db, ctx: ctx}
+	if err = b.upgrade(); err != nil {
+		return nil, fmt.Errorf("failed to upgrade string schema records: %w", err)
+	}
+
+	return b, nil
+}
+
+// upgrade rewrites string schema records with time ordered keys
+func (b *Bolt) upgrade() error {
+	n := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			var legacy [][]byte
+			err := bucket.ForEach(func(k, v []byte) error {
+				if bytes.IndexByte(k, 0) < 0 {
+					legacy = append(legacy, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range legacy {
+				d, err := decodeBolt(k, bucket.Get(k))
+				if err != nil {
+					return fmt.Errorf("bucket %q, key %q: %w", name, k, err)
+				}
+				key, val, err := encodeBolt(d)
+				if err != nil {
+					return err
+				}
+				if err = bucket.Put(key, val); err != nil {
+					return err
+				}
+				if err = bucket.Delete(k); err != nil {
+					return err
+				}
+				n++
+			}
+			return nil
+		})
+	})
+	if n > 0 {
+		log.Printf("[INFO] BoltDB upgraded %d string schema records", n)
+	}
+	return err
+}
+
+// boltRecord is the json value of the bolt record. Records of the string schema
+// have DateTime formatted as "2006-01-02 15:04" in local time and string Value
+type boltRecord struct {
+	Topic    string
+	DateTime string
+	Value    json.RawMessage
+}
+
+// boltKey is the record key: topic, zero byte and big endian unix milliseconds,
+// so the records of the topic are ordered by time
+func boltKey(topic string, t time.Time) []byte {
+	k := make([]byte, len(topic)+9)
+	copy(k, topic)
+	binary.BigEndian.PutUint64(k[len(topic)+1:], uint64(t.UnixMilli()))
+	return k
+}
+
+// encodeBolt returns the key and the value of the record
+func encodeBolt(d Data) (key, val []byte, err error) {
+	v, err := json.Marshal(d.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	val, err = json.Marshal(boltRecord{Topic: d.Topic, DateTime: d.DateTime.Format(time.RFC3339Nano), Value: v})
+	if err != nil {
+		return nil, nil, err
+	}
+	return boltKey(d.Topic, d.DateTime), val, nil
+}
+
+// decodeBolt decodes records of both current and string schema
+func decodeBolt(k, v []byte) (Data, error) {
+	rec := boltRecord{}
+	if err := json.Unmarshal(v, &rec); err != nil {
+		return Data{}, err
+	}
+	d := Data{Topic: rec.Topic}
+
+	// current schema keys contain zero byte
+	if bytes.IndexByte(k, 0) >= 0 {
+		t, err := time.Parse(time.RFC3339Nano, rec.DateTime)
+		if err != nil {
+			return Data{}, err
+		}
+		d.DateTime = t.UTC()
+		return d, json.Unmarshal(rec.Value, &d.Value)
+	}
+
+	t, err := parseLegacyTime(rec.DateTime)
+	if err != nil {
+		return Data{}, err
+	}
+	d.DateTime = t
+	var val string
+	if err := json.Unmarshal(rec.Value, &val); err != nil {
+		return Data{}, err
+	}
+	d.Value = ParseValue(val)
+	return d, nil
 }
 
 // Read returns all the records from the given module
@@ -45,8 +155,7 @@ func (b *Bolt) Read(module string) ([]Data, error) {
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			val := Data{}
-			err := json.Unmarshal(v, &val)
+			val, err := decodeBolt(k, v)
 			if err != nil {
 				return err
 			}
@@ -67,46 +176,47 @@ func (b *Bolt) Read(module string) ([]Data, error) {
 // Write saves the given data to the storage. The data is saved in a bucket named after the module.
 // If the DateTime is empty, it will be set to the current time
 func (b *Bolt) Write(data Data) error {
+	return b.WriteBatch([]Data{data})
+}
 
-	if data.DateTime == "" {
-		data.DateTime = time.Now().Format("2006-01-02 15:04")
-	}
+// WriteBatch saves the records in a single transaction
+func (b *Bolt) WriteBatch(data []Data) error {
 
-	if data.Topic == "" {
-		return fmt.Errorf("topic is empty")
+	for _, d := range data {
+		if d.Topic == "" {
+			return fmt.Errorf("topic is empty")
+		}
 	}
 
-	err := b.db.Update(func(tx *bolt.Tx) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, d := range data {
+			d = normalize(d)
 
-		b, err := tx.CreateBucketIfNotExists([]byte(data.Module))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
-		}
+			b, err := tx.CreateBucketIfNotExists([]byte(d.Module))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 
-		jdata, jerr := json.Marshal(Data{Topic: data.Topic, DateTime: data.DateTime, Value: data.Value})
-		if jerr != nil {
-			return jerr
-		}
+			key, jdata, err := encodeBolt(d)
+			if err != nil {
+				return err
+			}
 
-		return b.Put([]byte(data.Topic+"-"+data.DateTime), jdata)
+			if err = b.Put(key, jdata); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
-	if err != nil {
-		return err
-	}
-
-	// log.Printf("[DEBUG] BoltDB saved to [%s]: key: %s,\t v: %s", data.Module, key, data)
-
-	return nil
 }
 
-// View returns a map of topics and their values for the given module
+// View returns a map of topics and their values for the given module for the last 3 months
 // The map is sorted by DateTime and structured as follows: map[Topic]map[DateTime]Value
 func (b *Bolt) View(module string) (data map[string]map[string]string, err error) {
 
 	data = make(map[string]map[string]string)
 
-	// Get all the records from the bucket module
-	records, err := b.Read(module)
+	records, err := b.Range(Query{Module: module, From: time.Now().AddDate(0, -3, 0)})
 	if err != nil {
 		return nil, err
 	}
@@ -114,12 +224,147 @@ func (b *Bolt) View(module string) (data map[string]map[string]string, err error
 		if _, ok := data[d.Topic]; !ok {
 			data[d.Topic] = make(map[string]string)
 		}
-		data[d.Topic][d.DateTime] = d.Value
+		data[d.Topic][d.DateTime.Local().Format(viewLayout)] = d.Value.String()
 	}
 
 	return
 }
 
+// Range returns the records matching the query, ordered by topic and DateTime, aggregated if Step is set.
+// Records of every topic are read seeking the cursor to the From key
+func (b *Bolt) Range(q Query) ([]Data, error) {
+
+	result := []Data{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(q.Module))
+		if bucket == nil {
+			return ErrRecordNotFound
+		}
+		c := bucket.Cursor()
+
+		topics := q.Topics
+		if len(topics) == 0 {
+			topics = boltTopics(c)
+		}
+
+		for _, topic := range topics {
+			prefix := []byte(topic + "\x00")
+			start := prefix
+			if !q.From.IsZero() {
+				start = boltKey(topic, q.From)
+			}
+			var end []byte
+			if !q.To.IsZero() {
+				end = boltKey(topic, q.To)
+			}
+
+			for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if end != nil && bytes.Compare(k, end) >= 0 {
+					break
+				}
+				// raw records can be limited right away
+				if q.Step == 0 && q.Limit > 0 && len(result) >= q.Limit {
+					return nil
+				}
+				d, err := decodeBolt(k, v)
+				if err != nil {
+					return err
+				}
+				d.Module = q.Module
+				result = append(result, d)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return q.limit(Aggregate(result, q.Step, q.Agg)), nil
+}
+
+// Delete removes the records matching the query, returns the number of removed records
+func (b *Bolt) Delete(q Query) (n int64, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(q.Module))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+
+		topics := q.Topics
+		if len(topics) == 0 {
+			topics = boltTopics(c)
+		}
+
+		// keys are collected first, deleting while iterating the cursor skips records
+		var keys [][]byte
+		for _, topic := range topics {
+			prefix := []byte(topic + "\x00")
+			start := prefix
+			if !q.From.IsZero() {
+				start = boltKey(topic, q.From)
+			}
+			var end []byte
+			if !q.To.IsZero() {
+				end = boltKey(topic, q.To)
+			}
+			for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if end != nil && bytes.Compare(k, end) >= 0 {
+					break
+				}
+				keys = append(keys, append([]byte{}, k...))
+			}
+		}
+
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Topics returns sorted topics of the module
+func (b *Bolt) Topics(module string) (topics []string, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket([]byte(module)); bucket != nil {
+			topics = boltTopics(bucket.Cursor())
+		}
+		return nil
+	})
+	return topics, err
+}
+
+// Modules returns sorted modules, one per bucket
+func (b *Bolt) Modules() (modules []string, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			modules = append(modules, string(name))
+			return nil
+		})
+	})
+	return modules, err
+}
+
+// boltTopics returns the topics of the bucket, jumping over the records of every topic
+func boltTopics(c *bolt.Cursor) (topics []string) {
+	k, _ := c.First()
+	for k != nil {
+		i := bytes.IndexByte(k, 0)
+		if i < 0 {
+			k, _ = c.Next()
+			continue
+		}
+		topics = append(topics, string(k[:i]))
+		k, _ = c.Seek(append(k[:i:i], 1))
+	}
+	return topics
+}
+
 // CleanUp removes all the data from the storage
 func (b *Bolt) CleanUp() error {
 	return b.db.Update(func(tx *bolt.Tx) error {
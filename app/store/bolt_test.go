@@ -14,6 +14,7 @@ import (
 
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 var debug bool
@@ -39,9 +40,9 @@ func Test_Bolt_Store(t *testing.T) {
 
 	testData := Data{
 		Module:   "TestModuleName",
-		DateTime: time.Now().Format("2006-01-02 15:04"),
+		DateTime: time.Now().UTC().Truncate(time.Millisecond),
 		Topic:    "TestTopicString",
-		Value:    "TestValueString",
+		Value:    StringValue("TestValueString"),
 	}
 	err = s.Write(testData)
 	assert.NoError(t, err)
@@ -56,7 +57,7 @@ func Test_Bolt_Store(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Write update
-	testData.Value = "TestValueStringUpdated"
+	testData.Value = FloatValue(23.75)
 	err = s.Write(testData)
 	assert.NoError(t, err)
 
@@ -75,9 +76,9 @@ func Test_Bolt_Store(t *testing.T) {
 	// Write another record
 	rec2 := Data{
 		Module:   "TestModuleName",
-		DateTime: "2022-01-02 03:04:05",
+		DateTime: time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond),
 		Topic:    "TestTopicString2",
-		Value:    "TestValueString2",
+		Value:    BoolValue(true),
 	}
 
 	err = s.Write(rec2)
@@ -87,8 +88,68 @@ func Test_Bolt_Store(t *testing.T) {
 	viewMessages, viewErr := s.View(rec2.Module)
 	assert.NoError(t, viewErr)
 	assert.NotEmpty(t, viewMessages)
-	assert.Equal(t, testData.Value, viewMessages[testData.Topic][testData.DateTime])
-	assert.Equal(t, rec2.Value, viewMessages[rec2.Topic][rec2.DateTime])
+	assert.Equal(t, testData.Value.String(), viewMessages[testData.Topic][testData.DateTime.Local().Format(viewLayout)])
+	assert.Equal(t, rec2.Value.String(), viewMessages[rec2.Topic][rec2.DateTime.Local().Format(viewLayout)])
+
+	// Records in the same minute don't collide
+	rec3 := rec2
+	rec3.DateTime = rec2.DateTime.Add(1500 * time.Millisecond)
+	rec3.Value = BoolValue(false)
+	err = s.Write(rec3)
+	assert.NoError(t, err)
+	savedMessage, readErr = s.Read(rec2.Module)
+	assert.NoError(t, readErr)
+	assert.Contains(t, savedMessage, rec2)
+	assert.Contains(t, savedMessage, rec3)
+}
+
+func Test_Bolt_Legacy(t *testing.T) {
+
+	s, err := NewBolt(context.Background(), path.Join(tempDir(), "test_legacy.bolt"))
+	assert.NoError(t, err)
+	s.CleanUp()
+
+	// string schema record
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("cave"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("temp-2023-04-05 06:07"), []byte(`{"Topic":"temp","DateTime":"2023-04-05 06:07","Value":"23.75"}`))
+	})
+	assert.NoError(t, err)
+
+	err = s.Write(Data{Module: "cave", Topic: "heater", Value: StringValue("on")})
+	assert.NoError(t, err)
+
+	data, err := s.Read("cave")
+	assert.NoError(t, err)
+	assert.Len(t, data, 2)
+	assert.Equal(t, Data{
+		Module:   "cave",
+		DateTime: time.Date(2023, 4, 5, 6, 7, 0, 0, time.Local).UTC(),
+		Topic:    "temp",
+		Value:    FloatValue(23.75),
+	}, data[1])
+	assert.Equal(t, StringValue("on"), data[0].Value)
+
+	// string schema records are rewritten with time ordered keys
+	err = s.upgrade()
+	assert.NoError(t, err)
+	data, err = s.Range(Query{Module: "cave", Topics: []string{"temp"}, From: time.Date(2023, 4, 5, 0, 0, 0, 0, time.Local)})
+	assert.NoError(t, err)
+	assert.Len(t, data, 1)
+	assert.Equal(t, FloatValue(23.75), data[0].Value)
+}
+
+func Test_Bolt_Range(t *testing.T) {
+
+	s, err := NewBolt(context.Background(), path.Join(tempDir(), "test_range.bolt"))
+	assert.NoError(t, err)
+	s.CleanUp()
+
+	testRange(t, s)
+	testAggregate(t, s)
 
 }
 
@@ -108,7 +169,7 @@ func TestWrite(t *testing.T) {
 	N := 100
 	log.Printf("[INFO] Writing %d records", N)
 	for i := 0; i < N; i++ {
-		s.Write(Data{Module: "bench_write", DateTime: time.Now().Format("2006-01-02 15:04:05.999999999"), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: fmt.Sprintf("value %d", rand.Uint64())})
+		s.Write(Data{Module: "bench_write", DateTime: time.Now(), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: FloatValue(rand.Float64())})
 	}
 	log.Printf("[INFO] Done")
 
@@ -119,7 +180,7 @@ func TestWrite(t *testing.T) {
 		assert.NoError(t, err)
 		assert.NotEmpty(t, data)
 		for j := 0; j < N; j++ {
-			s.Write(Data{Module: "bench_write", DateTime: time.Now().Format("2006-01-02 15:04:05.999999999"), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: fmt.Sprintf("value %d", rand.Uint64())})
+			s.Write(Data{Module: "bench_write", DateTime: time.Now(), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: FloatValue(rand.Float64())})
 		}
 	}
 	log.Printf("[INFO] Done")
@@ -146,7 +207,7 @@ func TestParallelWrite(t *testing.T) {
 	go func() {
 		log.Printf("[INFO] Writing %d records", N)
 		for i := 0; i < N; i++ {
-			s.Write(Data{Module: "bench_write", DateTime: time.Now().Format("2006-01-02 15:04:05.999999999"), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: fmt.Sprintf("value %d", rand.Uint64())})
+			s.Write(Data{Module: "bench_write", DateTime: time.Now(), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: FloatValue(rand.Float64())})
 		}
 		log.Printf("[INFO] Done")
 		wg.Done()
@@ -155,7 +216,7 @@ func TestParallelWrite(t *testing.T) {
 	go func() {
 		log.Printf("[INFO] Writing %d records", N)
 		for i := 0; i < N; i++ {
-			s.Write(Data{Module: "bench_write", DateTime: time.Now().Format("2006-01-02 15:04:05.999999999"), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: fmt.Sprintf("value %d", rand.Uint64())})
+			s.Write(Data{Module: "bench_write", DateTime: time.Now(), Topic: fmt.Sprintf("topic %d", rand.Uint64()), Value: FloatValue(rand.Float64())})
 		}
 		log.Printf("[INFO] Done")
 		wg.Done()
@@ -1,12 +1,17 @@
 package store
 
-// TODO: implement the store interface
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
 type Store struct {
 	// memory store
 	// key is the module and Bolt bucket name
 	// value is the slice of Data
 	data map[string][]Data
+	mu   sync.RWMutex
 }
 
 func NewMemoryStore() *Store {
@@ -19,37 +24,127 @@ func NewMemoryStore() *Store {
 
 // Read reads records for the given module from the database
 func (s *Store) Read(module string) (data []Data, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if _, ok := s.data[module]; !ok {
 		return nil, ErrRecordNotFound
 	}
-	return s.data[module], nil
+	return append([]Data{}, s.data[module]...), nil
 }
 
-// Write writes the data to the database
+// Write writes the data to the database, the record of the same topic and time is replaced
+// as the persistent stores do
 func (s *Store) Write(data Data) error {
+	data = normalize(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if _, ok := s.data[data.Module]; !ok {
 		s.data[data.Module] = []Data{}
 	}
-	s.data[data.Module] = append(s.data[data.Module], data)
+	records := s.data[data.Module]
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Topic == data.Topic && records[i].DateTime.Equal(data.DateTime) {
+			records[i] = data
+			return nil
+		}
+	}
+	s.data[data.Module] = append(records, data)
 	return nil
 }
 
-// View returns a map of topics and their values for the given module
+// View returns a map of topics and their values for the given module for the last 3 months
 // The map is sorted by DateTime and structured as follows:
 // map[Topic]map[DateTime]Value
 func (s *Store) View(module string) (data map[string]map[string]string, err error) {
 
 	data = make(map[string]map[string]string)
 
-	// select distinct topics from module
-	for _, d := range s.data[module] {
-		data[d.Topic] = make(map[string]string)
+	records, err := s.Range(Query{Module: module, From: time.Now().AddDate(0, -3, 0)})
+	if err != nil && err != ErrRecordNotFound {
+		return nil, err
 	}
 
-	// select all records from module and fill the map
-	for _, d := range s.data[module] {
-		data[d.Topic][d.DateTime] = d.Value
+	for _, d := range records {
+		if _, ok := data[d.Topic]; !ok {
+			data[d.Topic] = make(map[string]string)
+		}
+		data[d.Topic][d.DateTime.Local().Format(viewLayout)] = d.Value.String()
 	}
 
 	return
 }
+
+// Range returns the records matching the query, ordered by topic and DateTime
+func (s *Store) Range(q Query) ([]Data, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records, ok := s.data[q.Module]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	var res []Data
+	for _, d := range records {
+		if q.match(d) {
+			res = append(res, d)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Topic != res[j].Topic {
+			return res[i].Topic < res[j].Topic
+		}
+		return res[i].DateTime.Before(res[j].DateTime)
+	})
+	return q.limit(Aggregate(res, q.Step, q.Agg)), nil
+}
+
+// Delete removes the records matching the query, returns the number of removed records
+func (s *Store) Delete(q Query) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	kept := s.data[q.Module][:0]
+	for _, d := range s.data[q.Module] {
+		if q.match(d) {
+			n++
+			continue
+		}
+		kept = append(kept, d)
+	}
+	if _, ok := s.data[q.Module]; ok {
+		s.data[q.Module] = kept
+	}
+	return n, nil
+}
+
+// Topics returns sorted topics of the module
+func (s *Store) Topics(module string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var topics []string
+	for _, d := range s.data[module] {
+		if !seen[d.Topic] {
+			seen[d.Topic] = true
+			topics = append(topics, d.Topic)
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// Modules returns sorted modules of the store
+func (s *Store) Modules() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	modules := make([]string, 0, len(s.data))
+	for m := range s.data {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+	return modules, nil
+}
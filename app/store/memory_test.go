@@ -2,6 +2,7 @@ package store
 
 import (
 	"testing"
+	"time"
 
 	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
@@ -20,9 +21,9 @@ func Test_Memory_Store(t *testing.T) {
 	// Write
 	testData := Data{
 		Module:   "Test Module",
-		DateTime: "2022-01-02 03:04:05",
+		DateTime: time.Now().UTC().Truncate(time.Millisecond),
 		Topic:    "Test Topic",
-		Value:    "Test Value",
+		Value:    StringValue("Test Value"),
 	}
 	err := s.Write(testData)
 	assert.NoError(t, err)
@@ -33,6 +34,14 @@ func Test_Memory_Store(t *testing.T) {
 	assert.NotEmpty(t, savedMessages)
 	assert.Equal(t, testData, savedMessages[0])
 
+	// Write replaces the record of the same topic and time
+	replaced := testData
+	replaced.Value = StringValue("Replaced Value")
+	assert.NoError(t, s.Write(replaced))
+	savedMessages, readErr = s.Read("Test Module")
+	assert.NoError(t, readErr)
+	assert.Equal(t, []Data{replaced}, savedMessages)
+
 	// Read not found
 	noSuchBucketMessages, noSuchBucketErr := s.Read("No Such Bucket")
 	assert.Error(t, noSuchBucketErr)
@@ -43,5 +52,65 @@ func Test_Memory_Store(t *testing.T) {
 	viewMessages, viewErr := s.View("Test Module")
 	assert.NoError(t, viewErr)
 	assert.NotEmpty(t, viewMessages)
-	assert.Equal(t, testData.Value, viewMessages[testData.Topic][testData.DateTime])
+	assert.Equal(t, replaced.Value.String(), viewMessages[testData.Topic][testData.DateTime.Local().Format(viewLayout)])
+}
+
+func Test_Memory_Range(t *testing.T) {
+	testRange(t, NewMemoryStore())
+	testAggregate(t, NewMemoryStore())
+}
+
+// testRange checks Range implementation of the Storer
+func testRange(t *testing.T, s Storer) {
+
+	_, err := s.Range(Query{Module: "range"})
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	var records []Data
+	for i := 0; i < 10; i++ {
+		for _, topic := range []string{"temp", "heater", "light"} {
+			d := Data{Module: "range", DateTime: start.Add(time.Duration(i) * time.Minute), Topic: topic, Value: FloatValue(float64(i))}
+			records = append(records, d)
+		}
+	}
+	// write in reverse order, results must be ordered anyway
+	for i := len(records) - 1; i >= 0; i-- {
+		assert.NoError(t, s.Write(records[i]))
+	}
+
+	all, err := s.Range(Query{Module: "range"})
+	assert.NoError(t, err)
+	assert.Len(t, all, 30)
+	assert.Equal(t, "heater", all[0].Topic)
+	assert.Equal(t, start, all[0].DateTime)
+	assert.Equal(t, "temp", all[29].Topic)
+	assert.Equal(t, start.Add(9*time.Minute), all[29].DateTime)
+
+	data, err := s.Range(Query{Module: "range", Topics: []string{"temp"}, From: start.Add(2 * time.Minute), To: start.Add(5 * time.Minute)})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{records[6], records[9], records[12]}, data)
+
+	data, err = s.Range(Query{Module: "range", Topics: []string{"light", "nosuchtopic"}, From: start.Add(8 * time.Minute)})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{records[26], records[29]}, data)
+
+	data, err = s.Range(Query{Module: "range", To: start.Add(time.Minute)})
+	assert.NoError(t, err)
+	assert.Len(t, data, 3)
+
+	data, err = s.Range(Query{Module: "range", Topics: []string{"temp"}, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{records[0], records[3]}, data)
+
+	topics, err := s.Topics("range")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"heater", "light", "temp"}, topics)
+
+	n, err := s.Delete(Query{Module: "range", Topics: []string{"temp", "light"}, To: start.Add(5 * time.Minute)})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	all, err = s.Range(Query{Module: "range"})
+	assert.NoError(t, err)
+	assert.Len(t, all, 20)
 }
@@ -2,70 +2,262 @@ package store
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
 )
 
-func Migrate(ctx context.Context) error {
+// Migration copies the records matching the filters from one storage to another.
+// Records are copied in chunks of time, a chunk is written in a single batch if the target supports it.
+// The progress is saved to the checkpoint file after every chunk, interrupted migration is resumed
+// from the last complete chunk.
+// The checkpoint is resumed by the migration of the same storages and filters only
+type Migration struct {
+	From, To   Storer
+	Source     string        // source storage URI, saved to the checkpoint
+	Target     string        // target storage URI, saved to the checkpoint
+	Modules    []string      // all the modules of the source if empty
+	Topics     []string      // all the topics if empty
+	Since      time.Time     // no lower bound if zero
+	Until      time.Time     // no upper bound if zero
+	Checkpoint string        // progress file name, migration is started over if empty
+	DryRun     bool          // count the records without writing anything
+	Chunk      time.Duration // time span of records copied at once, a day if zero
+}
 
-	// read 'DEBUG' flag from env
-	if os.Getenv("DEBUG") != "" {
-		// example: DEBUG=1 go test -v ./app/store -run Test_Bolt_Store
-		log.Setup(log.Debug, log.Msec, log.LevelBraces)
-		log.Printf("[WARN] Debug mode is on")
-	}
+// MigrateReport holds the record counts of a migrated module
+type MigrateReport struct {
+	Module string
+	Source int64 // records matching the filters in the source
+	Copied int64 // records written by this run
+	Target int64 // records matching the filters in the target
+}
 
-	// init sqlite storage
-	s, err := NewSQLite(ctx, "file:./store/mqttdata.db?mode=rwc")
-	if err != nil {
-		log.Fatalf("[ERROR] Failed to open SQLite storage: %e", err)
-	}
+// OK checks if the target has all the source records
+func (r MigrateReport) OK() bool {
+	return r.Source == r.Target
+}
 
-	// init bolt storage
-	b, err := NewBolt(ctx, "/mnt/ramdisk/mqttdata.bolt")
-	if err != nil {
-		log.Fatalf("[ERROR] Failed to open Bolt storage: %e", err)
+func (r MigrateReport) String() string {
+	status := "ok"
+	if !r.OK() {
+		status = "MISMATCH"
 	}
+	return fmt.Sprintf("%s: source %d, copied %d, target %d, %s", r.Module, r.Source, r.Copied, r.Target, status)
+}
 
-	// prepare bolt to receive data
-	b.CleanUp()
+// checkpoint is the migration progress saved to the file
+type checkpoint struct {
+	Scope string               `json:"scope"` // storages and filters of the migration, see Migration.scope
+	Next  map[string]time.Time `json:"next"`  // start of the next chunk by module
+	Done  map[string]bool      `json:"done"`
+}
 
-	i := 0
-	modules := [...]string{"cave"}
-	for _, m := range modules {
-		data, err := s.View(m)
-		if err != nil {
-			log.Printf("[ERROR] Failed to read data from SQLite storage: %e", err)
+// Migrate copies the records and verifies the record counts of every module.
+// The target is never cleaned up, records are written as they are
+func Migrate(ctx context.Context, m Migration) ([]MigrateReport, error) {
+	if m.Chunk <= 0 {
+		m.Chunk = 24 * time.Hour
+	}
+
+	modules := m.Modules
+	if len(modules) == 0 {
+		var err error
+		if modules, err = m.From.Modules(); err != nil {
+			return nil, fmt.Errorf("failed to list source modules: %w", err)
 		}
-		for topic, values := range data {
-			for dt, v := range values {
+	}
 
-				// truncate value to 5 chars because i'm sure there are floats that are too long
-				if len(v) > 5 {
-					v = v[:5]
-				}
+	cp, err := loadCheckpoint(m.Checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	if !m.DryRun && cp.Scope != "" && cp.Scope != m.scope() {
+		return nil, fmt.Errorf("checkpoint %s is of another migration, %s, remove it to start over", m.Checkpoint, cp.Scope)
+	}
+	cp.Scope = m.scope()
 
-				err = b.Write(Data{Module: m, DateTime: dt, Topic: topic, Value: v})
-				if err != nil {
-					log.Printf("[ERROR] Failed to write data to Bolt storage: %e", err)
+	var reports []MigrateReport
+	for _, module := range modules {
+		r := MigrateReport{Module: module}
+		if !m.DryRun && !cp.Done[module] {
+			q := m.query(module)
+			if next, ok := cp.Next[module]; ok {
+				log.Printf("[INFO] resuming %s from %s", module, next.Format(time.RFC3339))
+				q.From = next
+			}
+			err = each(m.From, q, m.Chunk, func(data []Data, next time.Time) error {
+				if len(data) > 0 {
+					if err := writeBatch(m.To, data); err != nil {
+						return fmt.Errorf("failed to write %d records: %w", len(data), err)
+					}
 				}
-
-				i++
-				if i%1000 == 0 {
-					log.Printf("[DEBUG] %d records migrated", i)
-					// os.Exit(0)
+				r.Copied += int64(len(data))
+				if !next.IsZero() {
+					cp.Next[module] = next
+					if err := saveCheckpoint(m.Checkpoint, cp); err != nil {
+						return err
+					}
 				}
-
+				log.Printf("[DEBUG] %s: %d records copied", module, r.Copied)
 				select {
 				case <-ctx.Done():
-					log.Printf("[DEBUG] Migrate cancelled")
-					return nil
+					return ctx.Err()
 				default:
 				}
+				return nil
+			})
+			if err != nil {
+				return reports, fmt.Errorf("failed to migrate %s: %w", module, err)
+			}
+			cp.Done[module] = true
+			delete(cp.Next, module)
+			if err = saveCheckpoint(m.Checkpoint, cp); err != nil {
+				return reports, err
+			}
+		}
+
+		if r.Source, err = count(m.From, m.query(module), m.Chunk); err != nil {
+			return reports, fmt.Errorf("failed to count source records of %s: %w", module, err)
+		}
+		if r.Target, err = count(m.To, m.query(module), m.Chunk); err != nil {
+			return reports, fmt.Errorf("failed to count target records of %s: %w", module, err)
+		}
+		reports = append(reports, r)
+	}
+
+	// the migration is complete, nothing to resume
+	if m.Checkpoint != "" && !m.DryRun {
+		if err := os.Remove(m.Checkpoint); err != nil && !os.IsNotExist(err) {
+			return reports, err
+		}
+	}
+	return reports, nil
+}
+
+// scope describes the storages and filters the checkpoint is valid for
+func (m Migration) scope() string {
+	bound := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprintf("%s to %s, modules %v, topics %v, since %s, until %s",
+		m.Source, m.Target, m.Modules, m.Topics, bound(m.Since), bound(m.Until))
+}
+
+// query returns the module query with migration filters
+func (m Migration) query(module string) Query {
+	return Query{Module: module, Topics: m.Topics, From: m.Since, To: m.Until}
+}
+
+// each calls fn for the records of the query in chunks of time, starting with the earliest record.
+// Next is the start of the following chunk, zero for the last one
+func each(s Storer, q Query, chunk time.Duration, fn func(data []Data, next time.Time) error) error {
+	start, ok, err := earliest(s, q)
+	if err != nil || !ok {
+		return err
+	}
+
+	now := time.Now()
+	for from := start; ; {
+		to := from.Add(chunk)
+		last := false
+		switch {
+		case !q.To.IsZero() && !to.Before(q.To):
+			to, last = q.To, true
+		case q.To.IsZero() && to.After(now):
+			// the last chunk has no upper bound
+			to, last = time.Time{}, true
+		}
+
+		data, err := s.Range(Query{Module: q.Module, Topics: q.Topics, From: from, To: to})
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return err
+		}
+		if last {
+			return fn(data, time.Time{})
+		}
+		if err = fn(data, to); err != nil {
+			return err
+		}
+		from = to
+	}
+}
+
+// count returns the number of records matching the query
+func count(s Storer, q Query, chunk time.Duration) (n int64, err error) {
+	err = each(s, q, chunk, func(data []Data, _ time.Time) error {
+		n += int64(len(data))
+		return nil
+	})
+	return n, err
+}
+
+// earliest returns the time of the earliest record of the query topics, not before the query From.
+// False if there are no such records
+func earliest(s Storer, q Query) (t time.Time, ok bool, err error) {
+	topics := q.Topics
+	if len(topics) == 0 {
+		if topics, err = s.Topics(q.Module); err != nil {
+			if errors.Is(err, ErrRecordNotFound) {
+				err = nil
 			}
+			return t, false, err
 		}
 	}
+	for _, topic := range topics {
+		data, err := s.Range(Query{Module: q.Module, Topics: []string{topic}, From: q.From, To: q.To, Limit: 1})
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return t, false, err
+		}
+		if len(data) > 0 && (!ok || data[0].DateTime.Before(t)) {
+			t, ok = data[0].DateTime, true
+		}
+	}
+	return t, ok, nil
+}
+
+func loadCheckpoint(file string) (*checkpoint, error) {
+	cp := &checkpoint{Next: map[string]time.Time{}, Done: map[string]bool{}}
+	if file == "" {
+		return cp, nil
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if err = json.Unmarshal(data, cp); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint %s: %w", file, err)
+	}
+	if cp.Next == nil {
+		cp.Next = map[string]time.Time{}
+	}
+	if cp.Done == nil {
+		cp.Done = map[string]bool{}
+	}
+	return cp, nil
+}
 
-	return nil
+// saveCheckpoint writes the progress to a temporary file and renames it, so that the checkpoint is never partial
+func saveCheckpoint(file string, cp *checkpoint) error {
+	if file == "" {
+		return nil
+	}
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(file+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return os.Rename(file+".tmp", file)
 }
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Open(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := Open(ctx, "memory:")
+	assert.NoError(t, err)
+	assert.IsType(t, &Store{}, s)
+
+	s, err = Open(ctx, "bolt://"+path.Join(tempDir(), "open.bolt"))
+	assert.NoError(t, err)
+	assert.IsType(t, &Bolt{}, s)
+	defer os.Remove(path.Join(tempDir(), "open.bolt"))
+
+	_, err = Open(ctx, "mqttdata.db")
+	assert.Error(t, err)
+	_, err = Open(ctx, "postgres:localhost")
+	assert.Error(t, err)
+}
+
+func Test_Migrate(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	from := NewMemoryStore()
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5*24; i++ {
+		dt := start.Add(time.Duration(i) * time.Hour)
+		assert.NoError(t, from.Write(Data{Module: "cave", DateTime: dt, Topic: "temp", Value: FloatValue(float64(i))}))
+		assert.NoError(t, from.Write(Data{Module: "cave", DateTime: dt, Topic: "door", Value: StringValue("open")}))
+		assert.NoError(t, from.Write(Data{Module: "probes", DateTime: dt, Topic: "ds18b20/1", Value: FloatValue(23.5)}))
+	}
+
+	file := path.Join(tempDir(), "migrate.bolt")
+	defer os.Remove(file)
+	to, err := NewBolt(ctx, file)
+	assert.NoError(t, err)
+	to.CleanUp()
+
+	cpFile := path.Join(tempDir(), "migrate.checkpoint")
+	defer os.Remove(cpFile)
+
+	// dry run doesn't write anything
+	reports, err := Migrate(ctx, Migration{From: from, To: to, DryRun: true, Checkpoint: cpFile})
+	assert.NoError(t, err)
+	assert.Equal(t, []MigrateReport{{Module: "cave", Source: 240}, {Module: "probes", Source: 120}}, reports)
+	modules, err := to.Modules()
+	assert.NoError(t, err)
+	assert.Empty(t, modules)
+	assert.NoFileExists(t, cpFile)
+
+	// filters
+	reports, err = Migrate(ctx, Migration{From: from, To: to, Modules: []string{"cave"}, Topics: []string{"temp"},
+		Since: start.Add(24 * time.Hour), Until: start.Add(48 * time.Hour), Chunk: 5 * time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, []MigrateReport{{Module: "cave", Source: 24, Copied: 24, Target: 24}}, reports)
+	assert.True(t, reports[0].OK())
+
+	// interrupted migration is resumed from the checkpoint of the same storages and filters only
+	to.CleanUp()
+	m := Migration{From: from, To: to, Source: "memory:", Target: "bolt:" + file, Checkpoint: cpFile}
+	cp := &checkpoint{Scope: m.scope(), Next: map[string]time.Time{"cave": start.Add(72 * time.Hour)}, Done: map[string]bool{"probes": true}}
+	assert.NoError(t, saveCheckpoint(cpFile, cp))
+	for _, other := range []Migration{
+		{From: from, To: to, Source: "memory:", Target: "bolt:other.bolt", Checkpoint: cpFile},
+		{From: from, To: to, Source: "memory:", Target: "bolt:" + file, Topics: []string{"temp"}, Checkpoint: cpFile},
+		{From: from, To: to, Source: "memory:", Target: "bolt:" + file, Since: start, Checkpoint: cpFile},
+	} {
+		_, err = Migrate(ctx, other)
+		assert.Error(t, err, other.scope())
+	}
+	assert.FileExists(t, cpFile)
+	reports, err = Migrate(ctx, m)
+	assert.NoError(t, err)
+	assert.Equal(t, []MigrateReport{{Module: "cave", Source: 240, Copied: 96, Target: 96}, {Module: "probes", Source: 120}}, reports)
+	assert.False(t, reports[0].OK())
+	assert.NoFileExists(t, cpFile, "checkpoint is removed after the migration")
+
+	// complete migration
+	to.CleanUp()
+	reports, err = Migrate(ctx, Migration{From: from, To: to, Checkpoint: cpFile})
+	assert.NoError(t, err)
+	for _, r := range reports {
+		assert.True(t, r.OK(), r.String())
+	}
+	data, err := to.Range(Query{Module: "cave", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	expected, err := from.Range(Query{Module: "cave", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+
+	// every chunk is written in a single batch
+	batched := &batchStore{Store: NewMemoryStore()}
+	reports, err = Migrate(ctx, Migration{From: from, To: batched})
+	assert.NoError(t, err)
+	assert.Equal(t, []MigrateReport{{Module: "cave", Source: 240, Copied: 240, Target: 240}, {Module: "probes", Source: 120, Copied: 120, Target: 120}}, reports)
+	assert.Equal(t, 10, batched.batches)
+
+	// cancelled migration keeps the checkpoint
+	to.CleanUp()
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	_, err = Migrate(cctx, Migration{From: from, To: to, Checkpoint: cpFile, Chunk: time.Hour})
+	assert.ErrorIs(t, err, context.Canceled)
+	cp, err = loadCheckpoint(cpFile)
+	assert.NoError(t, err)
+	assert.Equal(t, start.Add(time.Hour), cp.Next["cave"])
+}
+
+// batchStore counts the batches written
+type batchStore struct {
+	*Store
+	batches int
+}
+
+func (b *batchStore) WriteBatch(data []Data) error {
+	b.batches++
+	for _, d := range data {
+		if err := b.Store.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,500 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/parMaster/logserver/app/config"
+)
+
+// rollup is a resolution of rolled up records, stored in the module named with the suffix, e.g. "cave@5m"
+type rollup struct {
+	step   time.Duration
+	suffix string
+}
+
+var rollups = []rollup{{5 * time.Minute, "@5m"}, {time.Hour, "@1h"}}
+
+// ErrRollupAgg is returned for the range reaching the rolled up records with the aggregate function that can't be
+// computed of the bucket averages and last states
+var ErrRollupAgg = errors.New("aggregate function is not available for rolled up records")
+
+// IsRollup checks if the module keeps the rollups of another one, like "cave@5m" or its counts "cave@5m#n"
+func IsRollup(module string) bool {
+	for _, ru := range rollups {
+		if strings.Contains(module, ru.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// rollupChunk is the longest span of raw records rolled up at once
+const rollupChunk = 24 * time.Hour
+
+// Retention is a Storer keeping the raw records of configured modules for a limited time.
+// Raw records are rolled up into 5 minute and hourly buckets before they are pruned, records written
+// after their bucket was pruned are merged into it. Range reads the rollups for the part of the range older than the raw records retention
+type Retention struct {
+	Storer
+	policies map[string]config.Retention
+	mu       sync.Mutex
+	cursors  map[string]time.Time // next bucket to roll up, by rollup module
+	now      func() time.Time
+}
+
+func NewRetention(s Storer, policies []config.Retention) *Retention {
+	r := &Retention{
+		Storer:   s,
+		policies: map[string]config.Retention{},
+		cursors:  map[string]time.Time{},
+		now:      time.Now,
+	}
+	for _, p := range policies {
+		r.policies[p.Module] = p
+	}
+	return r
+}
+
+// keep returns the retention of the topic, topic overrides take precedence over module values
+func (r *Retention) keep(module, topic string) config.Keep {
+	p := r.policies[module]
+	k := p.Keep
+	if o, ok := p.Topics[topic]; ok {
+		if o.Raw != 0 {
+			k.Raw = o.Raw
+		}
+		if o.Rollup5m != 0 {
+			k.Rollup5m = o.Rollup5m
+		}
+		if o.Rollup1h != 0 {
+			k.Rollup1h = o.Rollup1h
+		}
+	}
+	return k
+}
+
+// cutoff returns the time records kept for d are older than, zero time if they are kept forever
+func (r *Retention) cutoff(d config.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return r.now().Add(-time.Duration(d))
+}
+
+// Modules returns the modules of the database without the rollup modules
+func (r *Retention) Modules() ([]string, error) {
+	modules, err := r.Storer.Modules()
+	if err != nil {
+		return nil, err
+	}
+	res := modules[:0]
+	for _, m := range modules {
+		if !IsRollup(m) {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+// View returns the view of the module, rollup modules are not found
+func (r *Retention) View(module string) (map[string]map[string]string, error) {
+	if IsRollup(module) {
+		return nil, ErrRecordNotFound
+	}
+	return r.Storer.View(module)
+}
+
+// Range reads raw records for the part of the range within the raw records retention and rollups before it.
+// Rollups are hourly if the query step is an hour or longer or the 5 minute rollups are already pruned.
+// Rollups keep the averages and the last states of the buckets, so only avg and last aggregates are available
+// for the range reaching them, ErrRollupAgg is returned for the others. Rollup modules are not found
+func (r *Retention) Range(q Query) ([]Data, error) {
+	if IsRollup(q.Module) {
+		return nil, ErrRecordNotFound
+	}
+	p, ok := r.policies[q.Module]
+	if !ok {
+		return r.Storer.Range(q)
+	}
+
+	// topics with the same retention are queried together
+	groups := map[config.Keep][]string{}
+	if len(p.Topics) == 0 {
+		groups[p.Keep] = q.Topics
+	} else {
+		topics := q.Topics
+		if len(topics) == 0 {
+			var err error
+			if topics, err = r.Storer.Topics(q.Module); err != nil {
+				return nil, err
+			}
+		}
+		for _, t := range topics {
+			k := r.keep(q.Module, t)
+			groups[k] = append(groups[k], t)
+		}
+	}
+
+	var res []Data
+	found := false
+	for k, topics := range groups {
+		gq := q
+		gq.Topics = topics
+		data, err := r.rangeKeep(gq, k)
+		if errors.Is(err, ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		found = true
+		res = append(res, data...)
+	}
+	if !found {
+		return nil, ErrRecordNotFound
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Topic < res[j].Topic })
+	return q.limit(res), nil
+}
+
+// rangeKeep reads the records of the topics sharing the retention
+func (r *Retention) rangeKeep(q Query, k config.Keep) ([]Data, error) {
+	rawCut := r.cutoff(k.Raw)
+	if rawCut.IsZero() || (!q.From.IsZero() && !q.From.Before(rawCut)) {
+		return r.Storer.Range(q)
+	}
+	if q.Agg != "" && q.Agg != AggAvg && q.Agg != AggLast {
+		return nil, fmt.Errorf("%w: %s", ErrRollupAgg, q.Agg)
+	}
+
+	ru := rollups[0]
+	if cut := r.cutoff(k.Rollup5m); q.Step >= time.Hour || (!cut.IsZero() && (q.From.IsZero() || q.From.Before(cut))) {
+		ru = rollups[1]
+	}
+
+	// split at the bucket boundary, so that no bucket is built of both rollups and raw records
+	step := ru.step
+	if q.Step > step {
+		step = q.Step
+	}
+	split := bucket(rawCut, step)
+	if split.Before(rawCut) {
+		split = split.Add(step)
+	}
+
+	old := q
+	old.Module, old.Limit = q.Module+ru.suffix, 0
+	if q.To.IsZero() || q.To.After(split) {
+		old.To = split
+	}
+	res, err := r.Storer.Range(old)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return nil, err
+	}
+	found := err == nil
+	for i := range res {
+		res[i].Module = q.Module
+	}
+
+	if q.To.IsZero() || q.To.After(split) {
+		recent := q
+		recent.From, recent.Limit = split, 0
+		data, err := r.Storer.Range(recent)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return nil, err
+		}
+		found = found || err == nil
+		res = append(res, data...)
+	}
+
+	if !found {
+		return nil, ErrRecordNotFound
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Topic < res[j].Topic })
+	return res, nil
+}
+
+// Run rolls up and prunes the records every interval until the context is done
+func (r *Retention) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.Apply()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Apply rolls up the raw records of the complete buckets and removes the expired records.
+// Raw records are removed only after they are rolled up
+func (r *Retention) Apply() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modules := make([]string, 0, len(r.policies))
+	for m := range r.policies {
+		modules = append(modules, m)
+	}
+	sort.Strings(modules)
+
+	var res error
+	for _, m := range modules {
+		if err := r.apply(m); err != nil {
+			log.Printf("[WARN] retention of %s failed: %v", m, err)
+			res = fmt.Errorf("retention of %s failed: %w", m, err)
+		}
+	}
+	return res
+}
+
+func (r *Retention) apply(module string) error {
+	topics, err := r.Storer.Topics(module)
+	if errors.Is(err, ErrRecordNotFound) || (err == nil && len(topics) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	now := r.now()
+	for _, ru := range rollups {
+		if err := r.rollup(module, topics, ru, bucket(now, ru.step)); err != nil {
+			return err
+		}
+	}
+
+	var removed int64
+	for _, t := range topics {
+		k := r.keep(module, t)
+		if cut := r.cutoff(k.Raw); !cut.IsZero() {
+			// whole hourly buckets are pruned, so that every bucket is sealed once
+			n, err := r.prune(module, t, bucket(cut, rollups[len(rollups)-1].step))
+			if err != nil {
+				return err
+			}
+			removed += n
+		}
+		for i, d := range []config.Duration{k.Rollup5m, k.Rollup1h} {
+			if cut := r.cutoff(d); !cut.IsZero() {
+				for _, m := range []string{module + rollups[i].suffix, module + rollups[i].suffix + countSuffix} {
+					n, err := r.Storer.Delete(Query{Module: m, Topics: []string{t}, To: cut})
+					if err != nil && !errors.Is(err, ErrRecordNotFound) {
+						return err
+					}
+					removed += n
+				}
+			}
+		}
+	}
+	if removed > 0 {
+		log.Printf("[INFO] retention: removed %d expired records of %s", removed, module)
+	}
+	return nil
+}
+
+// countSuffix names the module of the record counts of the sealed rollup buckets, e.g. "cave@5m#n"
+const countSuffix = "#n"
+
+// prune removes the raw records of the topic older than the cut. The buckets of the removed records
+// are rolled up again right before, so the records written after the bucket was rolled up, like
+// replayed or backfilled ones, are rolled up as well. Rolled up buckets of removed records are sealed
+// with the count of the records: records older than the previous cut found later are merged into
+// the sealed buckets, numeric averages are weighted by the counts, states of sealed buckets are kept.
+// Rollups and counts are written to the backend in a single batch before the records are removed,
+// a failure in between merges the records again on the next run, nothing is lost
+func (r *Retention) prune(module, topic string, cut time.Time) (removed int64, err error) {
+	db := r.backend()
+	for {
+		from, ok, err := earliest(db, Query{Module: module, Topics: []string{topic}, To: cut})
+		if err != nil || !ok {
+			return removed, err
+		}
+		from = bucket(from, rollups[len(rollups)-1].step)
+		to := from.Add(rollupChunk)
+		if to.After(cut) {
+			to = cut
+		}
+
+		q := Query{Module: module, Topics: []string{topic}, From: from, To: to}
+		raw, err := db.Range(q)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return removed, err
+		}
+		var sealed []Data
+		for _, ru := range rollups {
+			s, err := r.seal(module+ru.suffix, raw, ru.step, from, to)
+			if err != nil {
+				return removed, err
+			}
+			sealed = append(sealed, s...)
+		}
+		if err = writeBatch(db, sealed); err != nil {
+			return removed, fmt.Errorf("failed to write rollups of %s/%s: %w", module, topic, err)
+		}
+
+		n, err := db.Delete(q)
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+}
+
+// seal returns the rollups of the raw records of a topic merged into the sealed buckets of the rollup module,
+// followed by the counts to seal the buckets with
+func (r *Retention) seal(name string, raw []Data, step time.Duration, from, to time.Time) ([]Data, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	db := r.backend()
+	topic := raw[0].Topic
+	q := Query{Module: name, Topics: []string{topic}, From: from, To: to}
+	rolled, err := db.Range(q)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return nil, err
+	}
+	q.Module = name + countSuffix
+	sealed, err := db.Range(q)
+	if err != nil && !errors.Is(err, ErrRecordNotFound) {
+		return nil, err
+	}
+	prev := map[time.Time]Value{}
+	for _, d := range rolled {
+		prev[d.DateTime] = d.Value
+	}
+	counts := map[time.Time]float64{}
+	for _, d := range sealed {
+		counts[d.DateTime], _ = d.Value.Float()
+	}
+
+	data := rollupData(raw, step)
+	res := make([]Data, 0, 2*len(data))
+	var seals []Data
+	for i, c := range Aggregate(raw, step, AggCount) {
+		d := data[i]
+		d.Module = name
+		n, _ := c.Value.Float()
+		if was := counts[d.DateTime]; was > 0 {
+			if v, ok := prev[d.DateTime]; ok {
+				old, okOld := v.Float()
+				cur, okCur := d.Value.Float()
+				d.Value = v
+				if okOld && okCur && v.Kind() != KindString && d.Value.Kind() != KindString {
+					d.Value = FloatValue((old*was + cur*n) / (was + n))
+				}
+			}
+			n += was
+		}
+		res = append(res, d)
+		seals = append(seals, Data{Module: q.Module, DateTime: d.DateTime, Topic: topic, Value: FloatValue(n)})
+	}
+	return append(res, seals...), nil
+}
+
+// backend returns the storage under the write-behind buffer, rollups are written and read there
+// so that they are committed before the raw records are removed
+func (r *Retention) backend() Storer {
+	return unbuffered(r.Storer)
+}
+
+// rollup rolls up the raw records of the buckets after the previous run up to the end. The buckets
+// of the records written later are rolled up again before the records are pruned
+func (r *Retention) rollup(module string, topics []string, ru rollup, end time.Time) error {
+	name := module + ru.suffix
+	cursor, ok := r.cursors[name]
+	if !ok {
+		var err error
+		if cursor, err = r.start(module, topics, ru); err != nil {
+			return err
+		}
+	}
+
+	for cursor.Before(end) {
+		to := cursor.Add(rollupChunk)
+		if to.After(end) {
+			to = end
+		}
+		raw, err := r.backend().Range(Query{Module: module, From: cursor, To: to})
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return err
+		}
+		data := rollupData(raw, ru.step)
+		for i := range data {
+			data[i].Module = name
+		}
+		if err := writeBatch(r.backend(), data); err != nil {
+			return err
+		}
+		cursor = to
+		r.cursors[name] = cursor
+	}
+	return nil
+}
+
+// start finds the first bucket to roll up: the one after the latest rollup,
+// or the bucket of the earliest raw record if there are no rollups yet
+func (r *Retention) start(module string, topics []string, ru rollup) (time.Time, error) {
+	now := r.now()
+	for _, w := range []time.Duration{24 * time.Hour, 30 * 24 * time.Hour, 365 * 24 * time.Hour, 0} {
+		q := Query{Module: module + ru.suffix}
+		if w > 0 {
+			q.From = now.Add(-w)
+		}
+		data, err := r.Storer.Range(q)
+		if err != nil && !errors.Is(err, ErrRecordNotFound) {
+			return time.Time{}, err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		latest := data[0].DateTime
+		for _, d := range data {
+			if d.DateTime.After(latest) {
+				latest = d.DateTime
+			}
+		}
+		return latest.Add(ru.step), nil
+	}
+
+	t, ok, err := earliest(r.Storer, Query{Module: module, Topics: topics})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		t = now
+	}
+	return bucket(t, ru.step), nil
+}
+
+// rollupData aggregates the raw records into buckets of step. Numeric buckets get the average,
+// buckets of string states get the last state
+func rollupData(raw []Data, step time.Duration) []Data {
+	sort.SliceStable(raw, func(i, j int) bool {
+		if raw[i].Topic != raw[j].Topic {
+			return raw[i].Topic < raw[j].Topic
+		}
+		return raw[i].DateTime.Before(raw[j].DateTime)
+	})
+
+	avg := map[string]Data{}
+	for _, d := range Aggregate(raw, step, AggAvg) {
+		avg[d.Topic+"\x00"+d.DateTime.String()] = d
+	}
+	res := Aggregate(raw, step, AggLast)
+	for i, d := range res {
+		if a, ok := avg[d.Topic+"\x00"+d.DateTime.String()]; ok {
+			res[i] = a
+		}
+	}
+	return res
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Retention(t *testing.T) {
+
+	day := config.Duration(24 * time.Hour)
+	r := NewRetention(NewMemoryStore(), []config.Retention{{
+		Module: "cave",
+		Keep:   config.Keep{Raw: 2 * day, Rollup5m: 5 * day, Rollup1h: config.Forever},
+		Topics: map[string]config.Keep{"door": {Raw: config.Forever}},
+	}})
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(9 * 24 * time.Hour)
+	r.now = func() time.Time { return now }
+
+	// a reading every minute, every half an hour the door state
+	for i := 0; start.Add(time.Duration(i) * time.Minute).Before(now); i++ {
+		dt := start.Add(time.Duration(i) * time.Minute)
+		assert.NoError(t, r.Write(Data{Module: "cave", DateTime: dt, Topic: "temp", Value: FloatValue(float64(i % 60))}))
+		if i%30 == 0 {
+			assert.NoError(t, r.Write(Data{Module: "cave", DateTime: dt, Topic: "door", Value: StringValue(map[bool]string{true: "open", false: "closed"}[i%60 == 0])}))
+		}
+	}
+	_, err := r.Range(Query{Module: "nosuchmodule"})
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+
+	assert.NoError(t, r.Apply())
+
+	raw, err := r.Storer.Range(Query{Module: "cave", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Len(t, raw, 2*24*60)
+	assert.Equal(t, now.Add(-48*time.Hour), raw[0].DateTime)
+	door, err := r.Storer.Range(Query{Module: "cave", Topics: []string{"door"}})
+	assert.NoError(t, err)
+	assert.Len(t, door, 9*48, "door is kept forever")
+
+	hourly, err := r.Storer.Range(Query{Module: "cave@1h", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Len(t, hourly, 9*24)
+	assert.Equal(t, start, hourly[0].DateTime)
+	assert.Equal(t, FloatValue(29.5), hourly[0].Value)
+	five, err := r.Storer.Range(Query{Module: "cave@5m", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Len(t, five, 5*24*12)
+	assert.Equal(t, FloatValue(2), five[0].Value)
+	states, err := r.Storer.Range(Query{Module: "cave@1h", Topics: []string{"door"}})
+	assert.NoError(t, err)
+	assert.Equal(t, StringValue("closed"), states[0].Value, "last state of the bucket")
+
+	// hourly rollups are used for the range beyond 5 minute rollups retention
+	data, err := r.Range(Query{Module: "cave", Topics: []string{"temp"}, Step: time.Hour})
+	assert.NoError(t, err)
+	assert.Len(t, data, 9*24)
+	for _, d := range data {
+		assert.Equal(t, "cave", d.Module)
+		assert.Equal(t, FloatValue(29.5), d.Value, d.DateTime)
+	}
+
+	// 5 minute rollups and raw records
+	data, err = r.Range(Query{Module: "cave", Topics: []string{"temp"}, From: now.Add(-4 * 24 * time.Hour), Step: 5 * time.Minute})
+	assert.NoError(t, err)
+	assert.Len(t, data, 4*24*12)
+	assert.Equal(t, FloatValue(2), data[0].Value)
+	for i := 1; i < len(data); i++ {
+		assert.Equal(t, 5*time.Minute, data[i].DateTime.Sub(data[i-1].DateTime))
+	}
+
+	// raw records only
+	data, err = r.Range(Query{Module: "cave", Topics: []string{"temp"}, From: now.Add(-24 * time.Hour)})
+	assert.NoError(t, err)
+	assert.Len(t, data, 24*60)
+
+	// topics with different retention
+	data, err = r.Range(Query{Module: "cave", From: start, Step: time.Hour, Agg: AggLast})
+	assert.NoError(t, err)
+	assert.Len(t, data, 2*9*24)
+	assert.Equal(t, "door", data[0].Topic)
+	assert.Equal(t, "temp", data[len(data)-1].Topic)
+
+	// rollups are not modules of their own, aggregates of the bucket averages are refused
+	modules, err := r.Modules()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cave"}, modules)
+	_, err = r.Range(Query{Module: "cave@1h"})
+	assert.ErrorIs(t, err, ErrRecordNotFound)
+	for _, agg := range []Agg{AggCount, AggMin, AggMax, AggSum, "p95"} {
+		_, err = r.Range(Query{Module: "cave", Topics: []string{"temp"}, From: start, Step: time.Hour, Agg: agg})
+		assert.ErrorIs(t, err, ErrRollupAgg, agg)
+	}
+	data, err = r.Range(Query{Module: "cave", Topics: []string{"temp"}, From: now.Add(-time.Hour), Step: time.Hour, Agg: AggMax})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "cave", DateTime: now.Add(-time.Hour), Topic: "temp", Value: FloatValue(59)}}, data, "raw records only")
+	assert.True(t, IsRollup("cave@5m#n"))
+	assert.False(t, IsRollup("cave"))
+
+	// the next run has nothing to roll up
+	now = now.Add(time.Minute)
+	assert.NoError(t, r.Apply())
+	hourly, err = r.Storer.Range(Query{Module: "cave@1h", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Len(t, hourly, 9*24)
+}
+
+func Test_Retention_Late(t *testing.T) {
+
+	day := config.Duration(24 * time.Hour)
+	r := NewRetention(NewMemoryStore(), []config.Retention{{Module: "cave", Keep: config.Keep{Raw: 2 * day}}})
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(4 * 24 * time.Hour)
+	r.now = func() time.Time { return now }
+
+	for i := 0; start.Add(time.Duration(i) * time.Minute).Before(now); i++ {
+		assert.NoError(t, r.Write(Data{Module: "cave", DateTime: start.Add(time.Duration(i) * time.Minute), Topic: "temp", Value: FloatValue(float64(i % 60))}))
+	}
+	assert.NoError(t, r.Apply())
+	hourly := func(at time.Time) Value {
+		data, err := r.Storer.Range(Query{Module: "cave@1h", Topics: []string{"temp"}, From: at, To: at.Add(time.Hour)})
+		assert.NoError(t, err)
+		assert.Len(t, data, 1)
+		return data[0].Value
+	}
+	assert.Equal(t, FloatValue(29.5), hourly(start.Add(time.Hour)))
+
+	// backfilled record of the pruned bucket is merged into its rollup
+	assert.NoError(t, r.Write(Data{Module: "cave", DateTime: start.Add(time.Hour + 30*time.Second), Topic: "temp", Value: FloatValue(90.5)}))
+	// replayed record of the bucket rolled up, but not pruned yet
+	recent := now.Add(-48 * time.Hour)
+	assert.NoError(t, r.Write(Data{Module: "cave", DateTime: recent.Add(30 * time.Second), Topic: "temp", Value: FloatValue(90.5)}))
+
+	now = now.Add(time.Hour)
+	assert.NoError(t, r.Apply())
+	assert.Equal(t, FloatValue(30.5), hourly(start.Add(time.Hour)))
+	assert.Equal(t, FloatValue(30.5), hourly(recent))
+	raw, err := r.Storer.Range(Query{Module: "cave", Topics: []string{"temp"}, To: now.Add(-48 * time.Hour)})
+	assert.NoError(t, err)
+	assert.Empty(t, raw, "rolled up records are pruned")
+
+	// sealed bucket merges the records found later again
+	assert.NoError(t, r.Write(Data{Module: "cave", DateTime: start.Add(time.Hour + 40*time.Second), Topic: "temp", Value: FloatValue(92.5)}))
+	assert.NoError(t, r.Apply())
+	assert.Equal(t, FloatValue(31.5), hourly(start.Add(time.Hour)))
+	counts, err := r.Storer.Range(Query{Module: "cave@1h#n", Topics: []string{"temp"}, From: start.Add(time.Hour), To: start.Add(2 * time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "cave@1h#n", DateTime: start.Add(time.Hour), Topic: "temp", Value: FloatValue(62)}}, counts)
+}
+
+func Test_Retention_Batched(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := &failingStore{Store: NewMemoryStore(), broken: true}
+	day := config.Duration(24 * time.Hour)
+	r := NewRetention(NewBatcher(ctx, db, config.Batch{Size: 1000, Window: time.Hour}, func() {}), []config.Retention{{Module: "cave", Keep: config.Keep{Raw: day}}})
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(2 * 24 * time.Hour)
+	r.now = func() time.Time { return now }
+
+	for i := 0; start.Add(time.Duration(i) * time.Minute).Before(now); i++ {
+		assert.NoError(t, db.Store.Write(Data{Module: "cave", DateTime: start.Add(time.Duration(i) * time.Minute), Topic: "temp", Value: FloatValue(float64(i % 60))}))
+	}
+
+	// raw records are kept when the rollups are not written
+	assert.Error(t, r.Apply())
+	raw, err := db.Range(Query{Module: "cave", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Len(t, raw, 2*24*60)
+
+	// rollups are written to the backend, not to the buffer
+	db.setBroken(false)
+	assert.NoError(t, r.Apply())
+	hourly, err := db.Range(Query{Module: "cave@1h", Topics: []string{"temp"}, From: start, To: start.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "cave@1h", DateTime: start, Topic: "temp", Value: FloatValue(29.5)}}, hourly)
+	counts, err := db.Range(Query{Module: "cave@1h#n", Topics: []string{"temp"}, From: start, To: start.Add(time.Hour)})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "cave@1h#n", DateTime: start, Topic: "temp", Value: FloatValue(60)}}, counts)
+	raw, err = db.Range(Query{Module: "cave", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Len(t, raw, 24*60)
+	assert.Zero(t, r.Storer.(*Batcher).Stats().Pending)
+}
@@ -0,0 +1,340 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/parMaster/logserver/app/config"
+)
+
+// Spool is a Storer keeping the records failed to write in an append-only file of JSON lines.
+// Spooled records are retried in background with exponential backoff, original timestamps are kept.
+// The file survives restarts, the records left there are retried on start.
+// Writes failed to spool return the original error. The file is owned by a single process, see OpenSpool
+type Spool struct {
+	Storer
+	path                string
+	backoff, maxBackoff time.Duration
+	kick                chan struct{}
+	lock                *os.File // lock file held while the spool is open
+
+	mu    sync.Mutex // guards the file and stats
+	stats SpoolStats
+}
+
+// SpoolStats are the counters of the spool
+type SpoolStats struct {
+	Pending   int       `json:"pending"`  // records in the spool
+	Spooled   int64     `json:"spooled"`  // records spooled since start
+	Replayed  int64     `json:"replayed"` // records written from the spool since start
+	Attempts  int64     `json:"attempts"` // replay attempts
+	LastError string    `json:"last_error,omitempty"`
+	NextRetry time.Time `json:"next_retry,omitempty"`
+}
+
+// NewSpool opens the spool file and starts retrying the records until the context is done,
+// the spool is closed then
+func NewSpool(ctx context.Context, s Storer, cfg config.Spool) (*Spool, error) {
+	sp, err := OpenSpool(s, cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		sp.run(ctx)
+		if err := sp.Close(); err != nil {
+			log.Printf("[WARN] failed to close spool %s: %v", cfg.Path, err)
+		}
+	}()
+	return sp, nil
+}
+
+// OpenSpool opens the spool file without retrying the records in background, see Flush.
+// The lock file next to it is held until Close, ErrLocked is returned if another process has the spool open.
+// The storage may be set after the spool is open, it is only needed to write the records
+func OpenSpool(s Storer, cfg config.Spool) (*Spool, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("spool path is empty")
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = cfg.Backoff
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	lock, err := lockFile(cfg.Path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock spool %s: %w", cfg.Path, err)
+	}
+
+	sp := &Spool{Storer: s, path: cfg.Path, backoff: cfg.Backoff, maxBackoff: cfg.MaxBackoff, kick: make(chan struct{}, 1), lock: lock}
+	data, err := sp.read()
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to read spool %s: %w", cfg.Path, err)
+	}
+	// drop the torn line of the interrupted append, so that the next one starts on a new line
+	if err = sp.rewrite(data); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to rewrite spool %s: %w", cfg.Path, err)
+	}
+	sp.stats.Pending = len(data)
+	if len(data) > 0 {
+		log.Printf("[INFO] %d records found in spool %s", len(data), cfg.Path)
+	}
+	return sp, nil
+}
+
+// Write writes the record, it is spooled if the write fails
+func (s *Spool) Write(d Data) error {
+	err := s.Storer.Write(d)
+	if err == nil || d.Module == "" || d.Topic == "" {
+		return err
+	}
+	return s.spool([]Data{normalize(d)}, err)
+}
+
+// WriteBatch writes the records in a single transaction if the storage supports it,
+// otherwise one by one. Records failed to write are spooled
+func (s *Spool) WriteBatch(data []Data) error {
+	if err := writeBatch(s.Storer, data); err == nil {
+		return nil
+	}
+	var failed []Data
+	var err error
+	for _, d := range data {
+		if werr := s.Storer.Write(d); werr != nil {
+			if d.Module == "" || d.Topic == "" {
+				log.Printf("[ERROR] failed to write %s/%s: %v", d.Module, d.Topic, werr)
+				continue
+			}
+			failed, err = append(failed, normalize(d)), werr
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return s.spool(failed, err)
+}
+
+// spool appends the records to the file, the write error is returned if it fails
+func (s *Spool) spool(data []Data, werr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock == nil {
+		log.Printf("[ERROR] failed to spool %d records, spool is closed", len(data))
+		return werr
+	}
+	if err := appendJSON(s.path, data); err != nil {
+		log.Printf("[ERROR] failed to spool %d records: %v", len(data), err)
+		return werr
+	}
+	log.Printf("[WARN] %d records spooled, write failed: %v", len(data), werr)
+	s.stats.Pending += len(data)
+	s.stats.Spooled += int64(len(data))
+	s.stats.LastError = werr.Error()
+
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush writes the spooled records, the records failed to write again are kept in the spool
+func (s *Spool) Flush() (replayed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock == nil {
+		return 0, errors.New("spool is closed")
+	}
+
+	data, err := s.read()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read spool: %w", err)
+	}
+	s.stats.NextRetry = time.Time{}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	s.stats.Attempts++
+
+	var failed []Data
+	var werr error
+	if werr = writeBatch(s.Storer, data); werr != nil {
+		for _, d := range data {
+			if e := s.Storer.Write(d); e != nil {
+				failed, werr = append(failed, d), e
+			}
+		}
+	}
+	if err = s.rewrite(failed); err != nil {
+		// the records written are replayed again on the next flush, writes are idempotent by timestamp
+		return 0, fmt.Errorf("failed to rewrite spool: %w", err)
+	}
+
+	replayed = len(data) - len(failed)
+	s.stats.Pending = len(failed)
+	s.stats.Replayed += int64(replayed)
+	if len(failed) > 0 {
+		s.stats.LastError = werr.Error()
+		return replayed, fmt.Errorf("%d records failed to write: %w", len(failed), werr)
+	}
+	s.stats.LastError = ""
+	log.Printf("[INFO] %d spooled records written", replayed)
+	return replayed, nil
+}
+
+// Records returns the spooled records
+func (s *Spool) Records() ([]Data, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// Stats returns the counters of the spool
+func (s *Spool) Stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Close releases the lock of the spool file, records are not spooled after
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lock == nil {
+		return nil
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
+
+// run retries the spooled records with exponential backoff until the context is done
+func (s *Spool) run(ctx context.Context) {
+	backoff := s.backoff
+	for {
+		if s.Stats().Pending == 0 {
+			// wait for the records to be spooled
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.kick:
+			}
+			backoff = s.backoff
+		}
+
+		s.mu.Lock()
+		s.stats.NextRetry = time.Now().Add(backoff)
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		if _, err := s.Flush(); err != nil {
+			log.Printf("[WARN] spool replay failed: %v", err)
+			if backoff *= 2; backoff > s.maxBackoff {
+				backoff = s.maxBackoff
+			}
+			continue
+		}
+		backoff = s.backoff
+	}
+}
+
+// read returns the records of the file, called with the lock held
+func (s *Spool) read() ([]Data, error) {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []Data
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var d Data
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			log.Printf("[WARN] skipping invalid spool record at line %d: %v", line, err)
+			continue
+		}
+		res = append(res, d)
+	}
+	return res, scanner.Err()
+}
+
+// appendJSON writes the records at the end of the file and syncs it
+func appendJSON(path string, data []Data) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, d := range data {
+		if err = enc.Encode(d); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewrite replaces the file with the records, removes it if there are none, called with the lock held
+func (s *Spool) rewrite(data []Data) error {
+	if len(data) == 0 {
+		if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := appendJSON(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// FindSpool returns the spool of the storage, nil if it is not configured
+func FindSpool(s Storer) *Spool {
+	switch s := s.(type) {
+	case *Retention:
+		return FindSpool(s.Storer)
+	case *Batcher:
+		return FindSpool(s.Storer)
+	case *Spool:
+		return s
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parMaster/logserver/app/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingStore fails the writes while it is broken
+type failingStore struct {
+	*Store
+	mu     sync.Mutex
+	broken bool
+}
+
+func (f *failingStore) Write(d Data) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.broken {
+		return errors.New("database is locked")
+	}
+	return f.Store.Write(d)
+}
+
+func (f *failingStore) setBroken(broken bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.broken = broken
+}
+
+func Test_Spool(t *testing.T) {
+
+	cfg := config.Spool{Path: path.Join(t.TempDir(), "spool", "spool.jsonl")}
+	db := &failingStore{Store: NewMemoryStore(), broken: true}
+	sp, err := OpenSpool(db, cfg)
+	require.NoError(t, err)
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, sp.Write(Data{Module: "cave", DateTime: start, Topic: "temp", Value: FloatValue(21)}))
+	assert.NoError(t, sp.WriteBatch([]Data{
+		{Module: "cave", DateTime: start.Add(time.Minute), Topic: "temp", Value: FloatValue(22)},
+		{Module: "cave", DateTime: start.Add(time.Minute), Topic: "heater", Value: BoolValue(true)},
+	}))
+	assert.Error(t, sp.Write(Data{Module: "cave", Value: FloatValue(1)}), "invalid records are not spooled")
+
+	stats := sp.Stats()
+	assert.Equal(t, 3, stats.Pending)
+	assert.Equal(t, int64(3), stats.Spooled)
+	assert.Equal(t, "database is locked", stats.LastError)
+
+	n, err := sp.Flush()
+	assert.Error(t, err)
+	assert.Zero(t, n)
+	assert.Equal(t, 3, sp.Stats().Pending)
+
+	// spool is owned by a single process until closed
+	_, err = OpenSpool(db, cfg)
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.NoError(t, sp.Close())
+	assert.Error(t, sp.Write(Data{Module: "cave", DateTime: start, Topic: "temp", Value: FloatValue(21)}), "closed spool keeps nothing")
+	_, err = sp.Flush()
+	assert.Error(t, err)
+
+	// spool survives restart, torn last line is dropped
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND, 0o640)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"module":"cave","date`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	sp, err = OpenSpool(db, cfg)
+	require.NoError(t, err)
+	defer sp.Close()
+	records, err := sp.Records()
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.True(t, start.Equal(records[0].DateTime))
+	assert.Equal(t, FloatValue(21), records[0].Value)
+
+	// records keep the original timestamps
+	db.setBroken(false)
+	n, err = sp.Flush()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	data, err := db.Range(Query{Module: "cave", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	require.Len(t, data, 2)
+	assert.True(t, start.Equal(data[0].DateTime))
+	assert.Equal(t, int64(3), sp.Stats().Replayed)
+	assert.Zero(t, sp.Stats().Pending)
+	assert.Empty(t, sp.Stats().LastError)
+	_, err = os.Stat(cfg.Path)
+	assert.True(t, os.IsNotExist(err), "flushed spool is removed")
+}
+
+func Test_Spool_Retry(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db := &failingStore{Store: NewMemoryStore(), broken: true}
+	sp, err := NewSpool(ctx, db, config.Spool{Path: path.Join(t.TempDir(), "spool.jsonl"), Backoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	require.NoError(t, err)
+	assert.Equal(t, sp, FindSpool(NewRetention(NewBatcher(ctx, sp, config.Batch{}, func() {}), nil)))
+	assert.Nil(t, FindSpool(db))
+
+	assert.NoError(t, sp.Write(Data{Module: "cave", Topic: "temp", Value: FloatValue(21)}))
+	assert.Eventually(t, func() bool { return sp.Stats().Attempts >= 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, 1, sp.Stats().Pending)
+	assert.False(t, sp.Stats().NextRetry.IsZero())
+
+	db.setBroken(false)
+	assert.Eventually(t, func() bool { return sp.Stats().Pending == 0 }, time.Second, time.Millisecond)
+	topics, err := db.Topics("cave")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"temp"}, topics)
+}
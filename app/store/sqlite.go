@@ -5,20 +5,44 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// SQLiteStorage keeps the records in two tables: series of module and topic pairs
+// and points keyed by the series id and unix milliseconds timestamp
 type SQLiteStorage struct {
-	DB            *sql.DB
-	ctx           context.Context
-	activeModules map[string]bool
+	DB     *sql.DB
+	ctx    context.Context
+	stmt   sqliteStatements
+	series map[string]int64 // series id by module and topic
+	mu     sync.Mutex       // guards series
 }
 
+type sqliteStatements struct {
+	insertSeries, selectSeries, moduleSeries, modules *sql.Stmt
+	insertPoint, selectPoints, deletePoints           *sql.Stmt
+	aggregate                                         map[Agg]*sql.Stmt
+}
+
+// sqliteAggregates are the aggregate functions computed in SQL, strings are not numbers and only counted
+var sqliteAggregates = map[Agg]string{
+	AggAvg:   "AVG(num)",
+	AggMin:   "MIN(num)",
+	AggMax:   "MAX(num)",
+	AggSum:   "SUM(num)",
+	AggCount: "COUNT(*)",
+}
+
+// NewSQLite opens the database and applies schema migrations
 func NewSQLite(ctx context.Context, path string) (*SQLiteStorage, error) {
 
-	sqliteDatabase, err := sql.Open("sqlite3", path)
+	sqliteDatabase, err := sql.Open("sqlite3", sqliteDSN(path))
 	if err != nil {
 		return nil, err
 	}
@@ -28,49 +52,206 @@ func NewSQLite(ctx context.Context, path string) (*SQLiteStorage, error) {
 		sqliteDatabase.Close()
 	}()
 
-	return &SQLiteStorage{DB: sqliteDatabase, ctx: ctx, activeModules: make(map[string]bool)}, nil
+	s := &SQLiteStorage{DB: sqliteDatabase, ctx: ctx, series: make(map[string]int64)}
+	if err = s.migrate(); err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
+	if err = s.prepare(); err != nil {
+		return nil, fmt.Errorf("failed to prepare statements: %w", err)
+	}
+	return s, nil
 }
 
-func (s *SQLiteStorage) Write(d Data) error {
+// sqliteDSN adds connection parameters to the path: WAL journal for file databases,
+// busy timeout and write lock taken by transactions right away
+func sqliteDSN(path string) string {
+	params := []string{"_busy_timeout=5000", "_txlock=immediate"}
+	if !strings.Contains(path, "mode=ro") && !strings.Contains(path, "mode=memory") && !strings.Contains(path, ":memory:") {
+		params = append(params, "_journal_mode=WAL")
+	}
+	if strings.Contains(path, "?") {
+		return path + "&" + strings.Join(params, "&")
+	}
+	return path + "?" + strings.Join(params, "&")
+}
 
-	if ok, err := s.moduleActive(d.Module); err != nil || !ok {
-		return err
+func (s *SQLiteStorage) prepare() (err error) {
+	prepare := func(q string) *sql.Stmt {
+		if err != nil {
+			return nil
+		}
+		var stmt *sql.Stmt
+		stmt, err = s.DB.PrepareContext(s.ctx, q)
+		return stmt
 	}
 
-	if d.DateTime == "" {
-		d.DateTime = time.Now().Format("2006-01-02 15:04")
+	s.stmt.insertSeries = prepare("INSERT OR IGNORE INTO series (module, topic) VALUES (?, ?)")
+	s.stmt.selectSeries = prepare("SELECT id FROM series WHERE module = ? AND topic = ?")
+	s.stmt.moduleSeries = prepare("SELECT id, topic FROM series WHERE module = ? ORDER BY topic")
+	s.stmt.modules = prepare("SELECT DISTINCT module FROM series ORDER BY module")
+	s.stmt.insertPoint = prepare("INSERT OR REPLACE INTO points (series_id, ts, kind, num, text) VALUES (?, ?, ?, ?, ?)")
+	s.stmt.selectPoints = prepare("SELECT ts, kind, num, text FROM points WHERE series_id = ? AND ts >= ? AND ts < ? ORDER BY ts LIMIT ?")
+	s.stmt.deletePoints = prepare("DELETE FROM points WHERE series_id = ? AND ts >= ? AND ts < ?")
+	s.stmt.aggregate = map[Agg]*sql.Stmt{}
+	for agg, fn := range sqliteAggregates {
+		s.stmt.aggregate[agg] = prepare("SELECT ts - ts % ? AS bucket, " + fn +
+			" FROM points WHERE series_id = ? AND ts >= ? AND ts < ? GROUP BY bucket ORDER BY bucket LIMIT ?")
 	}
+	return err
+}
 
+// Write writes the record, the record of the same topic and time is replaced
+func (s *SQLiteStorage) Write(d Data) error {
+
+	if d.Module == "" {
+		return errors.New("module name is empty")
+	}
 	if d.Topic == "" {
 		return errors.New("topic is empty")
 	}
 
-	q := fmt.Sprintf("INSERT INTO `%s` VALUES ($1, $2, $3)", d.Module)
+	d = normalize(d)
 
-	_, err := s.DB.ExecContext(s.ctx, q, d.DateTime, d.Topic, d.Value)
+	id, err := s.seriesID(d.Module, d.Topic)
+	if err != nil {
+		return err
+	}
+	kind, num, text := sqliteValue(d.Value)
+	_, err = s.stmt.insertPoint.ExecContext(s.ctx, id, d.DateTime.UnixMilli(), kind, num, text)
 	return err
 }
 
-// Read reads records for the given module from the database
-func (s *SQLiteStorage) Read(module string) (data []Data, err error) {
+// WriteBatch writes the records in a single transaction
+func (s *SQLiteStorage) WriteBatch(data []Data) error {
 
-	q := fmt.Sprintf("SELECT * FROM `%s`", module)
-	rows, err := s.DB.QueryContext(s.ctx, q)
+	// series are created before the transaction, it holds the write lock
+	ids := make([]int64, len(data))
+	for i, d := range data {
+		if d.Module == "" {
+			return errors.New("module name is empty")
+		}
+		if d.Topic == "" {
+			return errors.New("topic is empty")
+		}
+		id, err := s.seriesID(d.Module, d.Topic)
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+
+	tx, err := s.DB.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := tx.StmtContext(s.ctx, s.stmt.insertPoint)
+	for i, d := range data {
+		d = normalize(d)
+		kind, num, text := sqliteValue(d.Value)
+		if _, err = stmt.ExecContext(s.ctx, ids[i], d.DateTime.UnixMilli(), kind, num, text); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// seriesID returns the id of the module and topic series, the series is created if it doesn't exist
+func (s *SQLiteStorage) seriesID(module, topic string) (int64, error) {
+	key := module + "\x00" + topic
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.series[key]; ok {
+		return id, nil
+	}
+	if _, err := s.stmt.insertSeries.ExecContext(s.ctx, module, topic); err != nil {
+		return 0, err
+	}
+	var id int64
+	if err := s.stmt.selectSeries.QueryRowContext(s.ctx, module, topic).Scan(&id); err != nil {
+		return 0, err
+	}
+	s.series[key] = id
+	return id, nil
+}
+
+// sqliteValue returns the columns of the value: kind, number for floats and bools, text for strings
+func sqliteValue(v Value) (Kind, interface{}, interface{}) {
+	if f, ok := v.Float(); ok {
+		return v.Kind(), f, nil
+	}
+	return v.Kind(), nil, v.String()
+}
+
+// scanValue converts the scanned value columns
+func scanValue(kind Kind, num sql.NullFloat64, text sql.NullString) Value {
+	switch kind {
+	case KindFloat:
+		return FloatValue(num.Float64)
+	case KindBool:
+		return BoolValue(num.Float64 != 0)
+	}
+	return StringValue(text.String)
+}
+
+type sqliteSeries struct {
+	id    int64
+	topic string
+}
+
+// moduleSeries returns the series of the module topics ordered by topic, all the topics if none is given.
+// ErrRecordNotFound is returned if the module has no series
+func (s *SQLiteStorage) moduleSeries(module string, topics []string) ([]sqliteSeries, error) {
+	rows, err := s.stmt.moduleSeries.QueryContext(s.ctx, module)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	found := false
+	var series []sqliteSeries
 	for rows.Next() {
-		d := Data{Module: module}
-		err = rows.Scan(&d.DateTime, &d.Topic, &d.Value)
-		if err != nil {
+		var ss sqliteSeries
+		if err = rows.Scan(&ss.id, &ss.topic); err != nil {
 			return nil, err
 		}
-		data = append(data, d)
+		found = true
+		if (Query{Topics: topics}).match(Data{Topic: ss.topic}) {
+			series = append(series, ss)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrRecordNotFound
 	}
+	return series, nil
+}
 
-	return
+// bounds returns the query time bounds in unix milliseconds
+func (q Query) bounds() (from, to int64) {
+	from, to = math.MinInt64, math.MaxInt64
+	if !q.From.IsZero() {
+		from = q.From.UnixMilli()
+	}
+	if !q.To.IsZero() {
+		to = q.To.UnixMilli()
+	}
+	return from, to
+}
+
+// Read reads records for the given module from the database, ordered by DateTime
+func (s *SQLiteStorage) Read(module string) (data []Data, err error) {
+	data, err = s.Range(Query{Module: module})
+	if err != nil {
+		return nil, err
+	}
+	sortByTime(data)
+	return data, nil
 }
 
 // View returns a map of topics and their values for the given module
@@ -78,70 +259,194 @@ func (s *SQLiteStorage) Read(module string) (data []Data, err error) {
 // map[Topic]map[DateTime]Value
 func (s *SQLiteStorage) View(module string) (data map[string]map[string]string, err error) {
 
-	data = make(map[string]map[string]string)
-
-	// select distinct topics from module
-	q := fmt.Sprintf("SELECT DISTINCT Topic FROM `%s`", module)
-	rows, err := s.DB.QueryContext(s.ctx, q)
+	series, err := s.moduleSeries(module, nil)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var topic string
-		err = rows.Scan(&topic)
+	// records of the last 3 months averaged by minute, local time
+	data = make(map[string]map[string]string)
+	from := time.Now().AddDate(0, -3, 0)
+	for _, ss := range series {
+		data[ss.topic] = make(map[string]string)
+		rows, err := s.stmt.aggregate[AggAvg].QueryContext(s.ctx, time.Minute.Milliseconds(), ss.id, from.UnixMilli(), int64(math.MaxInt64), -1)
 		if err != nil {
 			return nil, err
 		}
-		data[topic] = make(map[string]string)
+		for rows.Next() {
+			var minute int64
+			var avg sql.NullFloat64
+			if err = rows.Scan(&minute, &avg); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if avg.Valid {
+				data[ss.topic][time.UnixMilli(minute).Local().Format("2006-01-02 15:04")] = FloatValue(math.Round(avg.Float64*100) / 100).String()
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
 	}
 
-	// select all records from module and fill the map
-	q = fmt.Sprintf("SELECT DateTime, Topic, ROUND(AVG(Value), 2) FROM `%s` WHERE DateTime > '%s' GROUP BY DateTime, Topic order by DateTime", module, time.Now().AddDate(0, -3, 0).Format("2006-01-02 15:04"))
-	rows, err = s.DB.QueryContext(s.ctx, q)
+	return data, nil
+}
+
+// Range returns the records matching the query, ordered by topic and DateTime, aggregated if Step is set.
+// Aggregate functions available in SQL are computed by the database
+func (s *SQLiteStorage) Range(q Query) (data []Data, err error) {
+
+	series, err := s.moduleSeries(q.Module, q.Topics)
 	if err != nil {
 		return nil, err
 	}
+	from, to := q.bounds()
 
-	for rows.Next() {
-		d := Data{Module: module}
-		err = rows.Scan(&d.DateTime, &d.Topic, &d.Value)
+	agg := q.Agg
+	if agg == "" {
+		agg = AggAvg
+	}
+	stmt, inSQL := s.stmt.aggregate[agg]
+	inSQL = inSQL && q.Step >= time.Millisecond && q.Step%time.Millisecond == 0
+
+	for _, ss := range series {
+		limit := -1 // no limit
+		if q.Limit > 0 {
+			if limit = q.Limit - len(data); limit <= 0 {
+				break
+			}
+		}
+
+		if inSQL {
+			rows, err := stmt.QueryContext(s.ctx, q.Step.Milliseconds(), ss.id, from, to, limit)
+			if err != nil {
+				return nil, err
+			}
+			for rows.Next() {
+				var b int64
+				var val sql.NullFloat64
+				if err = rows.Scan(&b, &val); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				// bucket without numeric values
+				if !val.Valid {
+					continue
+				}
+				data = append(data, Data{Module: q.Module, DateTime: time.UnixMilli(b).UTC(), Topic: ss.topic, Value: FloatValue(val.Float64)})
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if q.Step > 0 {
+			limit = -1 // limit the buckets, not the records
+		}
+		raw, err := s.points(q.Module, ss, from, to, limit)
 		if err != nil {
 			return nil, err
 		}
-		data[d.Topic][d.DateTime] = d.Value
+		data = append(data, Aggregate(raw, q.Step, q.Agg)...)
 	}
 
-	return
+	return q.limit(data), nil
 }
 
-// Check if the table exists, create if not. Cache the result in the map
-func (s *SQLiteStorage) moduleActive(module string) (bool, error) {
-
-	if module == "" {
-		return false, errors.New("module name is empty")
+// points returns the records of the series within the bounds
+func (s *SQLiteStorage) points(module string, ss sqliteSeries, from, to int64, limit int) (data []Data, err error) {
+	rows, err := s.stmt.selectPoints.QueryContext(s.ctx, ss.id, from, to, limit)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	if s.activeModules[module] {
-		return true, nil
+	for rows.Next() {
+		var ts int64
+		var kind Kind
+		var num sql.NullFloat64
+		var text sql.NullString
+		if err = rows.Scan(&ts, &kind, &num, &text); err != nil {
+			return nil, err
+		}
+		data = append(data, Data{Module: module, DateTime: time.UnixMilli(ts).UTC(), Topic: ss.topic, Value: scanValue(kind, num, text)})
 	}
+	return data, rows.Err()
+}
 
-	if _, ok := s.activeModules[module]; !ok {
-		q := fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` (DateTime TEXT, Topic TEXT, Value TEXT)", module)
-		_, err := s.DB.ExecContext(s.ctx, q)
+// Delete removes the records matching the query, returns the number of removed records
+func (s *SQLiteStorage) Delete(q Query) (n int64, err error) {
+	series, err := s.moduleSeries(q.Module, q.Topics)
+	if errors.Is(err, ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	from, to := q.bounds()
+	for _, ss := range series {
+		res, err := s.stmt.deletePoints.ExecContext(s.ctx, ss.id, from, to)
 		if err != nil {
-			return false, err
+			return n, err
 		}
-		s.activeModules[module] = true
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return n, err
+		}
+		n += rows
 	}
+	return n, nil
+}
 
-	return true, nil
+// Topics returns sorted topics of the module
+func (s *SQLiteStorage) Topics(module string) (topics []string, err error) {
+	series, err := s.moduleSeries(module, nil)
+	if errors.Is(err, ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, ss := range series {
+		topics = append(topics, ss.topic)
+	}
+	return topics, nil
 }
 
-// Cleanup removes the table for the given module
+// Modules returns sorted modules
+func (s *SQLiteStorage) Modules() (modules []string, err error) {
+	rows, err := s.stmt.modules.QueryContext(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var module string
+		if err = rows.Scan(&module); err != nil {
+			return nil, err
+		}
+		modules = append(modules, module)
+	}
+	return modules, rows.Err()
+}
+
+// Cleanup removes the series and records of the given module
 func (s *SQLiteStorage) Cleanup(module string) {
-	q := fmt.Sprintf("DROP TABLE `%s`", module)
-	s.DB.Exec(q)
-	delete(s.activeModules, module)
+	s.DB.Exec("DELETE FROM points WHERE series_id IN (SELECT id FROM series WHERE module = ?)", module)
+	s.DB.Exec("DELETE FROM series WHERE module = ?", module)
+	s.mu.Lock()
+	for key := range s.series {
+		if strings.HasPrefix(key, module+"\x00") {
+			delete(s.series, key)
+		}
+	}
+	s.mu.Unlock()
+}
+
+// sortByTime orders the records by DateTime, records of the same time keep their order
+func sortByTime(data []Data) {
+	sort.SliceStable(data, func(i, j int) bool { return data[i].DateTime.Before(data[j].DateTime) })
 }
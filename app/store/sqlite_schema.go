@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// sqliteMigrations upgrade the schema, one version each. The schema version is kept in user_version pragma,
+// pending migrations are applied on open in a single transaction
+var sqliteMigrations = []func(ctx context.Context, tx *sql.Tx) error{
+	sqliteSeriesSchema, // 1
+}
+
+// migrate applies pending schema migrations
+func (s *SQLiteStorage) migrate() error {
+	tx, err := s.DB.BeginTx(s.ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err = tx.QueryRowContext(s.ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= len(sqliteMigrations) {
+		return nil
+	}
+
+	for v := version; v < len(sqliteMigrations); v++ {
+		log.Printf("[INFO] migrating SQLite schema to version %d", v+1)
+		if err = sqliteMigrations[v](s.ctx, tx); err != nil {
+			return fmt.Errorf("migration to version %d failed: %w", v+1, err)
+		}
+	}
+	if _, err = tx.ExecContext(s.ctx, fmt.Sprintf("PRAGMA user_version = %d", len(sqliteMigrations))); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sqliteSeriesSchema creates series and points tables and moves the records of table-per-module schema there
+func sqliteSeriesSchema(ctx context.Context, tx *sql.Tx) error {
+	var legacy []string
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, q := range []string{
+		`CREATE TABLE series (
+			id INTEGER PRIMARY KEY,
+			module TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			metadata TEXT NOT NULL DEFAULT '{}',
+			UNIQUE (module, topic)
+		)`,
+		`CREATE TABLE points (
+			series_id INTEGER NOT NULL REFERENCES series (id),
+			ts INTEGER NOT NULL,
+			kind INTEGER NOT NULL,
+			num REAL,
+			text TEXT,
+			PRIMARY KEY (series_id, ts)
+		) WITHOUT ROWID`,
+	} {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	for _, module := range legacy {
+		c, err := sqliteConvertTable(ctx, tx, module)
+		if err != nil {
+			return fmt.Errorf("failed to convert table %s: %w", module, err)
+		}
+		log.Printf("[INFO] converted %d records of %s", c.records, module)
+		if c.moved > 0 {
+			log.Printf("[WARN] %d records of %s shared the time with another record of the topic, moved by milliseconds within the minute", c.moved, module)
+		}
+		if c.dropped > 0 {
+			log.Printf("[WARN] %d records of %s dropped, no free millisecond left in their minute", c.dropped, module)
+		}
+	}
+	return nil
+}
+
+// sqliteConversion counts the converted records of the module table
+type sqliteConversion struct {
+	records int // records converted
+	moved   int // records moved to the next free millisecond of the minute
+	dropped int // records without a free millisecond in the minute
+}
+
+// sqliteConvertTable moves the records of the module table to series and points and drops the table.
+// String schema records have minute resolution, so a topic has many records of the same time. Records are
+// streamed in the order of the table, a record of the taken time is moved to the next free millisecond
+// of its minute, the order of the records within the minute is kept
+func sqliteConvertTable(ctx context.Context, tx *sql.Tx, module string) (c sqliteConversion, err error) {
+	table := "`" + strings.ReplaceAll(module, "`", "``") + "`"
+
+	insertSeries, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO series (module, topic) VALUES (?, ?)")
+	if err != nil {
+		return c, err
+	}
+	defer insertSeries.Close()
+	selectSeries, err := tx.PrepareContext(ctx, "SELECT id FROM series WHERE module = ? AND topic = ?")
+	if err != nil {
+		return c, err
+	}
+	defer selectSeries.Close()
+	insertPoint, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO points (series_id, ts, kind, num, text) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return c, err
+	}
+	defer insertPoint.Close()
+	lastPoint, err := tx.PrepareContext(ctx, "SELECT MAX(ts) FROM points WHERE series_id = ? AND ts >= ? AND ts < ?")
+	if err != nil {
+		return c, err
+	}
+	defer lastPoint.Close()
+
+	insert := func(id, ts int64, kind Kind, num, text interface{}) (bool, error) {
+		res, err := insertPoint.ExecContext(ctx, id, ts, kind, num, text)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n > 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT DateTime, Topic, Value FROM "+table+" ORDER BY rowid")
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+
+	series := map[string]int64{}
+	for rows.Next() {
+		var dt, topic string
+		var val interface{}
+		if err = rows.Scan(&dt, &topic, &val); err != nil {
+			return c, err
+		}
+		ts, v, err := scanLegacySQLite(dt, val)
+		if err != nil {
+			return c, err
+		}
+
+		id, ok := series[topic]
+		if !ok {
+			if _, err = insertSeries.ExecContext(ctx, module, topic); err != nil {
+				return c, err
+			}
+			if err = selectSeries.QueryRowContext(ctx, module, topic).Scan(&id); err != nil {
+				return c, err
+			}
+			series[topic] = id
+		}
+
+		kind, num, text := sqliteValue(v)
+		ms := ts.UnixMilli()
+		inserted, err := insert(id, ms, kind, num, text)
+		if err != nil {
+			return c, err
+		}
+		if !inserted {
+			// the time is taken, the next millisecond after the last record of the minute is tried
+			end := ts.Truncate(time.Minute).Add(time.Minute).UnixMilli()
+			var last sql.NullInt64
+			if err = lastPoint.QueryRowContext(ctx, id, ms, end).Scan(&last); err != nil {
+				return c, err
+			}
+			if last.Valid && last.Int64+1 < end {
+				if inserted, err = insert(id, last.Int64+1, kind, num, text); err != nil {
+					return c, err
+				}
+			}
+			if !inserted {
+				c.dropped++
+				continue
+			}
+			c.moved++
+		}
+		c.records++
+	}
+	if err = rows.Err(); err != nil {
+		return c, err
+	}
+	rows.Close()
+
+	_, err = tx.ExecContext(ctx, "DROP TABLE "+table)
+	return c, err
+}
+
+// sqliteLayout is the DateTime format of table-per-module records written in UTC,
+// string schema records have DateTime formatted as "2006-01-02 15:04" in local time
+const sqliteLayout = "2006-01-02 15:04:05.000"
+
+// scanLegacySQLite converts the columns of table-per-module records
+func scanLegacySQLite(dt string, val interface{}) (t time.Time, v Value, err error) {
+	// only UTC records have milliseconds
+	if len(dt) == len(sqliteLayout) {
+		t, err = time.Parse(sqliteLayout, dt)
+	} else {
+		t, err = parseLegacyTime(dt)
+	}
+	if err != nil {
+		return t, v, err
+	}
+
+	switch val := val.(type) {
+	case float64:
+		v = FloatValue(val)
+	case int64:
+		v = FloatValue(float64(val))
+	case []byte:
+		v = ParseValue(string(val))
+	case string:
+		v = ParseValue(val)
+	case nil:
+		v = StringValue("")
+	default:
+		return t, v, fmt.Errorf("unsupported value %v", val)
+	}
+	return normalize(Data{DateTime: t}).DateTime, v, nil
+}
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"log"
 	"os"
@@ -35,9 +36,9 @@ func Test_Sqlite_Store(t *testing.T) {
 
 	testRecord := Data{
 		Module:   "testModule",
-		DateTime: "2019-01-01 00:00",
+		DateTime: time.Date(2019, 1, 1, 0, 0, 0, 123000000, time.UTC),
 		Topic:    "testTopic",
-		Value:    "testValue",
+		Value:    StringValue("testValue"),
 	}
 
 	store.Cleanup(testRecord.Module)
@@ -52,13 +53,14 @@ func Test_Sqlite_Store(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, data[0], testRecord)
 
-	// write another record
+	// the record of the same topic and time is replaced
+	testRecord.Value = FloatValue(23.75)
 	err = store.Write(testRecord)
 	assert.Nil(t, err)
 	data, err = store.Read(testRecord.Module)
-	assert.Equal(t, 2, len(data))
+	assert.Equal(t, 1, len(data))
 	assert.Nil(t, err)
-	assert.Equal(t, data[1], testRecord)
+	assert.Equal(t, data[0], testRecord)
 
 	// test if the module is not active (no such table)
 	data, err = store.Read("notable")
@@ -66,25 +68,40 @@ func Test_Sqlite_Store(t *testing.T) {
 	assert.Error(t, err)
 
 	// empty topic is not allowed
-	err = store.Write(Data{Module: "testModule", Topic: "", Value: "testValue"})
+	err = store.Write(Data{Module: "testModule", Topic: "", Value: StringValue("testValue")})
 	assert.Error(t, err)
 
 	// empty value is allowed
-	err = store.Write(Data{Module: "testModule", Topic: "testTopic", Value: ""})
+	err = store.Write(Data{Module: "testModule", Topic: "testTopic", Value: StringValue("")})
 	assert.NoError(t, err)
 
 	// Test if the date time is set to the current time if it is not set.
-	dt := time.Now().Format("2006-01-02 15:04")
-	err = store.Write(Data{Module: "testModule", Topic: "testTopic", Value: "testValue"})
+	dt := time.Now()
+	err = store.Write(Data{Module: "testModule", Topic: "testTopic", Value: StringValue("testValue")})
 	assert.NoError(t, err)
 	savedValues, err := store.Read("testModule")
 	assert.NoError(t, err)
-	assert.Equal(t, dt, savedValues[len(savedValues)-1].DateTime)
+	assert.WithinDuration(t, dt, savedValues[len(savedValues)-1].DateTime, time.Second)
+	assert.Equal(t, time.UTC, savedValues[len(savedValues)-1].DateTime.Location())
+
+	// typed values
+	typed := []Data{
+		{Module: "testModule", DateTime: dt.Add(time.Millisecond).UTC().Truncate(time.Millisecond), Topic: "float", Value: FloatValue(23.75)},
+		{Module: "testModule", DateTime: dt.Add(2 * time.Millisecond).UTC().Truncate(time.Millisecond), Topic: "bool", Value: BoolValue(true)},
+	}
+	for _, d := range typed {
+		err = store.Write(d)
+		assert.NoError(t, err)
+	}
+	savedValues, err = store.Read("testModule")
+	assert.NoError(t, err)
+	assert.Equal(t, typed, savedValues[len(savedValues)-2:])
 
 	v, _ := store.Read("testModule")
 	n := 100
 	// n records
 	for i := 0; i < n; i++ {
+		testRecord.DateTime = testRecord.DateTime.Add(time.Second)
 		err = store.Write(testRecord)
 		assert.NoError(t, err)
 	}
@@ -103,13 +120,16 @@ func Test_SqliteStorage_View(t *testing.T) {
 		log.Printf("[ERROR] Failed to open SQLite storage: %e", err)
 	}
 
+	y, m, d := time.Now().Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, time.Local)
 	records := []Data{
-		{Module: "view", DateTime: time.Now().Format("2006-01-02") + " 00:00", Topic: "temp", Value: "36000"},
-		{Module: "view", DateTime: time.Now().Format("2006-01-02") + " 00:01", Topic: "temp", Value: "36100"},
-		{Module: "view", DateTime: time.Now().Format("2006-01-02") + " 00:02", Topic: "temp", Value: "36200"},
-		{Module: "view", DateTime: time.Now().Format("2006-01-02") + " 00:00", Topic: "rpm", Value: "100"},
-		{Module: "view", DateTime: time.Now().Format("2006-01-02") + " 00:01", Topic: "rpm", Value: "200"},
-		{Module: "view", DateTime: time.Now().Format("2006-01-02") + " 00:02", Topic: "rpm", Value: "300"},
+		{Module: "view", DateTime: midnight, Topic: "temp", Value: FloatValue(36000)},
+		{Module: "view", DateTime: midnight.Add(time.Minute), Topic: "temp", Value: FloatValue(36100)},
+		{Module: "view", DateTime: midnight.Add(2 * time.Minute), Topic: "temp", Value: FloatValue(36200)},
+		{Module: "view", DateTime: midnight.Add(2*time.Minute + 30*time.Second), Topic: "temp", Value: FloatValue(36300)},
+		{Module: "view", DateTime: midnight, Topic: "rpm", Value: FloatValue(100)},
+		{Module: "view", DateTime: midnight.Add(time.Minute), Topic: "rpm", Value: FloatValue(200)},
+		{Module: "view", DateTime: midnight.Add(2 * time.Minute), Topic: "rpm", Value: FloatValue(300)},
 	}
 
 	for _, r := range records {
@@ -123,7 +143,7 @@ func Test_SqliteStorage_View(t *testing.T) {
 		"temp": {
 			time.Now().Format("2006-01-02") + " 00:00": "36000",
 			time.Now().Format("2006-01-02") + " 00:01": "36100",
-			time.Now().Format("2006-01-02") + " 00:02": "36200",
+			time.Now().Format("2006-01-02") + " 00:02": "36250",
 		},
 		"rpm": {
 			time.Now().Format("2006-01-02") + " 00:00": "100",
@@ -149,14 +169,123 @@ func Test_SqliteStorage_readOnly(t *testing.T) {
 		log.Printf("[ERROR] Failed to open SQLite storage: %e", err)
 	}
 
-	err = store.Write(Data{Module: "testModule", Topic: "testTopic", Value: "testValue"})
+	err = store.Write(Data{Module: "testModule", Topic: "testTopic", Value: StringValue("testValue")})
 	assert.Error(t, err)
 	assert.Equal(t, "attempt to write a readonly database", err.Error())
 
-	s, err := NewSQLite(ctx, "file:/tmp/test_notcreated.db?mode=ro")
-	assert.NotNil(t, s)
-	assert.NoError(t, err)
-	err = s.Write(Data{Module: "testModule", Topic: "testTopic", Value: "testValue"})
+	// schema is migrated on open
+	_, err = NewSQLite(ctx, "file:/tmp/test_notcreated.db?mode=ro")
 	assert.Error(t, err)
-	assert.Equal(t, "unable to open database file: no such file or directory", err.Error())
+	assert.Contains(t, err.Error(), "unable to open database file: no such file or directory")
+}
+
+func Test_SqliteStorage_Legacy(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := fmt.Sprintf("%s/test_legacy.db", tempDir())
+	os.Remove(file)
+	defer os.Remove(file)
+
+	// table-per-module records, both string schema and typed ones
+	db, err := sql.Open("sqlite3", "file:"+file+"?mode=rwc")
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE `legacy` (DateTime TEXT, Topic TEXT, Value TEXT)")
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE INDEX `legacy_topic_datetime` ON `legacy` (Topic, DateTime)")
+	assert.NoError(t, err)
+	_, err = db.Exec("INSERT INTO `legacy` VALUES ('2023-04-05 06:07', 'temp', '23.75'), ('2023-04-05 06:08', 'heater', 'on'), ('2023-04-05 06:09:00.000', 'temp', 24)")
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE `we``ird` (DateTime TEXT, Topic TEXT, Value TEXT)")
+	assert.NoError(t, err)
+	_, err = db.Exec("INSERT INTO `we``ird` VALUES ('2023-04-05 06:07', 'flag', 'true')")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	store, err := NewSQLite(ctx, "file:"+file+"?mode=rwc")
+	assert.NoError(t, err)
+
+	data, err := store.Read("legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{
+		{Module: "legacy", DateTime: time.Date(2023, 4, 5, 6, 7, 0, 0, time.Local).UTC(), Topic: "temp", Value: FloatValue(23.75)},
+		{Module: "legacy", DateTime: time.Date(2023, 4, 5, 6, 8, 0, 0, time.Local).UTC(), Topic: "heater", Value: StringValue("on")},
+		{Module: "legacy", DateTime: time.Date(2023, 4, 5, 6, 9, 0, 0, time.UTC), Topic: "temp", Value: FloatValue(24)},
+	}, data)
+	data, err = store.Read("we`ird")
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "we`ird", DateTime: time.Date(2023, 4, 5, 6, 7, 0, 0, time.Local).UTC(), Topic: "flag", Value: BoolValue(true)}}, data)
+
+	modules, err := store.Modules()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"legacy", "we`ird"}, modules)
+
+	// module tables are dropped, schema version is set
+	var tables int
+	assert.NoError(t, store.DB.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('series', 'points')").Scan(&tables))
+	assert.Equal(t, 0, tables)
+	var version int
+	assert.NoError(t, store.DB.QueryRow("PRAGMA user_version").Scan(&version))
+	assert.Equal(t, len(sqliteMigrations), version)
+	var mode string
+	assert.NoError(t, store.DB.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	assert.Equal(t, "wal", mode)
+
+	// migrations are applied once
+	store, err = NewSQLite(ctx, "file:"+file+"?mode=rwc")
+	assert.NoError(t, err)
+	data, err = store.Read("legacy")
+	assert.NoError(t, err)
+	assert.Len(t, data, 3)
+}
+
+func Test_SqliteStorage_LegacySameMinute(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := fmt.Sprintf("%s/test_legacy_minute.db", tempDir())
+	os.Remove(file)
+	defer os.Remove(file)
+
+	// string schema has minute resolution, the topic has several records of the minute
+	db, err := sql.Open("sqlite3", "file:"+file+"?mode=rwc")
+	assert.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE `cave` (DateTime TEXT, Topic TEXT, Value TEXT)")
+	assert.NoError(t, err)
+	_, err = db.Exec("INSERT INTO `cave` VALUES ('2023-04-05 06:07', 'temp', '23.5'), ('2023-04-05 06:07', 'light', 'on'), " +
+		"('2023-04-05 06:07', 'temp', '23.6'), ('2023-04-05 06:07', 'temp', '23.7'), ('2023-04-05 06:08', 'temp', '23.8')")
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	store, err := NewSQLite(ctx, "file:"+file+"?mode=rwc")
+	assert.NoError(t, err)
+
+	minute := time.Date(2023, 4, 5, 6, 7, 0, 0, time.Local).UTC()
+	data, err := store.Range(Query{Module: "cave", Topics: []string{"temp"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{
+		{Module: "cave", DateTime: minute, Topic: "temp", Value: FloatValue(23.5)},
+		{Module: "cave", DateTime: minute.Add(time.Millisecond), Topic: "temp", Value: FloatValue(23.6)},
+		{Module: "cave", DateTime: minute.Add(2 * time.Millisecond), Topic: "temp", Value: FloatValue(23.7)},
+		{Module: "cave", DateTime: minute.Add(time.Minute), Topic: "temp", Value: FloatValue(23.8)},
+	}, data, "records of the minute are kept in order")
+	data, err = store.Range(Query{Module: "cave", Topics: []string{"light"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []Data{{Module: "cave", DateTime: minute, Topic: "light", Value: StringValue("on")}}, data)
+}
+
+func Test_SqliteStorage_Range(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := NewSQLite(ctx, fmt.Sprintf("file:%s/test_range.db?mode=rwc", tempDir()))
+	assert.NoError(t, err)
+	store.Cleanup("range")
+	store.Cleanup("agg")
+
+	testRange(t, store)
+	testAggregate(t, store)
 }
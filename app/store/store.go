@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
 	"github.com/parMaster/logserver/app/config"
@@ -12,15 +14,60 @@ import (
 var (
 	ErrRecordNotFound     = errors.New("record not found")
 	ErrPretendToCandelize = errors.New("pretending to candelize data")
+	ErrLocked             = errors.New("file is locked by another process")
 )
 
+// Data is a single record. DateTime is stored in UTC with millisecond precision,
+// current time is used if it is not set
 type Data struct {
-	Module   string
-	DateTime string
-	Topic    string
-	Value    string
+	Module   string    `json:"module"`
+	DateTime time.Time `json:"datetime"`
+	Topic    string    `json:"topic"`
+	Value    Value     `json:"value"`
 }
 
+// Query selects records of the Module. Topics and time bounds are optional.
+// Records are aggregated into buckets of Step if it is set, see Aggregate
+type Query struct {
+	Module string
+	Topics []string      // all the topics of the module if empty
+	From   time.Time     // inclusive, no lower bound if zero
+	To     time.Time     // exclusive, no upper bound if zero
+	Step   time.Duration // bucket size, raw records if zero
+	Agg    Agg           // aggregate function, avg if empty
+	Limit  int           // max number of records returned by Range, no limit if zero
+}
+
+// limit truncates the result to the query Limit
+func (q Query) limit(data []Data) []Data {
+	if q.Limit > 0 && len(data) > q.Limit {
+		return data[:q.Limit]
+	}
+	return data
+}
+
+// match checks if the record matches topics and time bounds of the query
+func (q Query) match(d Data) bool {
+	if !q.From.IsZero() && d.DateTime.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !d.DateTime.Before(q.To) {
+		return false
+	}
+	if len(q.Topics) == 0 {
+		return true
+	}
+	for _, t := range q.Topics {
+		if t == d.Topic {
+			return true
+		}
+	}
+	return false
+}
+
+// viewLayout is the DateTime format of View keys, local time
+const viewLayout = "2006-01-02 15:04:05.000"
+
 type Storer interface {
 	// Read reads records for the given module from the database.
 	Read(string) ([]Data, error)
@@ -28,26 +75,101 @@ type Storer interface {
 	Write(Data) error
 	// View returns the data for the given module in the format that is suitable for the web view.
 	View(string) (map[string]map[string]string, error)
+	// Range returns the records matching the query, ordered by topic and DateTime,
+	// aggregated if the query Step is set. ErrRecordNotFound is returned if the module doesn't exist
+	Range(Query) ([]Data, error)
+	// Delete removes the records matching the query topics and time bounds, returns the number of removed records
+	Delete(Query) (int64, error)
+	// Topics returns the topics of the module
+	Topics(string) ([]string, error)
+	// Modules returns the modules of the database
+	Modules() ([]string, error)
 }
 
-func Load(ctx context.Context, cfg config.Config, s *Storer) error {
-	var err error
-	switch cfg.Storage.Type {
-	case "bolt":
-		*s, err = NewBolt(ctx, cfg.Storage.Path)
+// Backend opens the storage at the path
+type Backend func(ctx context.Context, path string) (Storer, error)
+
+// backends are the storage types by name
+var backends = map[string]Backend{
+	"bolt": func(ctx context.Context, path string) (Storer, error) {
+		b, err := NewBolt(ctx, path)
 		if err != nil {
-			return fmt.Errorf("failed to init SQLite storage: %e", err)
+			return nil, err
 		}
-	case "sqlite":
-		*s, err = NewSQLite(ctx, cfg.Storage.Path)
+		return b, nil
+	},
+	"sqlite": func(ctx context.Context, path string) (Storer, error) {
+		s, err := NewSQLite(ctx, path)
 		if err != nil {
-			return fmt.Errorf("failed to init SQLite storage: %e", err)
+			return nil, err
 		}
-	case "":
+		return s, nil
+	},
+	"memory": func(context.Context, string) (Storer, error) {
+		return NewMemoryStore(), nil
+	},
+}
+
+// RegisterBackend adds the storage type to be used in config and storage URIs
+func RegisterBackend(typ string, b Backend) {
+	backends[typ] = b
+}
+
+// Open opens the storage by URI "type:path", e.g. "sqlite:store/mqttdata.db", "bolt:/mnt/ramdisk/mqttdata.bolt"
+// or "memory:". Leading "//" of the path is skipped, so "sqlite:///var/lib/mqttdata.db" is an absolute path
+func Open(ctx context.Context, uri string) (Storer, error) {
+	parts := strings.SplitN(uri, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid storage URI %q, expected type:path", uri)
+	}
+	return open(ctx, parts[0], strings.TrimPrefix(parts[1], "//"))
+}
+
+func open(ctx context.Context, typ, path string) (Storer, error) {
+	b, ok := backends[typ]
+	if !ok {
+		return nil, fmt.Errorf("storage type %s is not supported", typ)
+	}
+	s, err := b(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init %s storage: %w", typ, err)
+	}
+	return s, nil
+}
+
+// Load opens the configured storage, with the spool of failed writes, write-behind buffering
+// and retention policies if they are configured
+func Load(ctx context.Context, cfg config.Config, s *Storer) error {
+	if cfg.Storage.Type == "" {
 		log.Printf("[DEBUG] Storage is not configured")
 		return errors.New("storage is not configured")
-	default:
-		return fmt.Errorf("storage type %s is not supported", cfg.Storage.Type)
 	}
-	return err
+
+	batch := cfg.Storage.Batch.Size > 0
+	storeCtx, stop := ctx, func() {}
+	if batch {
+		// the backend outlives the context to write the buffered records
+		var cancel context.CancelFunc
+		storeCtx, cancel = context.WithCancel(context.Background())
+		stop = cancel
+	}
+
+	var err error
+	if *s, err = open(storeCtx, cfg.Storage.Type, cfg.Storage.Path); err != nil {
+		stop()
+		return err
+	}
+	if cfg.Storage.Spool.Path != "" {
+		if *s, err = NewSpool(storeCtx, *s, cfg.Storage.Spool); err != nil {
+			stop()
+			return err
+		}
+	}
+	if batch {
+		*s = NewBatcher(ctx, *s, cfg.Storage.Batch, stop)
+	}
+	if len(cfg.Retention) > 0 {
+		*s = NewRetention(*s, cfg.Retention)
+	}
+	return nil
 }
@@ -0,0 +1,128 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind is the type of the stored value
+type Kind uint8
+
+const (
+	KindString Kind = iota // string state, e.g. "on"
+	KindFloat              // numeric reading
+	KindBool               // boolean flag
+)
+
+// Value is a typed value of the record: a number, a bool or a string state
+type Value struct {
+	kind Kind
+	f    float64
+	b    bool
+	s    string
+}
+
+func FloatValue(f float64) Value { return Value{kind: KindFloat, f: f} }
+
+func BoolValue(b bool) Value { return Value{kind: KindBool, b: b} }
+
+func StringValue(s string) Value { return Value{kind: KindString, s: s} }
+
+// ParseValue detects the type of the raw value: finite numbers become floats,
+// "true" and "false" become bools, anything else is kept as a string state
+func ParseValue(s string) Value {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return FloatValue(f)
+	}
+	switch strings.ToLower(s) {
+	case "true":
+		return BoolValue(true)
+	case "false":
+		return BoolValue(false)
+	}
+	return StringValue(s)
+}
+
+func (v Value) Kind() Kind { return v.kind }
+
+// Float returns the numeric value, bools are 1 and 0. False if the value is not numeric
+func (v Value) Float() (float64, bool) {
+	switch v.kind {
+	case KindFloat:
+		return v.f, true
+	case KindBool:
+		if v.b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// String returns the text representation of the value
+func (v Value) String() string {
+	switch v.kind {
+	case KindFloat:
+		return strconv.FormatFloat(v.f, 'f', -1, 64)
+	case KindBool:
+		return strconv.FormatBool(v.b)
+	}
+	return v.s
+}
+
+// MarshalJSON encodes the value as json number, bool or string
+func (v Value) MarshalJSON() ([]byte, error) {
+	switch v.kind {
+	case KindFloat:
+		return json.Marshal(v.f)
+	case KindBool:
+		return json.Marshal(v.b)
+	}
+	return json.Marshal(v.s)
+}
+
+// UnmarshalJSON decodes json number, bool or string
+func (v *Value) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	switch r := raw.(type) {
+	case float64:
+		*v = FloatValue(r)
+	case bool:
+		*v = BoolValue(r)
+	case string:
+		*v = StringValue(r)
+	default:
+		return fmt.Errorf("unsupported value %s", string(data))
+	}
+	return nil
+}
+
+// legacyLayouts are the DateTime formats of string schema records, stored in local time
+var legacyLayouts = []string{"2006-01-02 15:04", "2006-01-02 15:04:05", "2006-01-02 15:04:05.999999999"}
+
+// parseLegacyTime parses DateTime of the string schema records
+func parseLegacyTime(s string) (time.Time, error) {
+	for _, l := range legacyLayouts {
+		if t, err := time.ParseInLocation(l, s, time.Local); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid datetime %q", s)
+}
+
+// normalize sets the missing DateTime to now and brings it to UTC with millisecond precision
+func normalize(d Data) Data {
+	if d.DateTime.IsZero() {
+		d.DateTime = time.Now()
+	}
+	d.DateTime = d.DateTime.UTC().Truncate(time.Millisecond)
+	return d
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Value(t *testing.T) {
+
+	tbl := []struct {
+		in   string
+		kind Kind
+		str  string
+		json string
+	}{
+		{"23.75", KindFloat, "23.75", "23.75"},
+		{" -127 ", KindFloat, "-127", "-127"},
+		{"1e3", KindFloat, "1000", "1000"},
+		{"true", KindBool, "true", "true"},
+		{"FALSE", KindBool, "false", "false"},
+		{"on", KindString, "on", `"on"`},
+		{"nan", KindString, "nan", `"nan"`},
+		{"Inf", KindString, "Inf", `"Inf"`},
+		{"", KindString, "", `""`},
+	}
+
+	for _, tt := range tbl {
+		v := ParseValue(tt.in)
+		assert.Equal(t, tt.kind, v.Kind(), tt.in)
+		assert.Equal(t, tt.str, v.String(), tt.in)
+
+		j, err := json.Marshal(v)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.json, string(j))
+
+		var back Value
+		assert.NoError(t, json.Unmarshal(j, &back))
+		assert.Equal(t, v, back)
+	}
+
+	f, ok := BoolValue(true).Float()
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, f)
+	_, ok = StringValue("on").Float()
+	assert.False(t, ok)
+
+	var v Value
+	assert.Error(t, json.Unmarshal([]byte(`{"a":1}`), &v))
+}
@@ -9,3 +9,12 @@ var View_html string
 
 //go:embed chart_tpl.min.js
 var Chart_tpl_min_js string
+
+//go:embed publish.html
+var Publish_html string
+
+//go:embed devices.html
+var Devices_html string
+
+//go:embed topics.html
+var Topics_html string